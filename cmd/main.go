@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 )
 
 const (
@@ -19,37 +20,206 @@ const (
 
 var config gameboy.Config
 
+var (
+	configFile string
+	gbsTrack   int
+	wavFile    string
+	wavLength  int
+	recordFile string
+	playFile   string
+	readOnly   bool
+	aviFile    string
+	aviFrames  int
+	dumpFrame  int
+	dumpDir    string
+	albumDir   string
+	terminal   bool
+	testOut    string
+)
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
 
+	if err := readConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		return
+	}
+
 	if len(args) == 0 {
-		fmt.Printf("usage: %s [flags] rom\n", os.Args[0])
+		fmt.Printf("usage: %s [flags] rom|gbs\n", os.Args[0])
+		fmt.Printf("       %s [flags] test list...\n", os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
 
+	config.TiltAxes = config.TiltAxisX >= 0 || config.TiltAxisY >= 0
+
 	// The bounds are arbitrary, but seem more than reasonable.
 	if config.Scale < 1 || config.Scale > 6 {
 		fmt.Printf("unlikely scaling factor: %dx\n", config.Scale)
 		return
 	}
 
-	if err := os.MkdirAll(config.SaveDir, 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+	if config.TurboSpeed < 0 || config.SlowSpeed < 0 {
+		fmt.Println("speeds must not be negative")
+		return
+	}
+
+	for _, dir := range []string{config.SaveDir, config.ScreenshotDir, testOut, albumDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			return
+		}
+	}
+
+	switch {
+	case recordFile != "" && playFile != "":
+		fmt.Println("-record and -play cannot be used together")
+		return
+	case recordFile != "":
+		config.MovieFile = recordFile
+		config.MovieMode = gameboy.MovieRecord
+	case playFile != "":
+		config.MovieFile = playFile
+		config.MovieMode = gameboy.MoviePlay
+		if readOnly {
+			config.MovieMode = gameboy.MovieReadOnly
+		}
+	}
+
+	if aviFile != "" {
+		if playFile == "" {
+			fmt.Println("-avi needs a movie to play (-play)")
+		} else if e := gameboy.RenderMovie(args[0], playFile,
+			aviFrames, config, aviFile); e != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], e)
+		}
+		return
+	}
+
+	if args[0] == "test" {
+		if len(args) == 1 {
+			fmt.Printf("usage: %s [flags] test list...\n", os.Args[0])
+		} else if !runTests(args[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if dumpFrame > 0 {
+		if e := gameboy.DumpVRAM(args[0], dumpFrame, config,
+			dumpDir); e != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], e)
+		}
+		return
+	}
+
+	if albumDir != "" {
+		if n, e := gameboy.ExportAlbum(args[0], config,
+			albumDir); e != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], e)
+		} else {
+			fmt.Printf("exported %d photos\n", n)
+		}
+		return
+	}
+
+	isGBS := strings.HasSuffix(strings.ToLower(args[0]), ".gbs")
+	if wavFile != "" {
+		if !isGBS {
+			fmt.Println("-wav is only supported for GBS files")
+		} else if e := gameboy.RenderGBS(args[0], gbsTrack,
+			wavLength, config, wavFile); e != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], e)
+		}
 		return
 	}
 
 	err := make(chan interface{})
-	out := make(chan int)
-	go gameboy.Start(args[0], config, out, err)
+	out := make(chan interface{})
+	switch {
+	case isGBS && terminal:
+		fmt.Println("-term is not supported for GBS files")
+		return
+	case isGBS:
+		go gameboy.StartGBS(args[0], gbsTrack, config, out, err)
+	case terminal:
+		go gameboy.StartTerminal(args[0], config, out, err)
+	default:
+		go gameboy.Start(args[0], config, out, err)
+	}
 
 	for wait(out, err) {
 		// keep waiting (do nothing)
 	}
 }
 
-func wait(out chan int, error chan interface{}) bool {
+// runTests runs the ROM tests in each list, printing a line for each
+// and a summary, and reports whether they all passed.
+func runTests(lists []string) bool {
+	passed, failed := 0, 0
+	for _, list := range lists {
+		tests, err := gameboy.ReadROMTests(list)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			return false
+		}
+		for _, t := range tests {
+			if testOut != "" {
+				t.Output = path.Join(testOut,
+					strings.Replace(t.Name, "/", "_", -1)+".png")
+			}
+			res, err := gameboy.RunROMTest(t, config)
+			switch {
+			case err != nil:
+				fmt.Printf("FAIL %s: %v\n", t.Name, err)
+				failed++
+			case !res.Pass:
+				fmt.Printf("FAIL %s: %s\n", t.Name, res.Reason)
+				failed++
+			default:
+				fmt.Printf("PASS %s (%d frames, %s)\n", t.Name,
+					res.Frames, res.Hash)
+				passed++
+			}
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	return failed == 0
+}
+
+// readConfig applies the configuration file, if there is one.
+// Options given on the command line take precedence over the file.
+func readConfig() os.Error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if _, err := os.Stat(configFile); err != nil && !given["config"] {
+		return nil // the default file need not exist
+	}
+
+	set := func(name, value string) os.Error {
+		switch {
+		case name == "config":
+			return os.NewError("config may not be set in a file")
+		case given[name]:
+			return nil
+		case flag.Lookup(name) == nil:
+			return fmt.Errorf("unknown option '%s'", name)
+		case !flag.Set(name, value):
+			return fmt.Errorf("bad value for %s: '%s'", name, value)
+		}
+		return nil
+	}
+	return gameboy.ReadConfig(configFile, &config, set)
+}
+
+func wait(out chan interface{}, error chan interface{}) bool {
 	select {
 	case err := <-error:
 		if err != nil {
@@ -69,13 +239,16 @@ func wait(out chan int, error chan interface{}) bool {
 					"cleaning up...\n",
 					sig)
 			}
-			out <- 1 // notify gameboy
+			out <- gameboy.Quit{}
 		}
 	}
 	return true
 }
 
 func init() {
+	flag.StringVar(&configFile, "config",
+		path.Join(os.Getenv("HOME"), dotCmdName, "config"),
+		"configuration file")
 	flag.StringVar(&config.SaveDir, "savedir",
 		path.Join(os.Getenv("HOME"), dotCmdName, "sav"),
 		"where to store save files")
@@ -86,6 +259,8 @@ func init() {
 	flag.IntVar(&config.AudioBuffers, "nbuf", 4, "audio buffers")
 	flag.StringVar(&config.AudioDriver, "adev", "",
 		"libao driver name (e.g. pulse, alsa)")
+	flag.BoolVar(&terminal, "term", false,
+		"run in the terminal, with no window (-adev none for silence)")
 	flag.BoolVar(&config.Fullscreen, "fs", false, "run in fullscreen mode")
 	flag.IntVar(&config.Joystick, "joystick", 0, "which joystick to use")
 	flag.IntVar(&config.JoyButtonA, "joy-a", 1, "joystick A button")
@@ -94,4 +269,67 @@ func init() {
 	flag.IntVar(&config.JoyButtonSelect, "joy-select", 10, "joystick select button")
 	flag.IntVar(&config.JoyAxisX, "joy-x", 0, "joystick x-axis (for d-pad)")
 	flag.IntVar(&config.JoyAxisY, "joy-y", 1, "joystick y-axis (for d-pad)")
+	flag.IntVar(&config.TiltAxisX, "tilt-x", -1,
+		"joystick axis to tilt left and right (MBC7)")
+	flag.IntVar(&config.TiltAxisY, "tilt-y", -1,
+		"joystick axis to tilt up and down (MBC7)")
+	flag.BoolVar(&config.TiltMouse, "tilt-mouse", false,
+		"tilt with the mouse (MBC7)")
+	flag.IntVar(&config.TurboSpeed, "turbo", 0,
+		"fast-forward speed in percent (0 for unlimited)")
+	flag.IntVar(&config.SlowSpeed, "slow", 50,
+		"slow motion speed in percent (0 for the default)")
+	flag.StringVar(&config.ScreenshotDir, "shotdir", "",
+		"where to save screenshots (default: savedir)")
+	flag.BoolVar(&config.ScreenshotScaled, "shotscale", false,
+		"also save screenshots at the display scale")
+	flag.BoolVar(&config.ScreenshotOSD, "shotosd", false,
+		"include the on-screen display in screenshots")
+	flag.BoolVar(&config.OSD, "osd", true,
+		"show messages and status on the screen")
+	flag.BoolVar(&config.ShowFPS, "fps", false, "show the frame rate")
+	flag.BoolVar(&config.ShowInput, "showinput", false,
+		"show the buttons held in each frame")
+	flag.IntVar(&config.GIFSeconds, "gifsecs", 10,
+		"seconds kept for GIF replays (0 to disable)")
+	flag.IntVar(&config.GIFSkip, "gifskip", 1,
+		"frames skipped between each one used in GIFs")
+	flag.StringVar(&config.Palette, "palette", "",
+		"colours for the screen (e.g. grey, pocket, cgb-blue)")
+	flag.StringVar(&config.Filter, "filter", "none",
+		"scaling filter: scale2x, scale3x, hq2x-hq4x or xbr2x-xbr4x")
+	flag.StringVar(&config.Effect, "effect", "none",
+		"LCD effect: grid, scanlines or dotmatrix")
+	flag.BoolVar(&config.Blend, "blend", false,
+		"blend each frame with the last (LCD ghosting)")
+	flag.StringVar(&config.Multicart, "multicart", "auto",
+		"treat MBC1 ROMs as multicarts: auto, yes or no")
+	flag.StringVar(&config.IR, "ir", "none",
+		"infrared port of HuC cartridges: none or loop")
+	flag.StringVar(&config.Camera, "camera", "",
+		"PNG image, or directory of them, for the Pocket Camera to see")
+	flag.StringVar(&albumDir, "album", "",
+		"export the Pocket Camera's photos to PNG files in this directory")
+	flag.StringVar(&config.VGMFile, "vgm", "",
+		"log sound register writes to this VGM file")
+	flag.StringVar(&recordFile, "record", "",
+		"record an input movie to this file")
+	flag.StringVar(&playFile, "play", "", "play back an input movie")
+	flag.BoolVar(&readOnly, "read-only", false,
+		"never change the movie given with -play")
+	flag.StringVar(&config.MovieStart, "movie-start", "power-on",
+		"start recording from power-on, sram, or a state slot (0-9)")
+	flag.StringVar(&aviFile, "avi", "",
+		"render the movie given with -play to this AVI file")
+	flag.IntVar(&aviFrames, "frames", 0,
+		"frames to render with -avi (default: the whole movie)")
+	flag.IntVar(&dumpFrame, "dump", 0,
+		"save the debug views as PNG files after this many frames")
+	flag.StringVar(&dumpDir, "dumpdir", ".", "where -dump saves its files")
+	flag.StringVar(&testOut, "testout", "",
+		"where the test command saves the last frame of each test")
+	flag.IntVar(&gbsTrack, "track", 0, "GBS track to play (default: first)")
+	flag.StringVar(&wavFile, "wav", "",
+		"render a GBS track to this WAV file instead of playing it")
+	flag.IntVar(&wavLength, "length", 120, "seconds to render with -wav")
 }
@@ -0,0 +1,70 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"ao"
+)
+
+// Sound is played through libao, opened by the frontends with
+// newMixer. Built without SDL (make NOSDL=1), the package leaves
+// libao out as well, and noao.go replaces this file.
+
+type aoOutput struct {
+	dev *ao.Device
+}
+
+func (out aoOutput) play(buf []int16) {
+	out.dev.Play16(buf)
+}
+
+func (out aoOutput) close() {
+	out.dev.Close()
+	ao.Shutdown()
+}
+
+func audioFormat(cfg *Config) ao.SampleFormat {
+	return ao.SampleFormat{
+		Bits:       16,
+		Rate:       cfg.AudioFreq,
+		Channels:   2,
+		ByteFormat: ao.FormatNative,
+		Matrix:     "L,R",
+	}
+}
+
+func newMixer(mem *memory) (mix *mixer, err interface{}) {
+	format := audioFormat(mem.config)
+
+	ao.Initialize()
+
+	id := ao.DriverID(mem.config.AudioDriver)
+	if id < 0 {
+		id = ao.DefaultDriverID()
+	}
+
+	var device *ao.Device
+	device, err = ao.OpenLive(id, &format)
+	if err != nil {
+		ao.Shutdown()
+		return
+	}
+
+	mix = newMixerOutput(mem, aoOutput{device})
+	mix.live = true
+
+	if mem.config.Verbose {
+		info, _ := ao.DriverInfo(id)
+		fmt.Println("Opened audio:")
+		fmt.Printf("  driver:      [%s] %s\n", info.ShortName, info.Name)
+		fmt.Printf("  rate:        %dHz\n", format.Rate)
+		fmt.Printf("  channels:    %d\n", format.Channels)
+		fmt.Printf("  buffer size: %d samples\n", 1024)
+		fmt.Printf("  buffers:     %d\n", len(mix.buf))
+	}
+
+	return mix, nil
+}
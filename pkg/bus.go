@@ -0,0 +1,16 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+// A Bus is all the CPU is connected to. It reads and writes through
+// the bus, and after each instruction (or interrupt) calls Tick with
+// the number of ticks taken, so that the rest of the machine can
+// catch up. The memory map is the usual bus; others run the CPU
+// without a display (see gbsBus), or on plain RAM for testing.
+type Bus interface {
+	Read(addr uint16) byte
+	Write(addr uint16, x byte)
+	Tick(t int)
+}
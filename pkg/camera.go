@@ -0,0 +1,364 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// The sensor is 128x128 pixels, of which the middle 112 rows
+	// make the picture.
+	sensorW = 128
+	sensorH = 128
+	photoW  = 128
+	photoH  = 112
+
+	cameraRegs   = 0x36   // A000-A035h
+	cameraOutput = 0x0100 // where a picture is put, in RAM bank 0
+	photoSize    = photoW * photoH / 4
+	cameraRAM    = 0x20000
+)
+
+// Edge enhancement ratios, in quarters, selected by A004h bits 4-6.
+var edgeRatios = [8]int{2, 3, 4, 5, 8, 12, 16, 20}
+
+// A cameraCart is the Pocket Camera's controller: up to 64 ROM banks,
+// 16 RAM banks (which can be read even when not enabled), and the
+// M64282FP image sensor. Selecting RAM bank 10h maps the sensor's
+// registers into A000-A035h instead (repeated every 80h):
+//
+//   A000h    bit 0 starts a capture, and reads 1 until it is done
+//   A001h    bit 7 is N, bits 5-6 the edge mode (none, horizontal,
+//            vertical or both)
+//   A002-3h  the exposure time, high byte first
+//   A004h    bits 4-6 select the edge ratio, bit 3 inverts
+//   A006-35h the dithering matrix: 3 thresholds for each of 4x4
+//            pixels, from dark to light
+//
+// The rest of the sensor's settings (gain and voltage references) are
+// ignored. RAM reads as 00h while a capture is in progress.
+type cameraCart struct {
+	cartridge
+	regs    [cameraRegs]byte
+	regMode bool
+	busy    int // ticks until the capture is done
+	shots   int // taken, for choosing the next image
+	sensor  [][]byte
+}
+
+// newCamera makes the camera's controller, which always has 128K of
+// RAM whatever the header says.
+func newCamera(rom romImage) Cartridge {
+	c := &cameraCart{cartridge: newBaseCartridge(rom)}
+	if len(c.ram) != cameraRAM {
+		c.ram = make([]byte, cameraRAM)
+	}
+	return c
+}
+
+func (c *cameraCart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.ramEnable = x&0x0F == 0x0A
+	case addr < 0x4000:
+		c.romBank = int(x & 0x3F)
+	case addr < 0x6000:
+		c.regMode = x&0x10 != 0
+		c.ramBank = int(x & 0x0F)
+	}
+}
+
+func (c *cameraCart) ReadRAM(addr uint16) byte {
+	switch {
+	case c.regMode:
+		if addr&0x7F == 0 {
+			return c.regs[0]
+		}
+		return 0x00
+	case c.busy > 0:
+		return 0x00
+	}
+	return c.ram[c.ramAddr(addr)]
+}
+
+func (c *cameraCart) WriteRAM(addr uint16, x byte) {
+	if !c.regMode {
+		if c.ramEnable && c.busy == 0 {
+			c.ram[c.ramAddr(addr)] = x
+		}
+		return
+	}
+	i := int(addr & 0x7F)
+	if i >= cameraRegs {
+		return
+	}
+	if i == 0 {
+		if x&1 != 0 && c.busy == 0 {
+			c.capture()
+			c.busy = c.captureTicks()
+		}
+		x &= 0x06
+		if c.busy > 0 {
+			x |= 1
+		}
+	}
+	c.regs[i] = x
+}
+
+func (c *cameraCart) Tick(t int) {
+	if c.busy > 0 {
+		if c.busy -= t; c.busy <= 0 {
+			c.busy = 0
+			c.regs[0] &^= 1
+		}
+	}
+}
+
+func (c *cameraCart) exposure() int {
+	return int(c.regs[2])<<8 | int(c.regs[3])
+}
+
+// captureTicks returns how long a capture takes with the current
+// settings, which is mostly the exposure time.
+func (c *cameraCart) captureTicks() int {
+	t := 32446 + 16*c.exposure()
+	if c.regs[1]&0x80 == 0 {
+		t += 512
+	}
+	return t
+}
+
+// capture takes a picture of the next image the sensor sees and puts
+// it in RAM as 16x14 tiles. The picture is taken all at once, with
+// the registers as they are when the capture starts, but cannot be
+// read until it is done.
+func (c *cameraCart) capture() {
+	var src []byte
+	if len(c.sensor) != 0 {
+		src = c.sensor[c.shots%len(c.sensor)]
+	}
+	c.shots++
+
+	// Exposure scales the light, with 300h taking the image as it is.
+	var pix [photoW * photoH]int
+	exposure := c.exposure()
+	for i := range pix {
+		v := 0x80
+		if src != nil {
+			v = int(src[(sensorH-photoH)/2*sensorW+i])
+		}
+		if v = v * exposure / 0x0300; v > 0xFF {
+			v = 0xFF
+		}
+		pix[i] = v
+	}
+	at := func(x, y int) int {
+		x = clampInt(x, 0, photoW-1)
+		y = clampInt(y, 0, photoH-1)
+		return pix[y*photoW+x]
+	}
+
+	mode := c.regs[1] >> 5 & 3
+	ratio := edgeRatios[c.regs[4]>>4&7]
+	invert := c.regs[4]&0x08 != 0
+	out := c.ram[cameraOutput : cameraOutput+photoSize]
+	for i := range out {
+		out[i] = 0
+	}
+	for y := 0; y < photoH; y++ {
+		for x := 0; x < photoW; x++ {
+			p := at(x, y)
+			e := 0
+			if mode&1 != 0 {
+				e += 2*p - at(x-1, y) - at(x+1, y)
+			}
+			if mode&2 != 0 {
+				e += 2*p - at(x, y-1) - at(x, y+1)
+			}
+			v := clampInt(p+e*ratio/4, 0, 0xFF)
+			if invert {
+				v = 0xFF - v
+			}
+			shade := c.dither(x, y, v)
+			tile := y/8*(photoW/8) + x/8
+			addr := tile*16 + y%8*2
+			bit := byte(0x80) >> uint(x%8)
+			if shade&1 != 0 {
+				out[addr] |= bit
+			}
+			if shade&2 != 0 {
+				out[addr+1] |= bit
+			}
+		}
+	}
+}
+
+// dither returns the shade (0 for white to 3 for black) for the value
+// v at (x, y), from the matrix thresholds for that pixel.
+func (c *cameraCart) dither(x, y, v int) int {
+	t := c.regs[6+(y%4*4+x%4)*3:]
+	switch {
+	case v < int(t[0]):
+		return 3
+	case v < int(t[1]):
+		return 2
+	case v < int(t[2]):
+		return 1
+	}
+	return 0
+}
+
+func clampInt(x, min, max int) int {
+	switch {
+	case x < min:
+		return min
+	case x > max:
+		return max
+	}
+	return x
+}
+
+func (c *cameraCart) StateFields() []interface{} {
+	return append(c.cartridge.StateFields(), c.regs[:], &c.regMode,
+		&c.busy, &c.shots)
+}
+
+// loadSensorImages reads what the sensor sees: a PNG image, or each
+// PNG image in a directory in order of name (one for each capture,
+// starting again after the last). Images are cropped to a square and
+// scaled to the sensor's size.
+func loadSensorImages(name string) ([][]byte, os.Error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		// Not a directory.
+		img, err := readSensorImage(name)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{img}, nil
+	}
+
+	sort.Strings(names)
+	var images [][]byte
+	for _, n := range names {
+		if strings.ToLower(path.Ext(n)) != ".png" {
+			continue
+		}
+		img, err := readSensorImage(path.Join(name, n))
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no PNG images in %s", name)
+	}
+	return images, nil
+}
+
+func readSensorImage(name string) ([]byte, os.Error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return sensorImage(img), nil
+}
+
+// sensorImage crops img to the middle square and scales it to the
+// sensor, as brightness from 0 (black) to FFh.
+func sensorImage(img image.Image) []byte {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+	pix := make([]byte, sensorW*sensorH)
+	for y := 0; y < sensorH; y++ {
+		for x := 0; x < sensorW; x++ {
+			r, g, b, _ := img.At(x0+x*side/sensorW,
+				y0+y*side/sensorH).RGBA()
+			pix[y*sensorW+x] = byte((299*r + 587*g + 114*b) / 1000 >> 8)
+		}
+	}
+	return pix
+}
+
+const (
+	albumPhotos = 30
+	albumIndex  = 0x11B2 // the number of each photo, or FFh if empty
+	albumStart  = 0x2000 // photo n is at albumStart + n*1000h
+)
+
+// photoImage returns the picture stored at data (as 16x14 tiles).
+func photoImage(data []byte) *image.Paletted {
+	grey := palettes["grey"][0]
+	img := image.NewPaletted(photoW, photoH,
+		image.PalettedColorModel{grey[0], grey[1], grey[2], grey[3]})
+	for y := 0; y < photoH; y++ {
+		for x := 0; x < photoW; x++ {
+			addr := (y/8*(photoW/8)+x/8)*16 + y%8*2
+			shift := uint(7 - x%8)
+			img.Pix[y*img.Stride+x] = data[addr]>>shift&1 |
+				data[addr+1]>>shift&1<<1
+		}
+	}
+	return img
+}
+
+// ExportAlbum saves each photo in the Pocket Camera's album, from the
+// battery save for the ROM image at rom, as a PNG file in dir. It
+// returns the number of photos saved.
+func ExportAlbum(rom string, cfg Config, dir string) (int, os.Error) {
+	data, e := loadROM(rom)
+	if e != nil {
+		return 0, fmt.Errorf("%v", e)
+	}
+	mem, e := newMemory(data, &cfg)
+	if e != nil {
+		return 0, fmt.Errorf("%v", e)
+	}
+	cam, ok := mem.cart.(*cameraCart)
+	if !ok {
+		return 0, os.NewError("not a Pocket Camera ROM")
+	}
+	if e := mem.load(cfg.SaveDir); e != nil {
+		return 0, fmt.Errorf("%v", e)
+	}
+
+	n := 0
+	for i := 0; i < albumPhotos; i++ {
+		num := cam.ram[albumIndex+i]
+		if num == 0xFF {
+			continue
+		}
+		name := path.Join(dir, fmt.Sprintf("%s-%02d.png",
+			mem.rom.title(), num+1))
+		photo := cam.ram[albumStart+i*0x1000:]
+		if err := writePNG(name, photoImage(photo)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"image"
+	"testing"
+)
+
+// halfDark is a sensor image, black on the left and white on the
+// right.
+func halfDark() []byte {
+	pix := make([]byte, sensorW*sensorH)
+	for i := range pix {
+		if i%sensorW >= sensorW/2 {
+			pix[i] = 0xFF
+		}
+	}
+	return pix
+}
+
+func TestCameraCapture(t *testing.T) {
+	c := newTestCartridge(t, testROM(64, 0xFC, 4))
+	c.(*cameraCart).sensor = [][]byte{halfDark()}
+	c.WriteROM(0x0000, 0x0A)
+	c.WriteROM(0x4000, 0x10)
+	c.WriteRAM(0xA002, 0x03) // exposure 300h
+	c.WriteRAM(0xA003, 0x00)
+	for i := uint16(0); i < 48; i += 3 {
+		c.WriteRAM(0xA006+i, 0x40)
+		c.WriteRAM(0xA007+i, 0x80)
+		c.WriteRAM(0xA008+i, 0xC0)
+	}
+	c.WriteRAM(0xA000, 0x01)
+	if x := c.ReadRAM(0xA000); x != 0x01 {
+		t.Errorf("A000h read %02X while capturing", x)
+	}
+
+	c.WriteROM(0x4000, 0x00)
+	if x := c.ReadRAM(0xA100); x != 0x00 {
+		t.Errorf("RAM read %02X while capturing", x)
+	}
+	c.Tick(c.(*cameraCart).captureTicks())
+	c.WriteROM(0x4000, 0x10)
+	if x := c.ReadRAM(0xA000); x != 0x00 {
+		t.Errorf("A000h read %02X after capturing", x)
+	}
+
+	c.WriteROM(0x4000, 0x00)
+	for _, x := range []struct {
+		addr uint16
+		want byte
+	}{
+		{0xA100, 0xFF}, // tile 0, black
+		{0xA101, 0xFF},
+		{0xA180, 0x00}, // tile 8, white
+		{0xA181, 0x00},
+	} {
+		if got := c.ReadRAM(x.addr); got != x.want {
+			t.Errorf("%04X read %02X, want %02X", x.addr, got, x.want)
+		}
+	}
+
+	img := photoImage(c.(*cameraCart).ram[cameraOutput:])
+	if a, b := img.Pix[0], img.Pix[photoW-1]; a != 3 || b != 0 {
+		t.Errorf("photo shades %d and %d, want 3 and 0", a, b)
+	}
+}
+
+func TestCameraEdges(t *testing.T) {
+	// Mid grey, with a white line down the middle.
+	pix := make([]byte, sensorW*sensorH)
+	for i := range pix {
+		pix[i] = 0x80
+		if i%sensorW == sensorW/2 {
+			pix[i] = 0xFF
+		}
+	}
+	c := newTestCartridge(t, testROM(64, 0xFC, 4)).(*cameraCart)
+	c.sensor = [][]byte{pix}
+	c.regs[2] = 0x03
+	for i := 6; i < cameraRegs; i += 3 {
+		c.regs[i], c.regs[i+1], c.regs[i+2] = 0x40, 0x80, 0xC0
+	}
+	shade := func() byte {
+		c.capture()
+		return photoImage(c.ram[cameraOutput:]).Pix[sensorW/2-1]
+	}
+	if x := shade(); x != 1 {
+		t.Errorf("shade %d beside the line, want 1", x)
+	}
+	c.regs[1] = 0x20 // horizontal edges
+	c.regs[4] = 0x20 // at a ratio of 1
+	if x := shade(); x != 3 {
+		t.Errorf("shade %d beside the line with edges, want 3", x)
+	}
+	c.regs[1] = 0x40 // vertical edges only
+	if x := shade(); x != 1 {
+		t.Errorf("shade %d beside the line with vertical edges, want 1", x)
+	}
+}
+
+func TestSensorImage(t *testing.T) {
+	// Only the middle square is seen; its left half is white.
+	img := image.NewRGBA(256, 128)
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 256; x++ {
+			c := image.RGBAColor{0, 0, 0, 0xFF}
+			if x < 32 || x >= 64 && x < 128 {
+				c = image.RGBAColor{0xFF, 0xFF, 0xFF, 0xFF}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	pix := sensorImage(img)
+	if a, b := pix[0], pix[sensorW-1]; a != 0xFF || b != 0 {
+		t.Errorf("sensor read %02X and %02X, want FF and 00", a, b)
+	}
+}
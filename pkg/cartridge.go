@@ -0,0 +1,235 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// A Cartridge is what is plugged into the machine: the ROM, any RAM
+// and clock, and the memory bank controller which maps them into the
+// address space. Each kind of controller is a separate type, made by
+// the function registered for it in mappers (see mbc.go).
+type Cartridge interface {
+	// ReadROM and WriteROM access 0000-7FFFh. Writes go to the
+	// controller's registers.
+	ReadROM(addr uint16) byte
+	WriteROM(addr uint16, x byte)
+
+	// ReadRAM and WriteRAM access A000-BFFFh.
+	ReadRAM(addr uint16) byte
+	WriteRAM(addr uint16, x byte)
+
+	// Tick runs any clock in the cartridge for t ticks.
+	Tick(t int)
+
+	// Battery returns what is kept by the battery (the RAM, and the
+	// clock if there is one), as saved to a file. It is nil if
+	// there is no battery, or nothing for it to keep. SetBattery
+	// restores what Battery returned.
+	Battery() []byte
+	SetBattery(data []byte) os.Error
+
+	// StateFields lists the controller's part of the machine
+	// state, in the form used by stateFields.
+	StateFields() []interface{}
+
+	// Banks returns the ROM bank mapped at 4000h and the RAM bank
+	// mapped at A000h, for debugging.
+	Banks() (rom, ram int)
+}
+
+// newCartridge makes a cartridge for the ROM image, with the
+// controller named in its header. MBC1 multicarts, which the header
+// does not tell apart, are guessed at (see isMulticart) unless
+// cfg.Multicart is "yes" or "no". An infrared port sees cfg.IRPeer,
+// or the other end of cfg.IRLink, or is looped back if cfg.IR is
+// "loop". A camera sees the images in cfg.Camera.
+func newCartridge(rom romImage, cfg *Config) (Cartridge, interface{}) {
+	mbc, err := rom.mbcType()
+	if err != nil {
+		return nil, err
+	}
+	if mbc == mbc1 {
+		switch cfg.Multicart {
+		case "", "auto":
+			if rom.isMulticart() {
+				mbc = mbc1m
+			}
+		case "yes":
+			mbc = mbc1m
+		case "no":
+		default:
+			return nil, fmt.Sprintf("bad multicart setting '%s' "+
+				"(expected auto, yes or no)", cfg.Multicart)
+		}
+	}
+	mapper, ok := mappers[mbc]
+	if !ok {
+		return nil, fmt.Sprintf("unsupported memory bank controller "+
+			"(%02Xh)", rom[0x0147])
+	}
+	cart := mapper(rom)
+	if dev, ok := cart.(irDevice); ok {
+		switch cfg.IR {
+		case "", "none":
+		case "loop":
+			dev.infrared().loopBack()
+		default:
+			return nil, fmt.Sprintf("bad infrared setting '%s' "+
+				"(expected none or loop)", cfg.IR)
+		}
+		switch {
+		case cfg.IRPeer != nil:
+			dev.infrared().peer = cfg.IRPeer
+		case cfg.IRLink != nil:
+			if err := cfg.IRLink.attach(dev.infrared()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cam, ok := cart.(*cameraCart); ok && cfg.Camera != "" {
+		images, err := loadSensorImages(cfg.Camera)
+		if err != nil {
+			return nil, err
+		}
+		cam.sensor = images
+	}
+	return cart, nil
+}
+
+// A cartridge has what the controllers have in common: the ROM and
+// RAM, and the banks of them which are mapped in. Its methods are
+// enough for a cartridge without a controller, and the others embed
+// it and remap the banks when their registers are written.
+type cartridge struct {
+	rom      romImage
+	ram      []byte
+	romBanks int
+	battery  bool
+
+	romBank0  int // mapped at 0000h
+	romBank   int // mapped at 4000h
+	ramBank   int
+	ramEnable bool
+}
+
+// newBaseCartridge sets up a cartridge with RAM of the size given in
+// the header (if it has any) and bank 1 at 4000h.
+func newBaseCartridge(rom romImage) cartridge {
+	c := cartridge{rom: rom, romBanks: len(rom) / 0x4000,
+		battery: rom.hasBattery(), romBank: 1}
+	if rom.hasRAM() {
+		c.ram = make([]byte, rom.ramSize())
+	}
+	return c
+}
+
+func (c *cartridge) ReadROM(addr uint16) byte {
+	bank := c.romBank
+	if addr < 0x4000 {
+		bank = c.romBank0
+	}
+	return c.rom[bank%c.romBanks*0x4000+int(addr&0x3FFF)]
+}
+
+func (c *cartridge) WriteROM(addr uint16, x byte) {}
+
+func (c *cartridge) ReadRAM(addr uint16) byte {
+	if !c.ramEnable || len(c.ram) == 0 {
+		return 0xFF
+	}
+	return c.ram[c.ramAddr(addr)]
+}
+
+func (c *cartridge) WriteRAM(addr uint16, x byte) {
+	if c.ramEnable && len(c.ram) != 0 {
+		c.ram[c.ramAddr(addr)] = x
+	}
+}
+
+// ramAddr returns the offset in the RAM of addr in the current bank.
+// RAM smaller than a bank is repeated.
+func (c *cartridge) ramAddr(addr uint16) int {
+	return (c.ramBank*0x2000 + int(addr-0xA000)) % len(c.ram)
+}
+
+func (c *cartridge) Tick(t int) {}
+
+func (c *cartridge) Battery() []byte {
+	if !c.battery || len(c.ram) == 0 {
+		return nil
+	}
+	data := make([]byte, len(c.ram))
+	copy(data, c.ram)
+	return data
+}
+
+func (c *cartridge) SetBattery(data []byte) os.Error {
+	if len(data) != len(c.ram) {
+		return fmt.Errorf("save should be %d bytes (%d found)",
+			len(c.ram), len(data))
+	}
+	copy(c.ram, data)
+	return nil
+}
+
+func (c *cartridge) StateFields() []interface{} {
+	return []interface{}{c.ram, &c.romBank0, &c.romBank, &c.ramBank,
+		&c.ramEnable}
+}
+
+func (c *cartridge) Banks() (rom, ram int) {
+	return c.romBank % c.romBanks, c.ramBank
+}
+
+// A clockCart keeps a clock in its battery save. restoreBattery is
+// SetBattery without moving the clock on by the time since it was
+// saved, so the same save always starts the machine the same way.
+type clockCart interface {
+	restoreBattery(data []byte) os.Error
+}
+
+// restoreBattery restores what Battery returned, leaving any clock as
+// it was saved.
+func restoreBattery(c Cartridge, data []byte) os.Error {
+	if cc, ok := c.(clockCart); ok {
+		return cc.restoreBattery(data)
+	}
+	return c.SetBattery(data)
+}
+
+func (m *memory) save(dir string) os.Error {
+	data := m.cart.Battery()
+	if data == nil {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(dir, m.saveName()), data, 0644)
+}
+
+func (m *memory) load(dir string) interface{} {
+	if m.cart.Battery() == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, m.saveName()))
+	if err != nil {
+		return err
+	}
+	return m.cart.SetBattery(data)
+}
+
+func (m *memory) saveName() string {
+	return m.fileName("battery")
+}
+
+// fileName returns a name for a file belonging to the current ROM,
+// with the given extension.
+func (m *memory) fileName(ext string) string {
+	return fmt.Sprintf("%s-%02X-%04X.%s", m.rom.title(),
+		m.rom.headerChecksum(), m.rom.globalChecksum(), ext)
+}
@@ -0,0 +1,322 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"os"
+)
+
+// The types below are commands which may be sent to a running
+// emulator on the channel given to Start. They are acted upon
+// between frames.
+
+// Quit stops the emulator (battery-backed RAM is still saved).
+type Quit struct{}
+
+// MuteChannel mutes or unmutes one of the four sound channels,
+// numbered 1-4 as in the register names (NR1x-NR4x).
+type MuteChannel struct {
+	Channel int
+	Mute    bool
+}
+
+// SoloChannel plays only the given sound channel (1-4), ignoring
+// any muting. Channel 0 cancels the solo.
+type SoloChannel struct {
+	Channel int
+}
+
+// ShowScope turns the per-channel sound overlay on or off.
+type ShowScope struct {
+	Show bool
+}
+
+// SkipTrack moves forward (or back, if negative) the given number
+// of tracks when playing a GBS file.
+type SkipTrack struct {
+	Tracks int
+}
+
+// Pause stops or resumes emulation.
+type Pause struct {
+	Pause bool
+}
+
+// FastForward runs the emulator at Config.TurboSpeed while on.
+type FastForward struct {
+	On bool
+}
+
+// SlowMotion runs the emulator at Config.SlowSpeed while on.
+type SlowMotion struct {
+	On bool
+}
+
+// SetSpeed sets the speed used when neither fast-forward nor slow
+// motion are on, as a percentage of normal; 0 runs as fast as
+// possible. Away from normal speed, sound is played faster or slower
+// to match (or not at all if unthrottled).
+type SetSpeed struct {
+	Percent int
+}
+
+// FrameAdvance runs a single frame and pauses.
+type FrameAdvance struct{}
+
+// ToggleFullscreen switches between windowed and fullscreen mode.
+type ToggleFullscreen struct{}
+
+// SaveState saves the state of the machine to one of ten numbered
+// slots (0-9) in the save directory.
+type SaveState struct {
+	Slot int
+}
+
+// LoadState restores the state saved in the given slot.
+type LoadState struct {
+	Slot int
+}
+
+// SelectSlot chooses the slot used by the save and load state keys.
+type SelectSlot struct {
+	Slot int
+}
+
+// Screenshot saves the screen to the save directory.
+type Screenshot struct{}
+
+// RecordVideo starts or stops recording the screen and sound to an
+// AVI file, named like a screenshot.
+type RecordVideo struct {
+	On bool
+}
+
+// ReadOnlyMovie switches a movie between read-only playback and
+// recording from the current frame.
+type ReadOnlyMovie struct {
+	On bool
+}
+
+// RecordGIF starts or stops collecting frames for an animated GIF,
+// which is saved when stopped.
+type RecordGIF struct {
+	On bool
+}
+
+// SaveReplay saves the last Config.GIFSeconds as an animated GIF.
+type SaveReplay struct{}
+
+// ShowView shows one of the debug views (see ViewTiles) in place of
+// the screen, or the screen again with ViewScreen.
+type ShowView struct {
+	View int
+}
+
+// The layers of the picture, for ShowLayer.
+const (
+	LayerBG = iota
+	LayerWindow
+	LayerSprites
+)
+
+// ShowLayer hides or shows a layer of the picture, whatever the game
+// has set in LCDC.
+type ShowLayer struct {
+	Layer int
+	Show  bool
+}
+
+// TintLayers colours each layer differently, to tell them apart.
+type TintLayers struct {
+	On bool
+}
+
+// ShowOSD switches the on-screen display on or off altogether.
+type ShowOSD struct {
+	On bool
+}
+
+// ShowFPS switches the frame rate counter on the on-screen display.
+type ShowFPS struct {
+	On bool
+}
+
+// ShowInput switches the display of the buttons held in each frame.
+type ShowInput struct {
+	On bool
+}
+
+// SetPalette changes the colours used for the screen, to one of the
+// built-in palettes or one from the configuration file.
+type SetPalette struct {
+	Name string
+}
+
+func (sys *machine) command(c interface{}) {
+	switch c := c.(type) {
+	case Quit:
+		sys.quit = true
+	case MuteChannel:
+		sys.audio.setMute(c.Channel, c.Mute)
+	case SoloChannel:
+		sys.audio.setSolo(c.Channel)
+	case ShowScope:
+		sys.audio.showScope(c.Show)
+	case Pause:
+		sys.paused = c.Pause
+		if c.Pause {
+			sys.message("paused")
+		} else {
+			sys.message("resumed")
+		}
+	case FastForward:
+		sys.turbo = c.On
+		if !c.On {
+			sys.message("normal speed")
+		} else if speed := sys.config.TurboSpeed; speed > 0 {
+			sys.message("fast-forward x%g", float64(speed)/100)
+		} else {
+			sys.message("fast-forward")
+		}
+	case SlowMotion:
+		sys.slow = c.On
+		sys.message("slow motion %s", onOff(c.On))
+	case SetSpeed:
+		if c.Percent >= 0 {
+			sys.speed = c.Percent
+		}
+	case FrameAdvance:
+		sys.advance = sys.paused
+		sys.paused = true
+	case ToggleFullscreen:
+		sys.lcd.toggleFullScreen()
+	case SaveState:
+		if err := sys.saveStateSlot(c.Slot); err != nil {
+			sys.error("save state failed: %v", err)
+		} else {
+			sys.message("state %d saved", c.Slot)
+		}
+	case LoadState:
+		if err := sys.loadStateSlot(c.Slot); err != nil {
+			sys.error("load state failed: %v", err)
+		} else {
+			sys.message("state %d loaded", c.Slot)
+		}
+	case SelectSlot:
+		if c.Slot >= 0 && c.Slot < stateSlots {
+			sys.slot = c.Slot
+			sys.message("state slot %d", c.Slot)
+		}
+	case ReadOnlyMovie:
+		if sys.movie == nil {
+			break
+		}
+		if err := sys.movie.setReadOnly(sys.frame, c.On); err != nil {
+			sys.error("movie: %v", err)
+		} else {
+			sys.message("movie %s", sys.movie.status(sys.frame))
+		}
+	case RecordVideo:
+		if !c.On {
+			if sys.video != nil {
+				sys.video.stop = true
+			}
+		} else if sys.video == nil {
+			name := sys.screenshotName(".avi")
+			if err := sys.startVideo(name); err != nil {
+				sys.error("video failed: %v", err)
+			} else {
+				sys.message("recording %s", name)
+			}
+		}
+	case RecordGIF:
+		if c.On && sys.gif == nil {
+			sys.gif = newGIFClip(0)
+			sys.message("recording GIF")
+		} else if !c.On && sys.gif != nil {
+			sys.saveGIF(sys.gif.frames)
+			sys.gif = nil
+		}
+	case SaveReplay:
+		if r := sys.gifReplay; r != nil {
+			sys.saveGIF(r.ordered())
+			sys.gifReplay = newGIFClip(sys.config.GIFSeconds)
+		}
+	case ShowView:
+		sys.lcd.setView(c.View)
+	case ShowLayer:
+		if c.Layer >= 0 && c.Layer < len(sys.lcd.hidden) {
+			sys.lcd.hidden[c.Layer] = !c.Show
+			sys.message("%s %s", layerNames[c.Layer], onOff(c.Show))
+		}
+	case TintLayers:
+		sys.lcd.tint = c.On
+		sys.lcd.setPalette(sys.lcd.palName)
+		sys.message("layer tint %s", onOff(c.On))
+	case ShowOSD:
+		sys.lcd.osd.show = c.On
+	case ShowFPS:
+		sys.lcd.osd.showFPS = c.On
+	case ShowInput:
+		sys.lcd.osd.showInput = c.On
+	case SetPalette:
+		if sys.lcd.setPalette(c.Name) {
+			sys.message("palette %s", c.Name)
+		} else {
+			sys.error("unknown palette '%s'", c.Name)
+		}
+	case Screenshot:
+		if name, err := sys.lcd.screenshot(); err != nil {
+			sys.error("screenshot failed: %v", err)
+		} else {
+			sys.message("saved %s", name)
+		}
+	}
+}
+
+// poll drains the input queue and carries out any pending commands,
+// whether sent by the caller or from bound inputs, using do.
+func (sys *machine) poll(in <-chan interface{}, do func(interface{})) {
+	for {
+		select {
+		case c := <-in:
+			do(c)
+		case ev := <-sys.events:
+			if ev.act == actTiltX || ev.act == actTiltY {
+				sys.tiltAxes[ev.act-actTiltX] = ev.value
+			} else if c := sys.action(ev.act, ev.down); c != nil {
+				do(c)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// message reports the outcome of a command, on the screen and (if
+// verbose) the console.
+func (m *memory) message(format string, args ...interface{}) {
+	if m.config.Verbose {
+		fmt.Printf(format+"\n", args...)
+	}
+	if m.lcd != nil {
+		m.lcd.osd.post(fmt.Sprintf(format, args...))
+	}
+}
+
+func (m *memory) error(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	if m.lcd != nil {
+		m.lcd.osd.post(fmt.Sprintf(format, args...))
+	}
+}
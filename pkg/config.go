@@ -0,0 +1,126 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ReadConfig reads a configuration file. Each line is either blank,
+// a comment starting with '#', an option:
+//
+//   scale = 3
+//
+// a binding from an input to a Game Boy button or action:
+//
+//   bind key:space a
+//   bind key:ctrl+s save-state
+//   bind joy:button2 fast-forward
+//   bind joy:axis0- left
+//   bind joy:hat0:up up
+//   bind key:f1 none
+//
+// a palette, of 4 colours or 12 (for BG, OBJ0 and OBJ1):
+//
+//   palette sepia #FFF0D0 #C0A070 #705030 #201000
+//
+// or the palette to use for a ROM, given by its checksums (as in
+// the names of save files) or just its header checksum:
+//
+//   rom-palette 3D-A2B1 sepia
+//   rom-palette 3D cgb-blue
+//
+// Bindings and palettes are added to cfg. Options are passed to set, which is
+// expected to treat them like the command line flags of the same
+// name.
+func ReadConfig(path string, cfg *Config, set func(name, value string) os.Error) os.Error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if cfg.Bindings == nil {
+		cfg.Bindings = make(map[string]string)
+	}
+	if cfg.Palettes == nil {
+		cfg.Palettes = make(map[string]string)
+	}
+	if cfg.ROMPalettes == nil {
+		cfg.ROMPalettes = make(map[string]string)
+	}
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err == os.EOF && line == "" {
+			break
+		} else if err != nil && err != os.EOF {
+			return err
+		}
+		if e := parseConfigLine(line, cfg, set); e != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, e)
+		}
+	}
+	return nil
+}
+
+func parseConfigLine(line string, cfg *Config, set func(name, value string) os.Error) interface{} {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "palette":
+		if len(fields) < 2 {
+			return "expected: palette <name> <colours>"
+		}
+		def := strings.Join(fields[2:], " ")
+		if _, err := parsePalette(def); err != nil {
+			return err
+		}
+		cfg.Palettes[strings.ToLower(fields[1])] = def
+		return nil
+	case "rom-palette":
+		if len(fields) != 3 {
+			return "expected: rom-palette <checksum> <palette>"
+		}
+		cfg.ROMPalettes[strings.ToUpper(fields[1])] =
+			strings.ToLower(fields[2])
+		return nil
+	case "bind":
+		if len(fields) != 3 {
+			return "expected: bind <input> <action>"
+		}
+		in := strings.ToLower(fields[1])
+		act := strings.ToLower(fields[2])
+		if _, err := parseInput(in); err != nil {
+			return err
+		}
+		if act != "none" {
+			if _, err := parseAction(act); err != nil {
+				return err
+			}
+		}
+		cfg.Bindings[in] = act
+		return nil
+	}
+
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "expected: option = value"
+	}
+	name := strings.TrimSpace(line[:i])
+	value := strings.TrimSpace(line[i+1:])
+	if err := set(name, value); err != nil {
+		return err
+	}
+	return nil
+}
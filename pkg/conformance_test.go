@@ -0,0 +1,190 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The conformance suites are run from whatever test ROMs are found
+// under romDir (none are included); see testdata/roms/README.
+const romDir = "testdata/roms"
+
+var strictConformance = flag.Bool("conformance.strict", false,
+	"fail TestConformance if any test ROM fails")
+
+// A conformanceSuite knows how to run the ROMs in its directory and
+// tell whether they passed.
+type conformanceSuite struct {
+	dir    string
+	frames int // the most any ROM is run for
+	check  func(sys *machine, rom string, frames int) (pass bool, detail string)
+}
+
+var conformanceSuites = []conformanceSuite{
+	{"blargg", 60 * 120, checkBlargg},
+	{"mooneye", 60 * 20, checkMooneye},
+	{"acid2", 60 * 10, checkAcid2},
+}
+
+// checkBlargg waits for Blargg's tests to report a result, either
+// over the link cable ("Passed" or "Failed") or in cartridge RAM,
+// where a signature at 0xA001 is followed by the status at 0xA000
+// (0x80 while running, then 0 for a pass) and text from 0xA004.
+func checkBlargg(sys *machine, rom string, frames int) (bool, string) {
+	var serial bytes.Buffer
+	sys.serial = &serial
+	for n := 0; n < frames; n++ {
+		sys.runFrame()
+		out := string(serial.Bytes())
+		switch {
+		case strings.Contains(out, "Passed"):
+			return true, ""
+		case strings.Contains(out, "Failed"):
+			return false, lastLine(out)
+		}
+		if sys.readByte(0xA001) == 0xDE && sys.readByte(0xA002) == 0xB0 &&
+			sys.readByte(0xA003) == 0x61 {
+			if status := sys.readByte(0xA000); status != 0x80 {
+				var text []byte
+				for a := uint16(0xA004); a < 0xC000; a++ {
+					b := sys.readByte(a)
+					if b == 0 {
+						break
+					}
+					text = append(text, b)
+				}
+				return status == 0, lastLine(string(text))
+			}
+		}
+	}
+	return false, "timed out"
+}
+
+// lastLine returns the last line of output which is not blank.
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// checkMooneye runs until the LD B,B breakpoint, then looks for the
+// Fibonacci numbers in B, C, D, E, H and L which signal a pass.
+func checkMooneye(sys *machine, rom string, frames int) (bool, string) {
+	regs, ok := runToBreakpoint(sys, frames)
+	if !ok {
+		return false, "timed out"
+	}
+	if string(regs) != string([]byte{3, 5, 8, 13, 21, 34}) {
+		return false, fmt.Sprintf("registers % X", regs)
+	}
+	return true, ""
+}
+
+// checkAcid2 runs until the LD B,B breakpoint, then compares the
+// screen with the reference image next to the ROM (dmg-acid2.png for
+// dmg-acid2.gb).
+func checkAcid2(sys *machine, rom string, frames int) (bool, string) {
+	if _, ok := runToBreakpoint(sys, frames); !ok {
+		return false, "timed out"
+	}
+	ref := rom[:len(rom)-len(filepath.Ext(rom))] + ".png"
+	diff, err := sys.lcd.diffPNG(ref)
+	switch {
+	case err != nil:
+		return false, err.String()
+	case diff > 0:
+		return false, fmt.Sprintf("%d pixels differ", diff)
+	}
+	return true, ""
+}
+
+// runToBreakpoint runs until LD B,B is about to be executed, returning
+// B, C, D, E, H and L at that point. The frame is finished.
+func runToBreakpoint(sys *machine, frames int) (regs []byte, ok bool) {
+	stop := func(sys *cpu) bool {
+		if sys.readByte(sys.pc) != 0x40 {
+			return false
+		}
+		regs = []byte{sys.b, sys.c, sys.d, sys.e,
+			byte(sys.hl >> 8), byte(sys.hl)}
+		return true
+	}
+	for n := 0; n < frames && !ok; n++ {
+		ok = sys.runFrameUntil(stop)
+	}
+	return
+}
+
+// findROMs returns the ROMs in dir and up to two levels below it.
+func findROMs(dir string) []string {
+	var roms []string
+	for _, pattern := range []string{"*.gb", "*/*.gb", "*/*/*.gb"} {
+		found, _ := filepath.Glob(filepath.Join(dir, pattern))
+		roms = append(roms, found...)
+	}
+	return roms
+}
+
+func TestConformance(t *testing.T) {
+	type result struct {
+		suite, rom string
+		pass       bool
+		detail     string
+	}
+	var results []result
+	for _, suite := range conformanceSuites {
+		dir := filepath.Join(romDir, suite.dir)
+		for _, rom := range findROMs(dir) {
+			r := result{suite: suite.dir, rom: rom[len(dir)+1:]}
+			cfg := Config{Scale: 1, AudioFreq: 48000, Palette: "grey"}
+			if sys, err := startHeadless(rom, &cfg); err != nil {
+				r.detail = err.String()
+			} else {
+				r.pass, r.detail = suite.check(sys, rom, suite.frames)
+				sys.audio.close()
+			}
+			results = append(results, r)
+		}
+	}
+	if len(results) == 0 {
+		t.Logf("no test ROMs in %s", romDir)
+		return
+	}
+
+	// The matrix: a line for each ROM, then the totals.
+	report := "\n"
+	passed := make(map[string]int)
+	total := make(map[string]int)
+	for _, r := range results {
+		status := "FAIL"
+		if r.pass {
+			status = "pass"
+			passed[r.suite]++
+		}
+		total[r.suite]++
+		report += fmt.Sprintf("%-8s %-48s %s %s\n", r.suite, r.rom,
+			status, r.detail)
+	}
+	for _, suite := range conformanceSuites {
+		if n := total[suite.dir]; n > 0 {
+			report += fmt.Sprintf("%-8s %d/%d passed\n", suite.dir,
+				passed[suite.dir], n)
+		}
+	}
+	t.Log(report)
+
+	if *strictConformance {
+		for _, r := range results {
+			if !r.pass {
+				t.Errorf("%s/%s failed", r.suite, r.rom)
+			}
+		}
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 type cpu struct {
-	*memory
+	bus              Bus
 	a, b, c, d, e    byte
 	hl, pc, sp       uint16
 	fz, fn, fh, fc   bool
@@ -19,8 +19,8 @@ type cpu struct {
 	stack            uint16
 }
 
-func newCPU(m *memory) *cpu {
-	return &cpu{memory: m,
+func newCPU(b Bus) *cpu {
+	return &cpu{bus: b,
 		a: 0x01, b: 0x00, c: 0x13, d: 0x00, e: 0xD8,
 		hl: 0x014D, pc: 0x0100, sp: 0xFFFE,
 		fz: true, fn: false, fh: true, fc: true,
@@ -37,10 +37,18 @@ func (sys *cpu) String() string {
 		sys.pc, sys.sp, sys.ime, sys.halt, sys.pause)
 }
 
+// step runs an instruction, or starts an interrupt handler, then
+// ticks the bus for as long as it took, which is returned.
 func (sys *cpu) step() int {
+	t := sys.next()
+	sys.bus.Tick(t)
+	return t
+}
+
+func (sys *cpu) next() int {
 	if sys.ime {
-		f := sys.readPort(portIF)
-		e := sys.readPort(portIE)
+		f := sys.readByte(portIF)
+		e := sys.readByte(portIE)
 		mask := f & e & 0x1F
 		if mask != 0 {
 			return sys.irq(mask, f)
@@ -78,8 +86,8 @@ func (sys *cpu) irq(mask, f byte) int {
 		sys.pc = joypadAddr
 		f &^= 0x10
 	}
-	sys.writePort(portIF, f)
-	return 8
+	sys.writeByte(portIF, f)
+	return 5
 }
 
 func (sys *cpu) dumpStack(w io.Writer) {
@@ -157,12 +165,15 @@ func (sys *cpu) call(pred bool) int {
 func (sys *cpu) rst(addr uint16) int {
 	sys.push(sys.pc)
 	sys.pc = addr
-	return 8
+	return 4
 }
 
+// push writes the high byte first, as the SM83 does.
 func (sys *cpu) push(x uint16) {
-	sys.sp -= 2
-	sys.writeWord(sys.sp, x)
+	sys.sp--
+	sys.writeByte(sys.sp, byte(x>>8))
+	sys.sp--
+	sys.writeByte(sys.sp, byte(x))
 	//fmt.Printf("-> SP=%04Xh *=%04Xh\n", sys.sp, x)
 }
 
@@ -470,6 +481,25 @@ func (sys *cpu) wl(x byte) {
 	sys.hl = uint16(x) | (sys.hl & 0xFF00)
 }
 
+func (sys *cpu) readByte(addr uint16) byte {
+	return sys.bus.Read(addr)
+}
+
+func (sys *cpu) writeByte(addr uint16, x byte) {
+	sys.bus.Write(addr, x)
+}
+
+func (sys *cpu) readWord(addr uint16) uint16 {
+	lo := uint16(sys.readByte(addr))
+	hi := uint16(sys.readByte(addr + 1))
+	return (hi << 8) | lo
+}
+
+func (sys *cpu) writeWord(addr uint16, x uint16) {
+	sys.writeByte(addr, uint8(x&0xFF))
+	sys.writeByte(addr+1, uint8(x>>8))
+}
+
 func (sys *cpu) fetchByte() byte {
 	pc := sys.pc
 	sys.pc++
@@ -1392,7 +1422,7 @@ var fdxTable = [256]func(*cpu) int{
 
 	0xE0: func(sys *cpu) int { // LDH (a8),A
 		addr := 0xFF00 + uint16(sys.fetchByte())
-		sys.writePort(addr, sys.a)
+		sys.writeByte(addr, sys.a)
 		return 3
 	},
 	0xE1: func(sys *cpu) int { // POP HL
@@ -1401,7 +1431,7 @@ var fdxTable = [256]func(*cpu) int{
 	},
 	0xE2: func(sys *cpu) int { // LD (C),A
 		addr := 0xFF00 + uint16(sys.c)
-		sys.writePort(addr, sys.a)
+		sys.writeByte(addr, sys.a)
 		return 2
 	},
 	0xE3: func(sys *cpu) int {
@@ -1453,7 +1483,7 @@ var fdxTable = [256]func(*cpu) int{
 
 	0xF0: func(sys *cpu) int { // LDH A,(a8)
 		addr := 0xFF00 + uint16(sys.fetchByte())
-		sys.a = sys.readPort(addr)
+		sys.a = sys.readByte(addr)
 		return 3
 	},
 	0xF1: func(sys *cpu) int { // POP AF
@@ -1462,7 +1492,7 @@ var fdxTable = [256]func(*cpu) int{
 	},
 	0xF2: func(sys *cpu) int { // LD A,(C)
 		addr := 0xFF00 + uint16(sys.c)
-		sys.a = sys.readPort(addr)
+		sys.a = sys.readByte(addr)
 		return 2
 	},
 	0xF3: func(sys *cpu) int { // DI
@@ -1814,7 +1844,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x46: func(sys *cpu) int {
 		sys.bit(0, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x47: func(sys *cpu) int {
 		sys.bit(0, sys.a)
@@ -1847,7 +1877,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x4E: func(sys *cpu) int {
 		sys.bit(1, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x4F: func(sys *cpu) int {
 		sys.bit(1, sys.a)
@@ -1880,7 +1910,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x56: func(sys *cpu) int {
 		sys.bit(2, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x57: func(sys *cpu) int {
 		sys.bit(2, sys.a)
@@ -1913,7 +1943,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x5E: func(sys *cpu) int {
 		sys.bit(3, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x5F: func(sys *cpu) int {
 		sys.bit(3, sys.a)
@@ -1946,7 +1976,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x66: func(sys *cpu) int {
 		sys.bit(4, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x67: func(sys *cpu) int {
 		sys.bit(4, sys.a)
@@ -1979,7 +2009,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x6E: func(sys *cpu) int {
 		sys.bit(5, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x6F: func(sys *cpu) int {
 		sys.bit(5, sys.a)
@@ -2012,7 +2042,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x76: func(sys *cpu) int {
 		sys.bit(6, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x77: func(sys *cpu) int {
 		sys.bit(6, sys.a)
@@ -2045,7 +2075,7 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 	0x7E: func(sys *cpu) int {
 		sys.bit(7, sys.readByte(sys.hl))
-		return 4
+		return 3
 	},
 	0x7F: func(sys *cpu) int {
 		sys.bit(7, sys.a)
@@ -2597,15 +2627,15 @@ var fdxTableCB = [256]func(*cpu) int{
 	},
 }
 
-func (m *memory) disasm(addr uint16) (result string) {
+func (sys *cpu) disasm(addr uint16) (result string) {
 	defer func() {
 		if e := recover(); e != nil {
 			result = "(read failed!)"
 		}
 	}()
-	code := m.readByte(addr)
-	imm8 := m.readByte(addr + 1)
-	imm16 := m.readWord(addr + 1)
+	code := sys.readByte(addr)
+	imm8 := sys.readByte(addr + 1)
+	imm16 := sys.readWord(addr + 1)
 	rel8 := int8(imm8)
 	jra := addr + 2 + uint16(rel8)
 	switch code {
@@ -5,7 +5,7 @@
 package gameboy
 
 import (
-	"⚛sdl"
+	"image"
 	"time"
 )
 
@@ -33,16 +33,42 @@ const (
 
 	scanlineTicks = oamTicks + vramTicks + hblankTicks
 	refreshTicks  = scanlineTicks*displayH + vblankTicks
+
+	frameNanos = 16742706 // real time taken by one refresh
 )
 
+// A screen shows the picture, in a window or a terminal. Coordinates
+// are in screen pixels, and colours as returned by mapColor.
+type screen interface {
+	setMode(w, h int)
+	mapColor(c image.RGBAColor) uint32
+	fillRect(x, y, w, h int, color uint32)
+	blit(pix []uint32, x, y, w, h int) // 0xRRGGBB pixels, w by h
+	setCaption(title string)
+	toggleFullScreen()
+	flip()
+}
+
 type display struct {
 	*memory
-	*sdl.Surface
-	pal       [4]uint32
+	screen    screen     // nil when running headless
+	pal       [16]uint32 // indexed like the frame
+	colors    [16]image.RGBAColor
+	palName   string
+	post      *postProcessor // software filters, if any
+	view      int            // shown beside the screen
+	hidden    [3]bool        // layers not drawn; see LayerBG
+	tint      bool           // whether layers are tinted
+	osd       osd
 	frameTime int64
 	screenW   int
 	screenH   int
 
+	// for debug views; see setView
+	canvas    *canvas
+	viewScale int
+	viewBuf   []uint32
+
 	clock int
 
 	// LCDC flags
@@ -72,9 +98,18 @@ type display struct {
 
 	// Scanlines are rendered to here first, and then drawn to the
 	// display - rather than each layer accessing the display
-	// separately (which is slow).
+	// separately (which is slow). Each pixel holds its shade and
+	// layer; see layerBG.
 	lineBuf [displayW]byte
 
+	// The frame being drawn, a line at a time. Each pixel is a
+	// shade and a layer, as in lineBuf.
+	frame [displayW * displayH]byte
+
+	// The last complete frame, copied from frame at VBlank, for
+	// screenshots and tests to see whole.
+	shown [displayW * displayH]byte
+
 	// When rendering a scanline this is zeroed out, then
 	// bitwise-ORed with the pixels from the BG and window. This
 	// is then used to lookup which pixels can be painted in
@@ -82,29 +117,29 @@ type display struct {
 	oamLineMask [displayW]byte
 }
 
-func newDisplay(m *memory) *display {
-	sdl.WM_SetCaption(m.rom.title(), "")
-	flags := uint32(sdl.DOUBLEBUF)
-	if m.config.Fullscreen {
-		flags |= sdl.FULLSCREEN
-	}
-	lcd := display{memory: m}
+// newDisplay draws on scr, which must be the size of the display
+// at the configured scale.
+func newDisplay(m *memory, scr screen, post *postProcessor) *display {
+	lcd := display{memory: m, screen: scr, post: post}
+	lcd.osd.show = m.config.OSD
+	lcd.osd.showFPS = m.config.ShowFPS
+	lcd.osd.showInput = m.config.ShowInput
 	lcd.screenW = displayW * m.config.Scale
 	lcd.screenH = displayH * m.config.Scale
-	lcd.Surface = sdl.SetVideoMode(lcd.screenW, lcd.screenH, 0, flags)
-	lcd.pal[0] = sdl.MapRGBA(lcd.Format, 0x9B, 0xBC, 0x0F, 0)
-	lcd.pal[1] = sdl.MapRGBA(lcd.Format, 0x8B, 0xAC, 0x0F, 0)
-	lcd.pal[2] = sdl.MapRGBA(lcd.Format, 0x30, 0x62, 0x30, 0)
-	lcd.pal[3] = sdl.MapRGBA(lcd.Format, 0x0F, 0x38, 0x0F, 0)
-	sdl.ShowCursor(sdl.DISABLE)
-	lcd.FillRect(nil, lcd.pal[0])
-	lcd.Flip()
+	lcd.initPalette()
+	lcd.clear()
+	scr.flip()
 	lcd.frameTime = time.Nanoseconds()
 	return &lcd
 }
 
 func (lcd *display) toggleFullScreen() {
-	sdl.WM_ToggleFullScreen(lcd.Surface)
+	lcd.screen.toggleFullScreen()
+}
+
+// clear fills the whole screen with the lightest shade.
+func (lcd *display) clear() {
+	lcd.screen.fillRect(0, 0, 1<<15, 1<<15, lcd.pal[0])
 }
 
 func (lcd *display) step(t int) {
@@ -150,20 +185,61 @@ func (lcd *display) step(t int) {
 			irq |= 0x02
 		}
 		lcd.writePort(portIF, irq|0x01)
-		lcd.Flip()
+		lcd.shown = lcd.frame
+		if lcd.video != nil {
+			lcd.videoFrame()
+		}
+		lcd.gifFrame()
+		if lcd.screen == nil {
+			break
+		}
+		lcd.osd.countFrame()
+		lcd.showFrame()
+		lcd.screen.flip()
 		lcd.delay()
 	}
 
 	lcd.writePort(portSTAT, stat)
 }
 
+// showFrame finishes drawing the last frame on the screen, unless a
+// debug view is shown instead, and draws the scope and on-screen
+// display over it.
+func (lcd *display) showFrame() {
+	if lcd.view != ViewScreen {
+		lcd.showView()
+	}
+	if lcd.post != nil {
+		lcd.present()
+	}
+	if lcd.audio.scope != nil {
+		lcd.drawScope()
+	}
+	lcd.showOSD()
+}
+
+// redraw draws the last frame again, with the on-screen display as
+// it is now, for while the machine is paused.
+func (lcd *display) redraw() {
+	if lcd.screen == nil {
+		return
+	}
+	if lcd.post == nil {
+		for y := 0; y < displayH; y++ {
+			lcd.drawLine(y, lcd.shown[y*displayW:(y+1)*displayW])
+		}
+	}
+	lcd.showFrame()
+	lcd.screen.flip()
+}
+
 func (lcd *display) delay() {
 	// while audio is playing, we let it control the
 	// emulation speed
-	if !lcd.audio.enable {
+	if speed := lcd.currentSpeed(); (!lcd.audio.enable || !lcd.audio.live) && speed > 0 {
 		now := time.Nanoseconds()
 		delta := now - lcd.frameTime
-		target := 16742706 - delta
+		target := frameNanos*100/int64(speed) - delta
 		if target > 0 {
 			time.Sleep(target)
 		}
@@ -177,11 +253,11 @@ func (lcd *display) scanline() {
 		lcd.lineBuf[i] = 0
 	}
 
-	if lcd.bgEnable {
-		lcd.mapline(lcd.bgMap, byte(0), lcd.scx, lcd.scy)
+	if lcd.bgEnable && !lcd.hidden[LayerBG] {
+		lcd.mapline(lcd.bgMap, byte(0), lcd.scx, lcd.scy, layerBG)
 	}
 
-	if lcd.windowEnable {
+	if lcd.windowEnable && !lcd.hidden[LayerWindow] {
 		if lcd.wx < 167 && lcd.wy < 144 && lcd.ly >= lcd.wy {
 			x := int(lcd.wx) - 7
 			xoff := -x
@@ -189,44 +265,57 @@ func (lcd *display) scanline() {
 				x = 0
 			}
 			lcd.mapline(lcd.windowMap, byte(x),
-				byte(xoff), byte(-lcd.wy))
+				byte(xoff), byte(-lcd.wy), layerWindow)
 		}
 	}
 
-	if lcd.spriteEnable {
+	if lcd.spriteEnable && !lcd.hidden[LayerSprites] {
 		lcd.oamline()
 	}
 
 	lcd.flushline()
 }
 
-func (lcd *display) mapline(map1 bool, x, xoff, yoff byte) {
+func (lcd *display) mapline(map1 bool, x, xoff, yoff byte, layer byte) {
 	y := lcd.ly + yoff
 	for ; x < displayW; x++ {
 		b := lcd.mapAt(map1, int(x+xoff), int(y))
 		lcd.oamLineMask[x] |= b
-		lcd.lineBuf[x] = lcd.bgp[b]
+		lcd.lineBuf[x] = lcd.bgp[b] | layer<<2
 	}
 }
 
 func (lcd *display) flushline() {
+	copy(lcd.frame[int(lcd.ly)*displayW:], lcd.lineBuf[:])
+	if lcd.screen == nil || lcd.post != nil {
+		return // running headless, or drawn at VBlank
+	}
+	lcd.drawLine(int(lcd.ly), lcd.lineBuf[:])
+}
+
+// drawLine draws a line of pixels on the screen.
+func (lcd *display) drawLine(ly int, line []byte) {
 	// Do some simple run-length counting to reduce the number of
-	// FillRect calls we need to make.
-	scale := uint16(lcd.config.Scale)
-	r := &sdl.Rect{0, int16(lcd.ly) * int16(scale), scale, scale}
-	cur := lcd.lineBuf[0]
+	// fillRect calls we need to make.
+	scale := lcd.config.Scale
+	y := ly * scale
+	start, cur := 0, line[0]
 	for x := 1; x < displayW; x++ {
-		b := lcd.lineBuf[x]
-		if b != cur {
-			lcd.FillRect(r, lcd.pal[cur])
-			cur = b
-			r.X = int16(x) * int16(scale)
-			r.W = scale
-		} else {
-			r.W += scale
+		if b := line[x]; b != cur {
+			lcd.screen.fillRect(start*scale, y, (x-start)*scale,
+				scale, lcd.pal[cur])
+			start, cur = x, b
 		}
 	}
-	lcd.FillRect(r, lcd.pal[cur])
+	lcd.screen.fillRect(start*scale, y, (displayW-start)*scale, scale,
+		lcd.pal[cur])
+}
+
+// fillRect fills a rectangle given in display coordinates, which
+// are scaled to the screen.
+func (lcd *display) fillRect(x, y, w, h int, color uint32) {
+	scale := lcd.config.Scale
+	lcd.screen.fillRect(x*scale, y*scale, w*scale, h*scale, color)
 }
 
 // oamline draws up to 10 sprites on the current scanline
@@ -289,7 +378,8 @@ func (lcd *display) spriteLine(tile, x, y, h int, info byte) {
 		px := (lcd.vram[tile] >> bit) & 1
 		px |= ((lcd.vram[tile+1] >> bit) & 1) << 1
 		if px != 0 {
-			lcd.lineBuf[xi] = lcd.obp[palidx][px]
+			lcd.lineBuf[xi] = lcd.obp[palidx][px] |
+				(layerOBJ0+palidx)<<2
 		}
 	}
 }
@@ -0,0 +1,187 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+// The states of the EEPROM between clock pulses.
+const (
+	eepromIdle    = iota // waiting for a start bit
+	eepromCommand        // reading the opcode and address
+	eepromData           // reading a word to write
+	eepromRead           // sending words out
+	eepromDone           // until chip select is dropped
+)
+
+// An eeprom is the 93LC56 serial EEPROM in MBC7 cartridges: 128
+// 16-bit words, driven by setting its chip select, clock and data in
+// lines and reading its data out line. Each command is a start bit
+// (1), a 2-bit opcode and an 8-bit address (of which the top bit is
+// ignored), sent on rising clock edges while chip select is high:
+//
+//   10 A  READ   send word A, after a 0 bit, then those after it
+//   01 A  WRITE  write the 16 bits which follow to word A
+//   11 A  ERASE  set word A to FFFFh
+//   00 11xxxxxx  EWEN  allow writing and erasing
+//   00 00xxxxxx  EWDS  disallow them again (as at power on)
+//   00 10xxxxxx  ERAL  set every word to FFFFh
+//   00 01xxxxxx  WRAL  write the 16 bits which follow to every word
+//
+// Writes take no time, so data out is always high (ready) except
+// while a word is being read.
+type eeprom struct {
+	data     [128]uint16
+	writable bool
+
+	cs, clk, di, do bool
+
+	state int
+	bits  int // shifted in
+	count int // bits shifted in
+	addr  int
+	all   bool // writing every word
+	out   int  // the word being sent
+	left  int  // bits of it still to send
+}
+
+func newEEPROM() *eeprom {
+	e := &eeprom{do: true}
+	for i := range e.data {
+		e.data[i] = 0xFFFF
+	}
+	return e
+}
+
+// read returns the lines as seen at Ax8xh: chip select in bit 7,
+// clock in bit 6, data in in bit 1 and data out in bit 0.
+func (e *eeprom) read() byte {
+	var x byte
+	if e.cs {
+		x |= 0x80
+	}
+	if e.clk {
+		x |= 0x40
+	}
+	if e.di {
+		x |= 0x02
+	}
+	if e.do {
+		x |= 0x01
+	}
+	return x
+}
+
+// write sets the lines from a write to Ax8xh, laid out as in read.
+func (e *eeprom) write(x byte) {
+	cs, clk, di := x&0x80 != 0, x&0x40 != 0, x&0x02 != 0
+	rising := clk && !e.clk
+	e.cs, e.clk, e.di = cs, clk, di
+	if !cs {
+		e.state = eepromIdle
+		e.do = true
+		return
+	}
+	if rising {
+		e.clock(di)
+	}
+}
+
+// clock handles a rising edge of the clock with chip select high.
+func (e *eeprom) clock(di bool) {
+	bit := 0
+	if di {
+		bit = 1
+	}
+	switch e.state {
+	case eepromIdle:
+		if di {
+			e.state = eepromCommand
+			e.bits, e.count = 0, 0
+		}
+	case eepromCommand:
+		e.bits = e.bits<<1 | bit
+		if e.count++; e.count == 10 {
+			e.command()
+		}
+	case eepromData:
+		e.bits = e.bits<<1 | bit
+		if e.count++; e.count == 16 {
+			e.store(uint16(e.bits))
+			e.state = eepromDone
+		}
+	case eepromRead:
+		e.do = e.out&0x8000 != 0
+		e.out <<= 1
+		if e.left--; e.left == 0 {
+			e.addr = (e.addr + 1) & 0x7F
+			e.out, e.left = int(e.data[e.addr]), 16
+		}
+	}
+}
+
+func (e *eeprom) command() {
+	e.addr = e.bits & 0x7F
+	e.state = eepromDone
+	switch e.bits >> 8 {
+	case 2: // READ
+		e.state = eepromRead
+		e.out, e.left = int(e.data[e.addr]), 16
+		e.do = false
+	case 1: // WRITE
+		e.state = eepromData
+		e.bits, e.count, e.all = 0, 0, false
+	case 3: // ERASE
+		if e.writable {
+			e.data[e.addr] = 0xFFFF
+		}
+	case 0:
+		switch e.bits >> 6 & 3 {
+		case 3: // EWEN
+			e.writable = true
+		case 0: // EWDS
+			e.writable = false
+		case 2: // ERAL
+			e.all = true
+			e.store(0xFFFF)
+		case 1: // WRAL
+			e.state = eepromData
+			e.bits, e.count, e.all = 0, 0, true
+		}
+	}
+}
+
+// store writes x to the word addressed, or to every word.
+func (e *eeprom) store(x uint16) {
+	switch {
+	case !e.writable:
+	case e.all:
+		for i := range e.data {
+			e.data[i] = x
+		}
+	default:
+		e.data[e.addr] = x
+	}
+}
+
+// bytes returns the contents of the EEPROM for saving, with the low
+// byte of each word first.
+func (e *eeprom) bytes() []byte {
+	b := make([]byte, 2*len(e.data))
+	for i, w := range e.data {
+		b[2*i] = byte(w)
+		b[2*i+1] = byte(w >> 8)
+	}
+	return b
+}
+
+func (e *eeprom) setBytes(b []byte) {
+	for i := range e.data {
+		e.data[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+}
+
+func (e *eeprom) stateFields() []interface{} {
+	return []interface{}{e.data[:], &e.writable,
+		&e.cs, &e.clk, &e.di, &e.do, &e.state, &e.bits, &e.count,
+		&e.addr, &e.all, &e.out, &e.left}
+}
@@ -0,0 +1,126 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "testing"
+
+// send clocks the low n bits of x into the EEPROM, high bit first,
+// with chip select held high.
+func send(e *eeprom, x, n int) {
+	for i := n - 1; i >= 0; i-- {
+		di := byte(x>>uint(i)&1) << 1
+		e.write(0x80 | di)
+		e.write(0xC0 | di)
+	}
+}
+
+// receive clocks n bits out of the EEPROM.
+func receive(e *eeprom, n int) int {
+	x := 0
+	for i := 0; i < n; i++ {
+		e.write(0x80)
+		e.write(0xC0)
+		x = x<<1 | int(e.read()&1)
+	}
+	return x
+}
+
+// sendCommand sends a start bit, an opcode and an address (or the
+// rest of an extended command), then any data.
+func sendCommand(e *eeprom, op, addr int, data ...int) {
+	e.write(0x00)
+	send(e, 1<<10|op<<8|addr, 11)
+	for _, x := range data {
+		send(e, x, 16)
+	}
+	e.write(0x00)
+}
+
+func readWords(e *eeprom, addr, n int) []int {
+	e.write(0x00)
+	send(e, 1<<10|2<<8|addr, 11)
+	if bit := e.read() & 1; bit != 0 {
+		panic("no dummy bit before the data")
+	}
+	words := make([]int, n)
+	for i := range words {
+		words[i] = receive(e, 16)
+	}
+	e.write(0x00)
+	return words
+}
+
+func TestEEPROMWrite(t *testing.T) {
+	e := newEEPROM()
+	sendCommand(e, 1, 0x05, 0x1234)
+	if x := e.data[5]; x != 0xFFFF {
+		t.Errorf("wrote %04X before EWEN", x)
+	}
+
+	sendCommand(e, 0, 0xC0) // EWEN
+	sendCommand(e, 1, 0x05, 0x1234)
+	sendCommand(e, 1, 0x86, 0xABCD) // the top address bit is ignored
+	got := readWords(e, 0x05, 3)
+	if got[0] != 0x1234 || got[1] != 0xABCD || got[2] != 0xFFFF {
+		t.Errorf("read %04X", got)
+	}
+
+	sendCommand(e, 0, 0x00) // EWDS
+	sendCommand(e, 1, 0x05, 0x0000)
+	if x := readWords(e, 0x05, 1)[0]; x != 0x1234 {
+		t.Errorf("read %04X after a write with EWDS", x)
+	}
+}
+
+func TestEEPROMErase(t *testing.T) {
+	e := newEEPROM()
+	sendCommand(e, 0, 0xC0)         // EWEN
+	sendCommand(e, 0, 0x40, 0x5A5A) // WRAL
+	for i, x := range e.data {
+		if x != 0x5A5A {
+			t.Fatalf("word %d is %04X after WRAL", i, x)
+		}
+	}
+
+	sendCommand(e, 3, 0x10) // ERASE
+	if x, y := e.data[0x10], e.data[0x11]; x != 0xFFFF || y != 0x5A5A {
+		t.Errorf("words %04X %04X after ERASE", x, y)
+	}
+
+	sendCommand(e, 0, 0x80) // ERAL
+	for i, x := range e.data {
+		if x != 0xFFFF {
+			t.Fatalf("word %d is %04X after ERAL", i, x)
+		}
+	}
+}
+
+func TestEEPROMReadWraps(t *testing.T) {
+	e := newEEPROM()
+	sendCommand(e, 0, 0xC0)
+	sendCommand(e, 1, 0x7F, 0x0102)
+	sendCommand(e, 1, 0x00, 0x0304)
+	if got := readWords(e, 0x7F, 2); got[0] != 0x0102 || got[1] != 0x0304 {
+		t.Errorf("read %04X across the end", got)
+	}
+	if x := e.read(); x&1 == 0 {
+		t.Error("not ready after chip select dropped")
+	}
+}
+
+func TestEEPROMBattery(t *testing.T) {
+	e := newEEPROM()
+	sendCommand(e, 0, 0xC0)
+	sendCommand(e, 1, 0x00, 0xBEEF)
+	b := e.bytes()
+	if len(b) != 256 || b[0] != 0xEF || b[1] != 0xBE {
+		t.Fatalf("saved % X...", b[:4])
+	}
+	f := newEEPROM()
+	f.setBytes(b)
+	if f.data != e.data {
+		t.Error("contents not restored")
+	}
+}
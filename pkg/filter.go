@@ -0,0 +1,857 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"os"
+)
+
+// Pixels are handled here as 0xRRGGBB values, so that the filters
+// can compare and mix colours without knowing the screen format.
+
+// A scaler enlarges a w by h picture by its factor.
+type scaler struct {
+	factor int
+	scale  func(dst, src []uint32, w, h, n int)
+}
+
+var scalers = map[string]scaler{
+	"scale2x": {2, scale2x},
+	"scale3x": {3, scale3x},
+	"hq2x":    {2, hqx},
+	"hq3x":    {3, hqx},
+	"hq4x":    {4, hqx},
+	"xbr2x":   {2, xbr},
+	"xbr3x":   {3, xbr},
+	"xbr4x":   {4, xbr},
+}
+
+// An effect changes an enlarged picture, where each pixel of the
+// original is n by n, to look more like an LCD. bg is the colour of
+// the unlit screen.
+type effect func(pix []uint32, w, h, n int, bg uint32)
+
+var effects = map[string]effect{
+	"grid":      gridEffect,
+	"scanlines": scanlineEffect,
+	"dotmatrix": dotMatrixEffect,
+}
+
+// A postProcessor draws frames through the filters chosen in the
+// Config, in software, instead of filling rectangles on the screen.
+type postProcessor struct {
+	scaler scaler
+	effect effect
+	blend  bool
+	factor int
+
+	rgb   []uint32 // the frame in colour
+	prev  []uint32 // the last one, for blending
+	mixed []uint32
+	out   []uint32
+}
+
+// newPostProcessor sets up the filters named by cfg.Filter and
+// cfg.Effect, and frame blending if cfg.Blend. It returns nil if none
+// of them are used. A filter sets cfg.Scale to its own factor.
+func newPostProcessor(cfg *Config) (*postProcessor, os.Error) {
+	p := &postProcessor{blend: cfg.Blend, factor: cfg.Scale,
+		scaler: scaler{cfg.Scale, nearest}}
+	used := cfg.Blend
+	if name := cfg.Filter; name != "" && name != "none" {
+		s, ok := scalers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter '%s'", name)
+		}
+		p.scaler = s
+		p.factor = s.factor
+		cfg.Scale = s.factor
+		used = true
+	}
+	if name := cfg.Effect; name != "" && name != "none" {
+		e, ok := effects[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown effect '%s'", name)
+		}
+		p.effect = e
+		used = true
+	}
+	if !used {
+		return nil, nil
+	}
+	n := displayW * displayH
+	p.rgb = make([]uint32, n)
+	p.prev = make([]uint32, n)
+	p.mixed = make([]uint32, n)
+	p.out = make([]uint32, n*p.factor*p.factor)
+	return p, nil
+}
+
+// process turns a frame (as kept by the display) into the picture to
+// show, in p.out.
+func (p *postProcessor) process(frame []byte, colors *[16]image.RGBAColor) {
+	var pal [16]uint32
+	for i, c := range colors {
+		pal[i] = rgbOf(c)
+	}
+	for i, b := range frame {
+		p.rgb[i] = pal[b&15]
+	}
+	src := p.rgb
+	if p.blend {
+		for i, c := range p.rgb {
+			p.mixed[i] = mix(p.prev[i], c, 128)
+		}
+		src = p.mixed
+		p.rgb, p.prev = p.prev, p.rgb
+	}
+	p.scaler.scale(p.out, src, displayW, displayH, p.factor)
+	if p.effect != nil {
+		p.effect(p.out, displayW*p.factor, displayH*p.factor,
+			p.factor, pal[0])
+	}
+}
+
+// present draws the last frame through the filters.
+func (lcd *display) present() {
+	p := lcd.post
+	p.process(lcd.shown[:], &lcd.colors)
+	lcd.screen.blit(p.out, 0, 0, displayW*p.factor, displayH*p.factor)
+}
+
+func rgbOf(c image.RGBAColor) uint32 {
+	return uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+}
+
+// mix returns a blend of two colours, with t/256 of b.
+func mix(a, b uint32, t int) uint32 {
+	var c uint32
+	for shift := uint(0); shift < 24; shift += 8 {
+		x := int(a >> shift & 0xFF)
+		y := int(b >> shift & 0xFF)
+		c |= uint32(x+(y-x)*t/256) << shift
+	}
+	return c
+}
+
+// pixelAt returns the pixel at x, y, or the nearest one on the edge.
+func pixelAt(src []uint32, w, h, x, y int) uint32 {
+	if x < 0 {
+		x = 0
+	} else if x >= w {
+		x = w - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= h {
+		y = h - 1
+	}
+	return src[y*w+x]
+}
+
+func nearest(dst, src []uint32, w, h, n int) {
+	for y := 0; y < h*n; y++ {
+		row := src[y/n*w:]
+		out := dst[y*w*n:]
+		for x := 0; x < w*n; x++ {
+			out[x] = row[x/n]
+		}
+	}
+}
+
+// scale2x is Andrea Mazzoleni's Scale2x (also known as EPX): each
+// corner takes the colour of its two neighbours when they agree, and
+// the edge they form is not part of a larger shape.
+func scale2x(dst, src []uint32, width, height, n int) {
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			b := pixelAt(src, width, height, x, y-1)
+			d := pixelAt(src, width, height, x-1, y)
+			e := src[y*width+x]
+			f := pixelAt(src, width, height, x+1, y)
+			h := pixelAt(src, width, height, x, y+1)
+			e0, e1, e2, e3 := e, e, e, e
+			if b != h && d != f {
+				if d == b {
+					e0 = d
+				}
+				if b == f {
+					e1 = f
+				}
+				if d == h {
+					e2 = d
+				}
+				if h == f {
+					e3 = f
+				}
+			}
+			i := y*2*width*2 + x*2
+			dst[i], dst[i+1] = e0, e1
+			dst[i+width*2], dst[i+width*2+1] = e2, e3
+		}
+	}
+}
+
+// scale3x is Scale2x's rules extended to nine pixels.
+func scale3x(dst, src []uint32, width, height, n int) {
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			a := pixelAt(src, width, height, x-1, y-1)
+			b := pixelAt(src, width, height, x, y-1)
+			c := pixelAt(src, width, height, x+1, y-1)
+			d := pixelAt(src, width, height, x-1, y)
+			e := src[y*width+x]
+			f := pixelAt(src, width, height, x+1, y)
+			g := pixelAt(src, width, height, x-1, y+1)
+			h := pixelAt(src, width, height, x, y+1)
+			i := pixelAt(src, width, height, x+1, y+1)
+			out := [9]uint32{e, e, e, e, e, e, e, e, e}
+			if b != h && d != f {
+				if d == b {
+					out[0] = d
+				}
+				if d == b && e != c || b == f && e != a {
+					out[1] = b
+				}
+				if b == f {
+					out[2] = f
+				}
+				if d == b && e != g || d == h && e != a {
+					out[3] = d
+				}
+				if b == f && e != i || h == f && e != c {
+					out[5] = f
+				}
+				if d == h {
+					out[6] = d
+				}
+				if d == h && e != i || h == f && e != g {
+					out[7] = h
+				}
+				if h == f {
+					out[8] = f
+				}
+			}
+			for j := 0; j < 3; j++ {
+				copy(dst[(y*3+j)*width*3+x*3:], out[j*3:j*3+3])
+			}
+		}
+	}
+}
+
+// yuv converts a colour to YUV, for comparing colours the way the
+// eye does.
+func yuv(c uint32) (y, u, v int) {
+	r := int(c >> 16 & 0xFF)
+	g := int(c >> 8 & 0xFF)
+	b := int(c & 0xFF)
+	y = (299*r + 587*g + 114*b) / 1000
+	u = (-169*r - 331*g + 500*b) / 1000
+	v = (500*r - 419*g - 81*b) / 1000
+	return
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Maxim Stepin's hq2x, hq3x and hq4x look at each pixel's 3x3
+// neighbourhood, numbered 0-8 across and down with the pixel itself
+// at 4, and make a pattern of which neighbours differ from it (bit 0
+// for neighbour 0, and so on, skipping 4). The colour of each pixel
+// of the enlarged block is then found from the pattern. The original
+// tables list this for all 256 patterns; here, as in FFmpeg's hqx
+// filter, the same rules are kept as lists of patterns, written for
+// the top left of the block and applied to the rest by mirroring the
+// neighbourhood.
+
+// An hqPattern matches the patterns p with p&mask == bits.
+type hqPattern struct{ mask, bits int }
+
+// An hqMix lists neighbours and their weights, in pairs.
+type hqMix []int
+
+// An hqRule gives a pixel the colour mix, when the neighbourhood's
+// pattern matches one of pats and (unless a == b) neighbours a and b
+// also differ.
+type hqRule struct {
+	pats []hqPattern
+	a, b int
+	mix  hqMix
+}
+
+// hq2xCorner gives each of hq2x's four pixels.
+var hq2xCorner = []hqRule{
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 1, 5, hqMix{4, 3, 3, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 7, 3, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x0B, 0x0B}, {0xFE, 0x4A}, {0xFE, 0x1A}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0x6F, 0x2A}, {0x5B, 0x0A}, {0xBF, 0x3A}, {0xDF, 0x5A},
+		{0x9F, 0x8A}, {0xCF, 0x8A}, {0xEF, 0x4E}, {0x3F, 0x0E},
+		{0xFB, 0x5A}, {0xBB, 0x8A}, {0x7F, 0x5A}, {0xAF, 0x8A},
+		{0xEB, 0x8A}}, 3, 1, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0x0B, 0x08}}, 0, 0, hqMix{4, 2, 0, 1, 1, 1}},
+	{[]hqPattern{{0x0B, 0x02}}, 0, 0, hqMix{4, 2, 0, 1, 3, 1}},
+	{[]hqPattern{{0x2F, 0x2F}}, 0, 0, hqMix{4, 14, 3, 1, 1, 1}},
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}},
+		0, 0, hqMix{4, 5, 1, 2, 3, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}},
+		0, 0, hqMix{4, 5, 3, 2, 1, 1}},
+	{[]hqPattern{{0x1B, 0x03}, {0x4F, 0x43}, {0x8B, 0x83}, {0x6B, 0x43}},
+		0, 0, hqMix{4, 3, 3, 1}},
+	{[]hqPattern{{0x4B, 0x09}, {0x8B, 0x89}, {0x1F, 0x19}, {0x3B, 0x19}},
+		0, 0, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x7E, 0x2A}, {0xEF, 0xAB}, {0xBF, 0x8F}, {0x7E, 0x0E}},
+		0, 0, hqMix{4, 2, 3, 3, 1, 3}},
+	{[]hqPattern{{0xFB, 0x6A}, {0x6F, 0x6E}, {0x3F, 0x3E}, {0xFB, 0xFA},
+		{0xDF, 0xDE}, {0xDF, 0x1E}}, 0, 0, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0x0A, 0x00}, {0x4F, 0x4B}, {0x9F, 0x1B}, {0x2F, 0x0B},
+		{0xBE, 0x0A}, {0xEE, 0x0A}, {0x7E, 0x0A}, {0xEB, 0x4B},
+		{0x3B, 0x1B}}, 0, 0, hqMix{4, 2, 3, 1, 1, 1}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 6, 3, 1, 1, 1}},
+}
+
+// hq3xCorner and hq3xEdge give hq3x's corner pixels and the ones
+// between them; the middle one is left as it was.
+var hq3xCorner = []hqRule{
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 1, 5, hqMix{4, 3, 3, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 7, 3, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x0B, 0x0B}, {0xFE, 0x4A}, {0xFE, 0x1A}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0x6F, 0x2A}, {0x5B, 0x0A}, {0xBF, 0x3A}, {0xDF, 0x5A},
+		{0x9F, 0x8A}, {0xCF, 0x8A}, {0xEF, 0x4E}, {0x3F, 0x0E},
+		{0xFB, 0x5A}, {0xBB, 0x8A}, {0x7F, 0x5A}, {0xAF, 0x8A},
+		{0xEB, 0x8A}}, 3, 1, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0x4B, 0x09}, {0x8B, 0x89}, {0x1F, 0x19}, {0x3B, 0x19}},
+		0, 0, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x1B, 0x03}, {0x4F, 0x43}, {0x8B, 0x83}, {0x6B, 0x43}},
+		0, 0, hqMix{4, 3, 3, 1}},
+	{[]hqPattern{{0x7E, 0x2A}, {0xEF, 0xAB}, {0xBF, 0x8F}, {0x7E, 0x0E}},
+		0, 0, hqMix{3, 1, 1, 1}},
+	{[]hqPattern{{0x4F, 0x4B}, {0x9F, 0x1B}, {0x2F, 0x0B}, {0xBE, 0x0A},
+		{0xEE, 0x0A}, {0x7E, 0x0A}, {0xEB, 0x4B}, {0x3B, 0x1B}},
+		0, 0, hqMix{4, 2, 3, 7, 1, 7}},
+	{[]hqPattern{{0x0B, 0x08}, {0xF9, 0x68}, {0xF3, 0x62}, {0x6D, 0x6C},
+		{0x67, 0x66}, {0x3D, 0x3C}, {0x37, 0x36}, {0xF9, 0xF8},
+		{0xDD, 0xDC}, {0xF3, 0xF2}, {0xD7, 0xD6}, {0xDD, 0x1C},
+		{0xD7, 0x16}, {0x0B, 0x02}}, 0, 0, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 2, 3, 1, 1, 1}},
+}
+
+var hq3xEdge = []hqRule{
+	{[]hqPattern{{0xFE, 0xDE}, {0x9E, 0x16}, {0xDA, 0x12}, {0x17, 0x16},
+		{0x5B, 0x12}, {0xBB, 0x12}}, 1, 5, hqMix{4, 1}},
+	{[]hqPattern{{0x0F, 0x0B}, {0x5E, 0x0A}, {0xFB, 0x7B}, {0x3B, 0x0B},
+		{0xBE, 0x0A}, {0x7A, 0x0A}}, 3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0xBF, 0x8F}, {0x7E, 0x0E}, {0xBF, 0x37}, {0xDB, 0x13}},
+		0, 0, hqMix{1, 3, 4, 1}},
+	{[]hqPattern{{0x02, 0x00}, {0x7C, 0x28}, {0xED, 0xA9}, {0xF5, 0xB4},
+		{0xD9, 0x90}}, 0, 0, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x4F, 0x4B}, {0xFB, 0x7B}, {0xFE, 0x7E}, {0x9F, 0x1B},
+		{0x2F, 0x0B}, {0xBE, 0x0A}, {0x7E, 0x0A}, {0xFB, 0x4B},
+		{0xFB, 0xDB}, {0xFE, 0xDE}, {0xFE, 0x56}, {0x57, 0x56},
+		{0x97, 0x16}, {0x3F, 0x1E}, {0xDB, 0x12}, {0xBB, 0x12}},
+		0, 0, hqMix{4, 7, 1, 1}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 1}},
+}
+
+// hq4xCorner, hq4xEdge and hq4xInner give the four pixels of each
+// quarter of hq4x's block: the corner, the one beside it (or, seen
+// transposed, below it), and the one diagonally inside it.
+var hq4xCorner = []hqRule{
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 1, 5, hqMix{4, 5, 3, 3}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 7, 3, hqMix{4, 5, 1, 3}},
+	{[]hqPattern{{0x0B, 0x0B}, {0xFE, 0x4A}, {0xFE, 0x1A}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0x6F, 0x2A}, {0x5B, 0x0A}, {0xBF, 0x3A}, {0xDF, 0x5A},
+		{0x9F, 0x8A}, {0xCF, 0x8A}, {0xEF, 0x4E}, {0x3F, 0x0E},
+		{0xFB, 0x5A}, {0xBB, 0x8A}, {0x7F, 0x5A}, {0xAF, 0x8A},
+		{0xEB, 0x8A}}, 3, 1, hqMix{4, 5, 0, 3}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 0, 0, hqMix{4, 3, 3, 1}},
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 0, 0, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x1B, 0x03}, {0x4F, 0x43}, {0x8B, 0x83}, {0x6B, 0x43}},
+		0, 0, hqMix{4, 5, 3, 3}},
+	{[]hqPattern{{0x4B, 0x09}, {0x8B, 0x89}, {0x1F, 0x19}, {0x3B, 0x19}},
+		0, 0, hqMix{4, 5, 1, 3}},
+	{[]hqPattern{{0x0F, 0x0B}, {0x5E, 0x0A}, {0x2B, 0x0B}, {0xBE, 0x0A},
+		{0x7A, 0x0A}, {0xEE, 0x0A}}, 0, 0, hqMix{1, 1, 3, 1}},
+	{[]hqPattern{{0x0B, 0x08}, {0xF9, 0x68}, {0xF3, 0x62}, {0x6D, 0x6C},
+		{0x67, 0x66}, {0x3D, 0x3C}, {0x37, 0x36}, {0xF9, 0xF8},
+		{0xDD, 0xDC}, {0xF3, 0xF2}, {0xD7, 0xD6}, {0xDD, 0x1C},
+		{0xD7, 0x16}, {0x0B, 0x02}}, 0, 0, hqMix{4, 5, 0, 3}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 2, 1, 1, 3, 1}},
+}
+
+var hq4xEdge = []hqRule{
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 1, 5, hqMix{4, 7, 3, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 7, 3, hqMix{4, 1}},
+	{[]hqPattern{{0x0F, 0x0B}, {0x2B, 0x0B}, {0xFE, 0x4A}, {0xFE, 0x1A}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0x6F, 0x2A}, {0x5B, 0x0A}, {0xBF, 0x3A}, {0xDF, 0x5A},
+		{0x9F, 0x8A}, {0xCF, 0x8A}, {0xEF, 0x4E}, {0x3F, 0x0E},
+		{0xFB, 0x5A}, {0xBB, 0x8A}, {0x7F, 0x5A}, {0xAF, 0x8A},
+		{0xEB, 0x8A}}, 3, 1, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 0, 0, hqMix{4, 1}},
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 0, 0, hqMix{1, 3, 4, 1}},
+	{[]hqPattern{{0x1B, 0x03}, {0x4F, 0x43}, {0x8B, 0x83}, {0x6B, 0x43}},
+		0, 0, hqMix{4, 7, 3, 1}},
+	{[]hqPattern{{0x4B, 0x09}, {0x8B, 0x89}, {0x1F, 0x19}, {0x3B, 0x19}},
+		0, 0, hqMix{4, 7, 1, 1}},
+	{[]hqPattern{{0x0F, 0x0B}, {0x5E, 0x0A}, {0x2B, 0x0B}, {0xBE, 0x0A},
+		{0x7A, 0x0A}, {0xEE, 0x0A}}, 0, 0, hqMix{1, 1, 4, 1}},
+	{[]hqPattern{{0x0B, 0x08}}, 0, 0, hqMix{4, 5, 1, 2, 0, 1}},
+	{[]hqPattern{{0x0B, 0x08}, {0xF9, 0x68}, {0xF3, 0x62}, {0x6D, 0x6C},
+		{0x67, 0x66}, {0x3D, 0x3C}, {0x37, 0x36}, {0xF9, 0xF8},
+		{0xDD, 0xDC}, {0xF3, 0xF2}, {0xD7, 0xD6}, {0xDD, 0x1C},
+		{0xD7, 0x16}, {0x0B, 0x02}}, 0, 0, hqMix{4, 3, 0, 1}},
+	{[]hqPattern{{0x2F, 0x2F}}, 0, 0, hqMix{4, 1}},
+	{[]hqPattern{{0x0A, 0x00}}, 0, 0, hqMix{4, 5, 1, 2, 3, 1}},
+	{[]hqPattern{{0x7E, 0x2A}, {0xEF, 0xAB}, {0xBF, 0x8F}, {0x7E, 0x0E}},
+		0, 0, hqMix{1, 1, 4, 1}},
+	{[]hqPattern{{0x4F, 0x4B}, {0x9F, 0x1B}, {0x2F, 0x0B}, {0xBE, 0x0A},
+		{0xEE, 0x0A}, {0x7E, 0x0A}, {0xEB, 0x4B}, {0x3B, 0x1B}},
+		0, 0, hqMix{4, 3, 1, 1}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 1}},
+}
+
+var hq4xInner = []hqRule{
+	{[]hqPattern{{0x7F, 0x2B}, {0xEF, 0xAB}, {0xBF, 0x8F}, {0x7F, 0x0F}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0xBF, 0x37}, {0xDB, 0x13}}, 1, 5, hqMix{4, 7, 3, 1}},
+	{[]hqPattern{{0xDB, 0x49}, {0xEF, 0x6D}}, 7, 3, hqMix{4, 7, 1, 1}},
+	{[]hqPattern{{0x6F, 0x2A}, {0x5B, 0x0A}, {0xBF, 0x3A}, {0xDF, 0x5A},
+		{0x9F, 0x8A}, {0xCF, 0x8A}, {0xEF, 0x4E}, {0x3F, 0x0E},
+		{0xFB, 0x5A}, {0xBB, 0x8A}, {0x7F, 0x5A}, {0xAF, 0x8A},
+		{0xEB, 0x8A}}, 3, 1, hqMix{4, 7, 0, 1}},
+	{[]hqPattern{{0x0F, 0x0B}, {0x2B, 0x0B}, {0xFE, 0x4A}, {0xFE, 0x1A}},
+		3, 1, hqMix{4, 1}},
+	{[]hqPattern{{0x2F, 0x2F}}, 0, 0, hqMix{4, 1}},
+	{[]hqPattern{{0x0A, 0x00}}, 0, 0, hqMix{4, 6, 3, 1, 1, 1}},
+	{[]hqPattern{{0x1B, 0x03}, {0x4F, 0x43}, {0x8B, 0x83}, {0x6B, 0x43}},
+		0, 0, hqMix{4, 7, 3, 1}},
+	{[]hqPattern{{0x4B, 0x09}, {0x8B, 0x89}, {0x1F, 0x19}, {0x3B, 0x19}},
+		0, 0, hqMix{4, 7, 1, 1}},
+	{[]hqPattern{{0x0B, 0x08}, {0xF9, 0x68}, {0xF3, 0x62}, {0x6D, 0x6C},
+		{0x67, 0x66}, {0x3D, 0x3C}, {0x37, 0x36}, {0xF9, 0xF8},
+		{0xDD, 0xDC}, {0xF3, 0xF2}, {0xD7, 0xD6}, {0xDD, 0x1C},
+		{0xD7, 0x16}, {0x0B, 0x02}}, 0, 0, hqMix{4, 7, 0, 1}},
+	{[]hqPattern{{0x00, 0x00}}, 0, 0, hqMix{4, 1}},
+}
+
+// An hqTable holds, for each pattern, the rules that may apply to it,
+// up to the first that always does.
+type hqTable [256][]hqRule
+
+func newHQTable(rules []hqRule) *hqTable {
+	t := new(hqTable)
+	for k := range t {
+	rules:
+		for _, r := range rules {
+			for _, p := range r.pats {
+				if k&p.mask == p.bits {
+					t[k] = append(t[k], r)
+					if r.a == r.b {
+						break rules
+					}
+					break
+				}
+			}
+		}
+	}
+	return t
+}
+
+// The tables for each factor. hq2x has no edges, and only hq4x has
+// inner pixels; hq3x leaves its middle pixel as it was.
+var (
+	hqCorner = [...]*hqTable{2: newHQTable(hq2xCorner),
+		3: newHQTable(hq3xCorner), 4: newHQTable(hq4xCorner)}
+	hqEdge  = [...]*hqTable{3: newHQTable(hq3xEdge), 4: newHQTable(hq4xEdge)}
+	hqInner = [...]*hqTable{4: newHQTable(hq4xInner)}
+)
+
+// hqFrames reorders the neighbourhood so that another corner is at
+// the top left: hqFrames[mx][my][t] is mirrored across if mx, down if
+// my, and transposed first if t. hqPatterns does the same for the
+// pattern.
+var (
+	hqFrames   [2][2][2][9]int
+	hqPatterns [2][2][2][256]uint8
+)
+
+// hqBit gives the bit for each neighbour in a pattern.
+var hqBit = [9]uint{0, 1, 2, 3, 8, 4, 5, 6, 7}
+
+func init() {
+	for i := 0; i < 8; i++ {
+		mx, my, t := i&1, i>>1&1, i>>2
+		for j := range hqFrames[mx][my][t] {
+			x, y := j%3, j/3
+			if t == 1 {
+				x, y = y, x
+			}
+			if mx == 1 {
+				x = 2 - x
+			}
+			if my == 1 {
+				y = 2 - y
+			}
+			hqFrames[mx][my][t][j] = y*3 + x
+		}
+		for k := range hqPatterns[mx][my][t] {
+			var p uint8
+			for j, g := range hqFrames[mx][my][t] {
+				if j != 4 && k>>hqBit[g]&1 != 0 {
+					p |= 1 << hqBit[j]
+				}
+			}
+			hqPatterns[mx][my][t][k] = p
+		}
+	}
+}
+
+// hqNeighbours is a pixel's 3x3 neighbourhood, with the colours in
+// YUV too, and its pattern.
+type hqNeighbours struct {
+	rgb [9]uint32
+	yuv [9][3]int
+	k   int
+}
+
+// differ reports whether neighbours i and j are told apart, by the
+// thresholds of hqx.
+func (nb *hqNeighbours) differ(i, j int) bool {
+	a, b := &nb.yuv[i], &nb.yuv[j]
+	return nb.rgb[i] != nb.rgb[j] && (abs(a[0]-b[0]) > 48 ||
+		abs(a[1]-b[1]) > 7 || abs(a[2]-b[2]) > 6)
+}
+
+// pattern finds which neighbours differ from the middle.
+func (nb *hqNeighbours) pattern() {
+	nb.k = 0
+	for i := range nb.rgb {
+		if i != 4 && nb.differ(i, 4) {
+			nb.k |= 1 << hqBit[i]
+		}
+	}
+}
+
+// pixel returns the colour that the first matching rule in t gives,
+// for the neighbourhood seen through frame f, where its pattern is k.
+func (nb *hqNeighbours) pixel(t *hqTable, f *[9]int, k uint8) uint32 {
+	rules := t[k]
+	for i := range rules {
+		r := &rules[i]
+		if r.a == r.b || nb.differ(f[r.a], f[r.b]) {
+			return nb.blend(f, r.mix)
+		}
+	}
+	return nb.rgb[4]
+}
+
+// blend mixes the neighbours listed in m.
+func (nb *hqNeighbours) blend(f *[9]int, m hqMix) uint32 {
+	if len(m) == 2 {
+		return nb.rgb[f[m[0]]]
+	}
+	var r, g, b, total uint32
+	for i := 0; i < len(m); i += 2 {
+		c, w := nb.rgb[f[m[i]]], uint32(m[i+1])
+		r += c >> 16 & 0xFF * w
+		g += c >> 8 & 0xFF * w
+		b += c & 0xFF * w
+		total += w
+	}
+	// The weights always add up to a power of two.
+	s := hqShift[total]
+	return r>>s<<16 | g>>s<<8 | b>>s
+}
+
+var hqShift = [17]uint{2: 1, 4: 2, 8: 3, 16: 4}
+
+// An hqPlace says how to find one pixel of the enlarged block: by the
+// rules in t, with the neighbourhood seen through frame f and the
+// pattern through p, or if t is nil, by keeping the pixel as it was.
+type hqPlace struct {
+	t *hqTable
+	f *[9]int
+	p *[256]uint8
+}
+
+// hqLayout places each pixel of an n by n block, working from the
+// nearest corner.
+func hqLayout(n int) []hqPlace {
+	places := make([]hqPlace, n*n)
+	for j := 0; j < n; j++ {
+		for i := 0; i < n; i++ {
+			mx, my := 0, 0
+			ci, cj := i, j
+			if 2*i >= n {
+				mx, ci = 1, n-1-i
+			}
+			if 2*j >= n {
+				my, cj = 1, n-1-j
+			}
+			t, tr := hqInner[n], 0
+			switch {
+			case ci == 0 && cj == 0:
+				t = hqCorner[n]
+			case ci == 1 && cj == 0:
+				t = hqEdge[n]
+			case ci == 0 && cj == 1:
+				t, tr = hqEdge[n], 1
+			}
+			places[j*n+i] = hqPlace{t, &hqFrames[mx][my][tr],
+				&hqPatterns[mx][my][tr]}
+		}
+	}
+	return places
+}
+
+// hqx is hq2x, hq3x or hq4x, for n of 2, 3 or 4.
+func hqx(dst, src []uint32, width, height, n int) {
+	places := hqLayout(n)
+	var nb hqNeighbours
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for i := range nb.rgb {
+				if x > 0 && i%3 < 2 {
+					// Along a row, two columns are
+					// already known.
+					nb.rgb[i] = nb.rgb[i+1]
+					nb.yuv[i] = nb.yuv[i+1]
+					continue
+				}
+				c := pixelAt(src, width, height, x+i%3-1, y+i/3-1)
+				nb.rgb[i] = c
+				nb.yuv[i][0], nb.yuv[i][1], nb.yuv[i][2] = yuv(c)
+			}
+			nb.pattern()
+			for j := 0; j < n; j++ {
+				out := dst[(y*n+j)*width*n+x*n:]
+				for i, pl := range places[j*n : j*n+n] {
+					if pl.t == nil {
+						out[i] = nb.rgb[4]
+					} else {
+						out[i] = nb.pixel(pl.t, pl.f, pl.p[nb.k])
+					}
+				}
+			}
+		}
+	}
+}
+
+// xbrNeighbours is a pixel's 5x5 neighbourhood, numbered across and
+// down with the pixel itself at 12, with the colours in YUV too.
+type xbrNeighbours struct {
+	rgb [25]uint32
+	yuv [25][3]int
+}
+
+// dist is the YUV distance between neighbours i and j used by xBR.
+func (nb *xbrNeighbours) dist(i, j int) int {
+	a, b := &nb.yuv[i], &nb.yuv[j]
+	return abs(a[0]-b[0]) + abs(a[1]-b[1]) + abs(a[2]-b[2])
+}
+
+// alike is xBR's test for colours close enough to count as the same.
+func (nb *xbrNeighbours) alike(i, j int) bool {
+	return nb.dist(i, j) < 155
+}
+
+// An xbrStep blends the colour found for a corner into the enlarged
+// pixel: out[to] = mix(out[from], px, t).
+type xbrStep struct{ to, from, t int }
+
+// xbrSteps gives, for each factor, how to fill in the bottom right
+// corner of an enlarged pixel (numbered across and down) when the edge
+// found there runs shallowly both ways, to the left, upwards,
+// diagonally, or only weakly.
+var xbrSteps = map[int][5][]xbrStep{
+	2: {
+		{{3, 3, 224}, {2, 2, 64}, {1, 2, 0}},
+		{{3, 3, 192}, {2, 2, 64}},
+		{{3, 3, 192}, {1, 1, 64}},
+		{{3, 3, 128}},
+		{{3, 3, 128}},
+	},
+	3: {
+		{{7, 7, 192}, {6, 6, 64}, {5, 7, 0}, {2, 6, 0}, {8, 8, 256}},
+		{{7, 7, 192}, {5, 5, 64}, {6, 6, 64}, {8, 8, 256}},
+		{{5, 5, 192}, {7, 7, 64}, {2, 2, 64}, {8, 8, 256}},
+		{{8, 8, 224}, {5, 5, 32}, {7, 7, 32}},
+		{{8, 8, 128}},
+	},
+	4: {
+		{{13, 13, 192}, {12, 12, 64}, {15, 15, 256}, {14, 14, 256},
+			{11, 11, 256}, {10, 12, 0}, {3, 12, 0}, {7, 13, 0}},
+		{{11, 11, 192}, {13, 13, 192}, {10, 10, 64}, {12, 12, 64},
+			{14, 14, 256}, {15, 15, 256}},
+		{{14, 14, 192}, {7, 7, 192}, {10, 10, 64}, {3, 3, 64},
+			{11, 11, 256}, {15, 15, 256}},
+		{{11, 11, 128}, {14, 14, 128}, {15, 15, 256}},
+		{{15, 15, 128}},
+	},
+}
+
+// The four turns that bring each corner of a pixel to the bottom
+// right, in xBR's order: (dx, dy) is taken as (a*dx+b*dy, c*dx+d*dy).
+var xbrTurns = [4][4]int{
+	{1, 0, 0, 1},
+	{0, 1, -1, 0},
+	{-1, 0, 0, -1},
+	{0, -1, 1, 0},
+}
+
+// xbr is Hyllian's xBR (the level 2 version, as in FFmpeg's xbr
+// filter), for n of 2, 3 or 4. Each corner of each pixel is checked
+// for an edge, by comparing the colour distances along the two
+// diagonals of its neighbourhood; the direction of the edge then
+// decides how much of the corner is blended with the neighbour
+// across it.
+func xbr(dst, src []uint32, width, height, n int) {
+	steps := xbrSteps[n]
+	out := make([]uint32, n*n)
+	var nb xbrNeighbours
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for i := range nb.rgb {
+				if x > 0 && i%5 < 4 {
+					nb.rgb[i] = nb.rgb[i+1]
+					nb.yuv[i] = nb.yuv[i+1]
+					continue
+				}
+				c := pixelAt(src, width, height, x+i%5-2, y+i/5-2)
+				nb.rgb[i] = c
+				nb.yuv[i][0], nb.yuv[i][1], nb.yuv[i][2] = yuv(c)
+			}
+			for i := range out {
+				out[i] = nb.rgb[12]
+			}
+			for _, turn := range xbrTurns {
+				s, px := nb.corner(turn)
+				if s < 0 {
+					continue
+				}
+				for _, st := range steps[s] {
+					to := xbrTurn(turn, st.to, n)
+					from := xbrTurn(turn, st.from, n)
+					out[to] = mix(out[from], px, st.t)
+				}
+			}
+			for j := 0; j < n; j++ {
+				copy(dst[(y*n+j)*width*n+x*n:], out[j*n:j*n+n])
+			}
+		}
+	}
+}
+
+// corner finds the edge at the bottom right corner of the middle
+// pixel, with the neighbourhood turned by turn. It returns the index
+// of its xbrSteps (or -1 if there is none) and the colour of the
+// neighbour across it.
+func (nb *xbrNeighbours) corner(turn [4]int) (int, uint32) {
+	p := func(dx, dy int) int {
+		return (2+turn[2]*dx+turn[3]*dy)*5 + 2 + turn[0]*dx + turn[1]*dy
+	}
+	e, b, c := 12, p(0, -1), p(1, -1)
+	d, f := p(-1, 0), p(1, 0)
+	g, h, i := p(-1, 1), p(0, 1), p(1, 1)
+	f4, i4 := p(2, 0), p(2, 1)
+	h5, i5 := p(0, 2), p(1, 2)
+	rgb := &nb.rgb
+	if rgb[e] == rgb[h] || rgb[e] == rgb[f] {
+		return -1, 0
+	}
+	along := nb.dist(e, c) + nb.dist(e, g) + nb.dist(i, h5) +
+		nb.dist(i, f4) + 4*nb.dist(h, f)
+	across := nb.dist(h, d) + nb.dist(h, i5) + nb.dist(f, i4) +
+		nb.dist(f, b) + 4*nb.dist(e, i)
+	if along > across {
+		return -1, 0
+	}
+	px := rgb[h]
+	if nb.dist(e, f) <= nb.dist(e, h) {
+		px = rgb[f]
+	}
+	if along == across || !(!nb.alike(f, b) && !nb.alike(h, d) ||
+		nb.alike(e, i) && !nb.alike(f, i4) && !nb.alike(h, i5) ||
+		nb.alike(e, g) || nb.alike(e, c)) {
+		return 4, px
+	}
+	ke, ki := nb.dist(f, g), nb.dist(h, c)
+	left := 2*ke <= ki && rgb[e] != rgb[g] && rgb[d] != rgb[g]
+	up := ke >= 2*ki && rgb[e] != rgb[c] && rgb[b] != rgb[c]
+	switch {
+	case left && up:
+		return 0, px
+	case left:
+		return 1, px
+	case up:
+		return 2, px
+	}
+	return 3, px
+}
+
+// xbrTurn returns where pixel i of an n by n block goes when the block
+// is turned by t.
+func xbrTurn(t [4]int, i, n int) int {
+	// Measure from the middle of the block, in half pixels.
+	x, y := 2*(i%n)-(n-1), 2*(i/n)-(n-1)
+	x, y = t[0]*x+t[1]*y, t[2]*x+t[3]*y
+	return (y+n-1)/2*n + (x+n-1)/2
+}
+
+// gridEffect darkens the edges of each pixel, like the gaps between
+// the cells of an LCD.
+func gridEffect(pix []uint32, w, h, n int, bg uint32) {
+	if n < 2 {
+		return
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x%n == n-1 || y%n == n-1 {
+				pix[y*w+x] = mix(pix[y*w+x], 0, 64)
+			}
+		}
+	}
+}
+
+// scanlineEffect darkens the bottom row of each pixel.
+func scanlineEffect(pix []uint32, w, h, n int, bg uint32) {
+	if n < 2 {
+		return
+	}
+	for y := n - 1; y < h; y += n {
+		row := pix[y*w : (y+1)*w]
+		for x, c := range row {
+			row[x] = mix(c, 0, 128)
+		}
+	}
+}
+
+// dotMatrixEffect separates the pixels with the colour of the unlit
+// screen, as on the DMG, where the dots stand slightly apart.
+func dotMatrixEffect(pix []uint32, w, h, n int, bg uint32) {
+	if n < 2 {
+		return
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			edgeX, edgeY := x%n == n-1, y%n == n-1
+			switch {
+			case edgeX && edgeY:
+				pix[y*w+x] = mix(pix[y*w+x], bg, 192)
+			case edgeX || edgeY:
+				pix[y*w+x] = mix(pix[y*w+x], bg, 128)
+			}
+		}
+	}
+}
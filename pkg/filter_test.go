@@ -0,0 +1,199 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+// Flat areas must come out unchanged by every filter.
+func TestFiltersFlat(t *testing.T) {
+	const w, h = 6, 5
+	for name, s := range scalers {
+		f := func(c uint32) bool {
+			c &= 0xFFFFFF
+			src := make([]uint32, w*h)
+			for i := range src {
+				src[i] = c
+			}
+			dst := make([]uint32, w*h*s.factor*s.factor)
+			s.scale(dst, src, w, h, s.factor)
+			for _, x := range dst {
+				if x != c {
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestScale2x(t *testing.T) {
+	// A diagonal step gets its corners filled in.
+	src := []uint32{
+		x, o,
+		o, o,
+	}
+	want := []uint32{
+		x, x, o, o,
+		x, o, o, o,
+		o, o, o, o,
+		o, o, o, o,
+	}
+	dst := make([]uint32, len(want))
+	scale2x(dst, src, 2, 2, 2)
+	for i := range want {
+		if dst[i] != want[i] {
+			t.Fatalf("got %06X, want %06X", dst, want)
+		}
+	}
+}
+
+// checkScaler runs a filter over a 4x4 picture, and compares every
+// pixel of the result.
+func checkScaler(t *testing.T, name string, src, want []uint32) {
+	s := scalers[name]
+	w := 4 * s.factor
+	dst := make([]uint32, w*w)
+	s.scale(dst, src, 4, 4, s.factor)
+	for i := range want {
+		if dst[i] != want[i] {
+			t.Errorf("%s: pixel %d, %d is %06X, want %06X", name,
+				i%w, i/w, dst[i], want[i])
+		}
+	}
+}
+
+// Pictures for the filter tests are black (o) and white (x), and
+// come out with mixes of the two: a quarter white (q1), about half
+// (dark, a little under, and lite, a little over), three quarters
+// (q3) and seven eighths (e7).
+const (
+	o, x       = 0x000000, 0xFFFFFF
+	q1, q3     = 0x3F3F3F, 0xBFBFBF
+	dark, lite = 0x7F7F7F, 0x808080
+	e7         = 0xDFDFDF
+)
+
+func TestFiltersStraightEdge(t *testing.T) {
+	src := []uint32{
+		x, x, o, o,
+		x, x, o, o,
+		x, x, o, o,
+		x, x, o, o,
+	}
+	for name, s := range scalers {
+		want := make([]uint32, 16*s.factor*s.factor)
+		nearest(want, src, 4, 4, s.factor)
+		checkScaler(t, name, src, want)
+	}
+}
+
+func TestFiltersLonePixel(t *testing.T) {
+	src := []uint32{
+		o, o, o, o,
+		o, x, o, o,
+		o, o, o, o,
+		o, o, o, o,
+	}
+	// hq2x only dims it...
+	want := make([]uint32, 8*8)
+	want[2*8+2], want[2*8+3], want[3*8+2], want[3*8+3] = e7, e7, e7, e7
+	checkScaler(t, "hq2x", src, want)
+	// ...but hq3x and hq4x round it off.
+	want = make([]uint32, 12*12)
+	copy(want[3*12+3:], []uint32{dark, x, dark})
+	copy(want[4*12+3:], []uint32{x, x, x})
+	copy(want[5*12+3:], []uint32{dark, x, dark})
+	checkScaler(t, "hq3x", src, want)
+	want = make([]uint32, 16*16)
+	copy(want[4*16+4:], []uint32{dark, x, x, dark})
+	copy(want[5*16+4:], []uint32{x, x, x, x})
+	copy(want[6*16+4:], []uint32{x, x, x, x})
+	copy(want[7*16+4:], []uint32{dark, x, x, dark})
+	checkScaler(t, "hq4x", src, want)
+	// xBR blends each corner halfway with the background.
+	want = make([]uint32, 8*8)
+	want[2*8+2], want[2*8+3], want[3*8+2], want[3*8+3] = lite, lite, lite, lite
+	checkScaler(t, "xbr2x", src, want)
+}
+
+func TestFiltersStaircase(t *testing.T) {
+	src := []uint32{
+		x, o, o, o,
+		x, x, o, o,
+		x, x, x, o,
+		x, x, x, x,
+	}
+	checkScaler(t, "hq2x", src, []uint32{
+		x, x, q1, o, o, o, o, o,
+		x, x, q3, o, o, o, o, o,
+		x, x, x, dark, o, o, o, o,
+		x, x, x, x, dark, o, o, o,
+		x, x, x, x, x, dark, o, o,
+		x, x, x, x, x, x, q3, q1,
+		x, x, x, x, x, x, x, x,
+		x, x, x, x, x, x, x, x,
+	})
+	checkScaler(t, "xbr2x", src, []uint32{
+		x, x, q1, o, o, o, o, o,
+		x, x, q3, o, o, o, o, o,
+		x, x, x, lite, o, o, o, o,
+		x, x, x, x, dark, o, o, o,
+		x, x, x, x, x, lite, o, o,
+		x, x, x, x, x, x, q3, q1,
+		x, x, x, x, x, x, x, x,
+		x, x, x, x, x, x, x, x,
+	})
+}
+
+// The hq rules are written for the top left corner and mirrored for
+// the others, so they must treat a neighbourhood and its transpose
+// alike (or for the edge pixels of hq3x, its mirror image across).
+func TestHQSymmetry(t *testing.T) {
+	colors := []uint32{o, x, 0x80FF80}
+	id, tr, mx := &hqFrames[0][0][0], &hqFrames[0][0][1], &hqFrames[1][0][0]
+	checks := []struct {
+		name string
+		tab  *hqTable
+		f    *[9]int
+		p    *[256]uint8
+	}{
+		{"hq2x corner", hqCorner[2], tr, &hqPatterns[0][0][1]},
+		{"hq3x corner", hqCorner[3], tr, &hqPatterns[0][0][1]},
+		{"hq3x edge", hqEdge[3], mx, &hqPatterns[1][0][0]},
+		{"hq4x corner", hqCorner[4], tr, &hqPatterns[0][0][1]},
+		{"hq4x inner", hqInner[4], tr, &hqPatterns[0][0][1]},
+	}
+	var nb hqNeighbours
+	for n := 0; n < 19683; n++ { // 3 to the 9th
+		for i, m := 0, n; i < 9; i, m = i+1, m/3 {
+			nb.rgb[i] = colors[m%3]
+			nb.yuv[i][0], nb.yuv[i][1], nb.yuv[i][2] = yuv(nb.rgb[i])
+		}
+		nb.pattern()
+		for _, c := range checks {
+			a := nb.pixel(c.tab, id, uint8(nb.k))
+			b := nb.pixel(c.tab, c.f, c.p[nb.k])
+			if a != b {
+				t.Fatalf("%s: %06X gives %06X, but %06X turned",
+					c.name, nb.rgb, a, b)
+			}
+		}
+	}
+}
+
+func TestMix(t *testing.T) {
+	if c := mix(0x000000, 0xFF8040, 128); c != 0x7F4020 {
+		t.Errorf("half mix gave %06X", c)
+	}
+	if c := mix(0x123456, 0xABCDEF, 0); c != 0x123456 {
+		t.Errorf("no mix gave %06X", c)
+	}
+}
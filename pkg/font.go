@@ -0,0 +1,112 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+)
+
+const (
+	glyphW = 3
+	glyphH = 5
+)
+
+// A tiny 3x5 bitmap font, enough for debugging overlays. Each row is
+// three bits wide with the most significant bit on the left. Lower
+// case letters are drawn using the upper case glyphs.
+var font = map[byte][glyphH]byte{
+	' ':  {0, 0, 0, 0, 0},
+	'!':  {2, 2, 2, 0, 2},
+	'"':  {5, 5, 0, 0, 0},
+	'#':  {5, 7, 5, 7, 5},
+	'%':  {5, 1, 2, 4, 5},
+	'\'': {2, 2, 0, 0, 0},
+	'(':  {1, 2, 2, 2, 1},
+	')':  {4, 2, 2, 2, 4},
+	'*':  {0, 5, 2, 5, 0},
+	'+':  {0, 2, 7, 2, 0},
+	',':  {0, 0, 0, 2, 4},
+	'-':  {0, 0, 7, 0, 0},
+	'.':  {0, 0, 0, 0, 2},
+	'/':  {1, 1, 2, 4, 4},
+	'0':  {7, 5, 5, 5, 7},
+	'1':  {2, 6, 2, 2, 7},
+	'2':  {7, 1, 7, 4, 7},
+	'3':  {7, 1, 3, 1, 7},
+	'4':  {5, 5, 7, 1, 1},
+	'5':  {7, 4, 7, 1, 7},
+	'6':  {7, 4, 7, 5, 7},
+	'7':  {7, 1, 1, 2, 2},
+	'8':  {7, 5, 7, 5, 7},
+	'9':  {7, 5, 7, 1, 7},
+	':':  {0, 2, 0, 2, 0},
+	';':  {0, 2, 0, 2, 4},
+	'<':  {1, 2, 4, 2, 1},
+	'=':  {0, 7, 0, 7, 0},
+	'>':  {4, 2, 1, 2, 4},
+	'?':  {7, 1, 3, 0, 2},
+	'@':  {7, 5, 7, 4, 7},
+	'A':  {2, 5, 7, 5, 5},
+	'B':  {6, 5, 6, 5, 6},
+	'C':  {3, 4, 4, 4, 3},
+	'D':  {6, 5, 5, 5, 6},
+	'E':  {7, 4, 6, 4, 7},
+	'F':  {7, 4, 6, 4, 4},
+	'G':  {3, 4, 5, 5, 3},
+	'H':  {5, 5, 7, 5, 5},
+	'I':  {7, 2, 2, 2, 7},
+	'J':  {1, 1, 1, 5, 2},
+	'K':  {5, 5, 6, 5, 5},
+	'L':  {4, 4, 4, 4, 7},
+	'M':  {5, 7, 7, 5, 5},
+	'N':  {6, 5, 5, 5, 5},
+	'O':  {2, 5, 5, 5, 2},
+	'P':  {6, 5, 6, 4, 4},
+	'Q':  {2, 5, 5, 6, 3},
+	'R':  {6, 5, 6, 5, 5},
+	'S':  {3, 4, 2, 1, 6},
+	'T':  {7, 2, 2, 2, 2},
+	'U':  {5, 5, 5, 5, 7},
+	'V':  {5, 5, 5, 5, 2},
+	'W':  {5, 5, 7, 7, 5},
+	'X':  {5, 5, 2, 5, 5},
+	'Y':  {5, 5, 2, 2, 2},
+	'Z':  {7, 1, 2, 4, 7},
+	'[':  {3, 2, 2, 2, 3},
+	']':  {6, 2, 2, 2, 6},
+	'^':  {2, 5, 0, 0, 0},
+	'_':  {0, 0, 0, 0, 7},
+}
+
+// drawText draws formatted text at (x, y) in display coordinates,
+// returning the width in pixels of what was drawn.
+func (lcd *display) drawText(x, y int, color uint32, format string, args ...interface{}) int {
+	return textPixels(x, y, fmt.Sprintf(format, args...), func(x, y int) {
+		lcd.fillRect(x, y, 1, 1, color)
+	})
+}
+
+// textPixels calls plot for each pixel of s drawn at (x, y),
+// returning the width of the text.
+func textPixels(x, y int, s string, plot func(x, y int)) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		glyph, ok := font[c]
+		if !ok {
+			glyph = font['?']
+		}
+		for row := 0; row < glyphH; row++ {
+			for col := 0; col < glyphW; col++ {
+				if glyph[row]&(4>>uint(col)) != 0 {
+					plot(x+i*(glyphW+1)+col, y+row)
+				}
+			}
+		}
+	}
+	return len(s) * (glyphW + 1)
+}
@@ -0,0 +1,467 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	gbsHeaderSize = 0x70
+
+	// Routines in the GBS data are called with this as the
+	// return address; it is never executed.
+	gbsReturn = 0x00F0
+
+	// Give up on an init or play routine which runs this long.
+	gbsCallLimit = ticksFreq * 4
+)
+
+// A gbsFile is a Game Boy Sound System rip: the sound driver and
+// music data from a game, along with the entry points for playing
+// each song.
+type gbsFile struct {
+	songs     int
+	first     int
+	load      uint16
+	init      uint16
+	play      uint16
+	sp        uint16
+	tma       byte
+	tac       byte
+	title     string
+	author    string
+	copyright string
+
+	rom romImage
+}
+
+func loadGBS(path string) (*gbsFile, os.Error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGBS(data)
+}
+
+func parseGBS(data []byte) (f *gbsFile, err os.Error) {
+	if len(data) < gbsHeaderSize || string(data[0:3]) != "GBS" {
+		return nil, os.NewError("not a GBS file")
+	}
+	if data[3] != 1 {
+		return nil, fmt.Errorf("unsupported GBS version %d", data[3])
+	}
+
+	word := func(i int) uint16 {
+		return uint16(data[i]) | uint16(data[i+1])<<8
+	}
+	str := func(i int) string {
+		s := data[i : i+32]
+		if n := bytes.IndexByte(s, 0); n >= 0 {
+			s = s[:n]
+		}
+		return string(s)
+	}
+
+	f = &gbsFile{
+		songs:     int(data[4]),
+		first:     int(data[5]),
+		load:      word(6),
+		init:      word(8),
+		play:      word(10),
+		sp:        word(12),
+		tma:       data[14],
+		tac:       data[15],
+		title:     str(0x10),
+		author:    str(0x30),
+		copyright: str(0x50),
+	}
+	if f.load < 0x0400 || f.load >= 0x8000 {
+		return nil, fmt.Errorf("bad GBS load address %04Xh", f.load)
+	}
+	if f.songs == 0 {
+		return nil, os.NewError("GBS file has no songs")
+	}
+	// Some rips number the first song from zero; play song 1 then.
+	if f.first < 1 || f.first > f.songs {
+		f.first = 1
+	}
+
+	// Map the data into a ROM image at the load address, padded
+	// out to a whole number of banks.
+	data = data[gbsHeaderSize:]
+	size := int(f.load) + len(data)
+	size = (size + 0x3FFF) &^ 0x3FFF
+	if size < 0x8000 {
+		size = 0x8000
+	}
+	f.rom = make(romImage, size)
+	copy(f.rom[f.load:], data)
+
+	// RST instructions are relocated to the load address, and
+	// interrupts return immediately (play is called directly).
+	for v := 0; v < 0x40; v += 8 {
+		addr := int(f.load) + v
+		f.rom[v] = 0xC3 // JP a16
+		f.rom[v+1] = byte(addr)
+		f.rom[v+2] = byte(addr >> 8)
+	}
+	for v := vblankAddr; v <= joypadAddr; v += 8 {
+		f.rom[v] = 0xD9 // RETI
+	}
+	return
+}
+
+// A gbsPlayer runs the routines in a GBS file on the emulated CPU,
+// calling play at the rate given by the header's timer settings (or
+// at the VBlank rate if the timer is not used).
+type gbsPlayer struct {
+	*gbsFile
+	sys *machine
+	lcd *display
+
+	track  int // 0-based
+	period int // CPU ticks between calls to play
+	clock  int
+	speed  int // CPU ticks per tick: 2 in double speed mode
+
+	frameTime int64
+}
+
+func newGBSPlayer(f *gbsFile, cfg *Config) *gbsPlayer {
+	m := &memory{rom: f.rom, cart: newGBSCart(f.rom), config: cfg,
+		dpadBits: 0xF, btnBits: 0xF, held: 0xFF, speed: 100}
+	p := &gbsPlayer{gbsFile: f, speed: 1}
+	bus := &gbsBus{memory: m}
+	if f.tac&0x80 != 0 {
+		p.speed = 2
+		bus.double = true
+	}
+	p.sys = &machine{newCPU(bus), m}
+	return p
+}
+
+// A gbsCart maps the GBS data as ROM, with 8K of RAM. Any write to
+// 2000-3FFFh selects a ROM bank.
+type gbsCart struct {
+	cartridge
+}
+
+func newGBSCart(rom romImage) *gbsCart {
+	return &gbsCart{cartridge{rom: rom, ram: make([]byte, 0x2000),
+		romBanks: len(rom) / 0x4000, romBank: 1, ramEnable: true}}
+}
+
+func (c *gbsCart) WriteROM(addr uint16, x byte) {
+	if addr >= 0x2000 && addr < 0x4000 {
+		if x == 0 {
+			x++
+		}
+		c.romBank = int(x)
+	}
+}
+
+// A gbsBus is the memory map without the display, which is never
+// shown by the player. In the CGB's double speed mode (TAC bit 7 in
+// the header) the CPU and timers run twice as fast, but the sound
+// does not, so it is given half the ticks.
+type gbsBus struct {
+	*memory
+	double bool
+	carry  int // an odd tick left over in double speed mode
+}
+
+func (b *gbsBus) Tick(t int) {
+	b.updateTimers(t)
+	if b.double {
+		t += b.carry
+		b.carry = t & 1
+		t >>= 1
+	}
+	b.audio.step(t)
+}
+
+// connect attaches the audio output, and optionally a display for
+// showing the track information.
+func (p *gbsPlayer) connect(audio *mixer, lcd *display) {
+	if lcd == nil {
+		// Nothing is drawn, but the registers must go somewhere.
+		lcd = &display{memory: p.sys.memory}
+	} else {
+		p.lcd = lcd
+	}
+	p.sys.connect(lcd, audio)
+}
+
+// start resets the machine and calls the init routine for track.
+func (p *gbsPlayer) start(track int) os.Error {
+	if track < 0 {
+		track = p.songs - 1
+	} else if track >= p.songs {
+		track = 0
+	}
+	p.track = track
+
+	sys := p.sys
+	m := sys.memory
+	m.cart = newGBSCart(p.rom)
+	m.vram = [0x2000]byte{}
+	m.wram = [0x2000]byte{}
+	m.oam = [0xA0]byte{}
+	m.hram = [0x100]byte{}
+	m.initPorts()
+	m.writePort(portTMA, p.tma)
+	m.writePort(portTAC, p.tac&0x07)
+
+	sys.a = byte(track)
+	sys.sp = p.sp
+	sys.stack = p.sp
+	sys.ime = false
+	sys.halt = false
+
+	if _, err := p.call(p.init); err != nil {
+		return err
+	}
+
+	// The init routine may have changed the timer. The VBlank rate
+	// is the same in double speed mode, so takes twice the CPU
+	// ticks; the timer's rate is counted in CPU ticks already.
+	p.period = refreshTicks * p.speed
+	if tac := m.hram[portTAC-0xFF00]; tac&0x04 != 0 {
+		p.period = (256 - int(m.hram[portTMA-0xFF00])) *
+			m.timaOverflow
+	}
+	p.clock = 0
+
+	if p.lcd != nil {
+		p.lcd.screen.setCaption(fmt.Sprintf("%s (%d/%d)",
+			p.title, p.track+1, p.songs))
+	}
+	return nil
+}
+
+// call runs the routine at addr until it returns, and reports how
+// many ticks it took.
+func (p *gbsPlayer) call(addr uint16) (t int, err os.Error) {
+	sys := p.sys
+	sys.push(gbsReturn)
+	sys.pc = addr
+	sys.halt = false
+	for sys.pc != gbsReturn {
+		if t > gbsCallLimit {
+			return t, fmt.Errorf("routine at %04Xh did not return",
+				addr)
+		}
+		t += sys.step()
+	}
+	return
+}
+
+// advance runs the player for t ticks, calling play as required.
+func (p *gbsPlayer) advance(t int) os.Error {
+	t *= p.speed
+	for t > 0 {
+		if p.clock >= p.period {
+			n, err := p.call(p.play)
+			if err != nil {
+				return err
+			}
+			p.clock += n - p.period
+			t -= n
+			continue
+		}
+		s := p.period - p.clock
+		if s > t {
+			s = t
+		}
+		if s > 4 {
+			s = 4
+		}
+		p.sys.bus.Tick(s)
+		p.clock += s
+		t -= s
+	}
+	return nil
+}
+
+func (p *gbsPlayer) draw() {
+	lcd := p.lcd
+	lcd.clear()
+	y := 8
+	for _, s := range []string{p.title, p.author, p.copyright} {
+		lcd.drawText(4, y, lcd.pal[3], "%s", s)
+		y += glyphH + 3
+	}
+	lcd.drawText(4, y+8, lcd.pal[2], "TRACK %d/%d", p.track+1, p.songs)
+	lcd.drawText(4, displayH-2*(glyphH+3), lcd.pal[2],
+		"LEFT/RIGHT: SKIP")
+	lcd.drawText(4, displayH-(glyphH+3), lcd.pal[2], "F5: SCOPE")
+	if lcd.audio.scope != nil {
+		lcd.drawScope()
+	}
+	lcd.screen.flip()
+}
+
+// run plays until told to quit, skipping tracks with the d-pad.
+func (p *gbsPlayer) run(in <-chan interface{}) (err os.Error) {
+	sys := p.sys
+	dpad := sys.dpadBits
+	for !sys.quit {
+		sys.latchInput()
+		if err = p.advance(refreshTicks); err != nil {
+			return
+		}
+		p.draw()
+		p.delay()
+
+		// act on newly pressed left/right
+		pressed := dpad &^ sys.dpadBits
+		dpad = sys.dpadBits
+		switch {
+		case pressed&0x02 != 0:
+			err = p.start(p.track - 1)
+		case pressed&0x01 != 0:
+			err = p.start(p.track + 1)
+		}
+		if err != nil {
+			return
+		}
+
+		sys.poll(in, func(c interface{}) {
+			if skip, ok := c.(SkipTrack); ok && err == nil {
+				err = p.start(p.track + skip.Tracks)
+			} else {
+				sys.command(c)
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// delay keeps time while the sound is switched off; otherwise the
+// audio output sets the pace.
+func (p *gbsPlayer) delay() {
+	if !p.sys.audio.enable {
+		now := time.Nanoseconds()
+		target := frameNanos - (now - p.frameTime)
+		if target > 0 {
+			time.Sleep(target)
+		}
+	}
+	p.frameTime = time.Nanoseconds()
+}
+
+// startGBS plays a GBS file, starting at the given track (numbered
+// from 1, or 0 for the file's default), with the devices provided by
+// fe.
+func startGBS(path string, track int, cfg *Config, in <-chan interface{}, fe frontend) (err interface{}) {
+	var f *gbsFile
+	if f, err = loadGBS(path); err != nil {
+		return
+	}
+	if cfg.Verbose {
+		f.printInfo()
+	}
+
+	if err = fe.init(cfg); err != nil {
+		return
+	}
+	defer fe.close()
+
+	p := newGBSPlayer(f, cfg)
+	if err = p.sys.initInput(); err != nil {
+		return
+	}
+
+	var audio *mixer
+	if audio, err = fe.openAudio(p.sys.memory); err != nil {
+		return
+	}
+	defer audio.close()
+
+	if cfg.VGMFile != "" {
+		p.sys.vgm = newVGMLog(p.sys.ticks)
+	}
+	scr := fe.openScreen(cfg, f.title, displayW*cfg.Scale,
+		displayH*cfg.Scale)
+	p.connect(audio, newDisplay(p.sys.memory, scr, nil))
+
+	go fe.monitor(p.sys.memory)
+
+	if track == 0 {
+		track = f.first
+	}
+	if e := p.start(track - 1); e != nil {
+		err = e
+		return
+	}
+	if e := p.run(in); e != nil {
+		err = e
+	} else if p.sys.vgm != nil {
+		err = p.sys.vgm.save(cfg.VGMFile, p.sys.ticks)
+	}
+	return
+}
+
+// RenderGBS plays the given track of a GBS file (numbered from 1,
+// or 0 for the file's default) for the given number of seconds,
+// writing the output to a WAV file. No audio or video devices are
+// used.
+func RenderGBS(path string, track int, seconds int, cfg Config, wav string) os.Error {
+	f, err := loadGBS(path)
+	if err != nil {
+		return err
+	}
+	if cfg.Verbose {
+		f.printInfo()
+	}
+
+	var out *wavOutput
+	if out, err = createWAV(wav, cfg.AudioFreq); err != nil {
+		return err
+	}
+
+	p := newGBSPlayer(f, &cfg)
+	audio := newMixerOutput(p.sys.memory, out)
+	if cfg.VGMFile != "" {
+		p.sys.vgm = newVGMLog(p.sys.ticks)
+	}
+	p.connect(audio, nil)
+
+	if track == 0 {
+		track = f.first
+	}
+	if err = p.start(track - 1); err == nil {
+		err = p.advance(seconds * ticksFreq)
+	}
+	audio.close()
+
+	if err == nil {
+		err = out.err
+	}
+	if err == nil && p.sys.vgm != nil {
+		err = p.sys.vgm.save(cfg.VGMFile, p.sys.ticks)
+	}
+	return err
+}
+
+func (f *gbsFile) printInfo() {
+	fmt.Printf("Loaded GBS file '%s'\n", f.title)
+	fmt.Printf("Author: %s\n", f.author)
+	fmt.Printf("Copyright: %s\n", f.copyright)
+	fmt.Printf("Songs: %d (first %d)\n", f.songs, f.first)
+	fmt.Printf("Load/init/play: %04X/%04X/%04X\n", f.load, f.init, f.play)
+	fmt.Printf("Timer: TMA=%02X TAC=%02X\n", f.tma, f.tac)
+	if f.tac&0x80 != 0 {
+		fmt.Println("Double speed mode")
+	}
+}
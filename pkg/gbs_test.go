@@ -0,0 +1,79 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "testing"
+
+// testGBS makes a GBS file whose init and play routines just return,
+// with the given timer settings.
+func testGBS(tma, tac byte) []byte {
+	data := make([]byte, gbsHeaderSize+1)
+	copy(data, "GBS")
+	data[3] = 1
+	data[4], data[5] = 1, 1
+	for i := 6; i < 12; i += 2 {
+		data[i], data[i+1] = 0x00, 0x04 // load, init and play at 0400h
+	}
+	data[12], data[13] = 0xFE, 0xFF
+	data[14], data[15] = tma, tac
+	data[gbsHeaderSize] = 0xC9 // RET
+	return data
+}
+
+func TestGBSDoubleSpeed(t *testing.T) {
+	for _, x := range []struct {
+		tac    byte
+		period int
+		speed  int
+	}{
+		{0x00, refreshTicks, 1},
+		{0x80, refreshTicks * 2, 2},
+		{0x04, 128 * 256, 1},
+		{0x84, 128 * 256, 2}, // in CPU ticks, which are faster
+	} {
+		f, err := parseGBS(testGBS(0x80, x.tac))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newGBSPlayer(f, &Config{})
+		p.connect(newMixerOutput(p.sys.memory, nullOutput{}), nil)
+		if err := p.start(0); err != nil {
+			t.Fatal(err)
+		}
+		if p.period != x.period || p.speed != x.speed {
+			t.Errorf("TAC %02X: period %d, speed %d; want %d, %d",
+				x.tac, p.period, p.speed, x.period, x.speed)
+		}
+	}
+}
+
+func TestGBSHeader(t *testing.T) {
+	for _, x := range []struct {
+		songs, first byte
+		want         int
+		ok           bool
+	}{
+		{3, 2, 2, true},
+		{3, 0, 1, true},
+		{3, 4, 1, true},
+		{0, 1, 0, false},
+	} {
+		data := testGBS(0, 0)
+		data[4], data[5] = x.songs, x.first
+		f, err := parseGBS(data)
+		if !x.ok {
+			if err == nil {
+				t.Errorf("%d songs: no error", x.songs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d songs, first %d: %s", x.songs, x.first, err)
+		} else if f.first != x.want {
+			t.Errorf("%d songs, first %d: first is %d, want %d",
+				x.songs, x.first, f.first, x.want)
+		}
+	}
+}
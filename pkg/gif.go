@@ -0,0 +1,157 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"image"
+	"io"
+	"os"
+)
+
+// A gifClip collects frames for an animated GIF, either from when
+// it is started until it is stopped, or continuously keeping only
+// the most recent frames.
+type gifClip struct {
+	frames [][]byte
+	next   int // oldest frame, once the ring is full
+	max    int // frames kept, or 0 for no limit
+}
+
+func newGIFClip(seconds int) *gifClip {
+	max := 0
+	if seconds > 0 {
+		max = seconds * ticksFreq / refreshTicks
+	}
+	return &gifClip{max: max}
+}
+
+func (c *gifClip) add(pix []byte) {
+	var f []byte
+	if c.max > 0 && len(c.frames) == c.max {
+		f = c.frames[c.next] // reuse the oldest
+		c.next = (c.next + 1) % c.max
+	} else {
+		f = make([]byte, len(pix))
+		c.frames = append(c.frames, f)
+	}
+	copy(f, pix)
+}
+
+// ordered returns the frames, oldest first.
+func (c *gifClip) ordered() [][]byte {
+	frames := make([][]byte, 0, len(c.frames))
+	frames = append(frames, c.frames[c.next:]...)
+	return append(frames, c.frames[:c.next]...)
+}
+
+// writeGIF encodes frames as a looping animated GIF in the given
+// colours (16, indexed like the frames), using every (skip+1)th
+// frame. Each frame's delay is rounded so that the
+// total stays in time with the DMG's 59.73 Hz, and repeated frames
+// are merged.
+func writeGIF(w io.Writer, frames [][]byte, skip int, colors image.PalettedColorModel) os.Error {
+	type gifFrame struct {
+		pix   []byte
+		delay int // 1/100 second
+	}
+	var out []gifFrame
+	cs := func(n int) int {
+		// centiseconds after n frames, rounded
+		return (n*refreshTicks*100 + ticksFreq/2) / ticksFreq
+	}
+	for i := 0; i < len(frames); i += skip + 1 {
+		d := cs(i+skip+1) - cs(i)
+		if n := len(out); n > 0 && bytes.Equal(out[n-1].pix, frames[i]) {
+			out[n-1].delay += d
+		} else {
+			out = append(out, gifFrame{frames[i], d})
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("GIF89a")
+	b.Write([]byte{displayW, 0, displayH, 0,
+		0xB3, // 16-colour global table
+		0, 0})
+	for _, c := range colors {
+		r, g, bl, _ := c.RGBA()
+		b.Write([]byte{byte(r >> 8), byte(g >> 8), byte(bl >> 8)})
+	}
+	// loop forever
+	b.Write([]byte{0x21, 0xFF, 11})
+	b.WriteString("NETSCAPE2.0")
+	b.Write([]byte{3, 1, 0, 0, 0})
+
+	var data bytes.Buffer
+	pix := make([]byte, displayW*displayH)
+	for _, f := range out {
+		b.Write([]byte{0x21, 0xF9, 4, 0,
+			byte(f.delay), byte(f.delay >> 8), 0, 0})
+		b.Write([]byte{0x2C, 0, 0, 0, 0,
+			displayW, 0, displayH, 0, 0})
+
+		data.Reset()
+		for i, p := range f.pix {
+			pix[i] = p & 15
+		}
+		lz := lzw.NewWriter(&data, lzw.LSB, 4)
+		lz.Write(pix)
+		if err := lz.Close(); err != nil {
+			return err
+		}
+		b.WriteByte(4) // minimum code size
+		for p := data.Bytes(); len(p) > 0; {
+			n := len(p)
+			if n > 255 {
+				n = 255
+			}
+			b.WriteByte(byte(n))
+			b.Write(p[:n])
+			p = p[n:]
+		}
+		b.WriteByte(0)
+	}
+	b.WriteByte(0x3B)
+	return b.Flush()
+}
+
+// saveGIF writes frames to a new file in the screenshot directory,
+// in the background. The frames must not be changed afterwards.
+func (m *memory) saveGIF(frames [][]byte) {
+	if len(frames) == 0 {
+		return
+	}
+	name := m.screenshotName(".gif")
+	skip := m.config.GIFSkip
+	colors := m.lcd.colorModel()
+	go func() {
+		f, err := os.Create(name)
+		if err == nil {
+			err = writeGIF(f, frames, skip, colors)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}
+		if err != nil {
+			m.error("GIF failed: %v", err)
+		} else {
+			m.message("saved %s", name)
+		}
+	}()
+}
+
+// gifFrame is called at each VBlank to add the frame to any clips
+// being collected.
+func (lcd *display) gifFrame() {
+	if lcd.gif != nil {
+		lcd.gif.add(lcd.frame[:])
+	}
+	if lcd.gifReplay != nil {
+		lcd.gifReplay.add(lcd.frame[:])
+	}
+}
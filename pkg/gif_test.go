@@ -0,0 +1,77 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"image/gif"
+	"testing"
+)
+
+func TestGIFClip(t *testing.T) {
+	c := newGIFClip(1)
+	frame := make([]byte, displayW*displayH)
+	for n := 0; n < 65; n++ {
+		frame[n] = byte(n%3 + 1)
+		c.add(frame)
+	}
+	frames := c.ordered()
+	if len(frames) != 59 {
+		t.Fatalf("kept %d frames, want 59", len(frames))
+	}
+	if frames[0][6] != 1 || frames[0][7] != 0 {
+		t.Errorf("first frame is not the oldest kept")
+	}
+	if frames[58][64] != 2 {
+		t.Errorf("last frame is not the newest")
+	}
+}
+
+func TestGIF(t *testing.T) {
+	lcd := &display{memory: &memory{config: &Config{}}}
+	lcd.setPalette("cgb-red")
+	testColors := lcd.colorModel()
+
+	a := make([]byte, displayW*displayH)
+	b := make([]byte, displayW*displayH)
+	for i := range b {
+		b[i] = byte(i % 16)
+	}
+	// The repeated frame should be merged with the first.
+	var buf bytes.Buffer
+	if err := writeGIF(&buf, [][]byte{a, a, b, a, b}, 0, testColors); err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Frames at 59.73 Hz end at 2, 3, 5, 7 and 8 centiseconds
+	// (rounded).
+	want := []int{3, 2, 2, 1}
+	if len(g.Delay) != len(want) {
+		t.Fatalf("%d images, want %d", len(g.Delay), len(want))
+	}
+	for i, d := range g.Delay {
+		if d != want[i] {
+			t.Errorf("delay %d is %d, want %d", i, d, want[i])
+		}
+	}
+	if !bytes.Equal(g.Image[1].Pix, b) || !bytes.Equal(g.Image[2].Pix, a) {
+		t.Errorf("images differ from the frames")
+	}
+	if c := g.Image[1].Palette[13]; c != testColors[13] {
+		t.Errorf("OBJ1 shade 1 is %v, want %v", c, testColors[13])
+	}
+
+	buf.Reset()
+	writeGIF(&buf, [][]byte{a, b, a, b, a}, 1, testColors)
+	if g, err = gif.DecodeAll(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Delay) != 1 || g.Delay[0] != 10 {
+		t.Errorf("skipping frames gave delays %v, want [10]", g.Delay)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// An IRPeer is whatever is at the other end of an infrared link.
+type IRPeer interface {
+	Light() bool // whether its LED is lit
+}
+
+// An irPort is the infrared LED and sensor in a Hudson cartridge.
+// What the sensor sees depends on the peer: with none it sees
+// nothing, looped back it sees its own LED, and connected to
+// another port it sees that one's.
+type irPort struct {
+	led  bool
+	peer IRPeer
+	lock *sync.Mutex // guards led while the port is on an IRLink
+}
+
+func (p *irPort) Light() bool {
+	if p.lock != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+	}
+	return p.led
+}
+
+func (p *irPort) setLED(on bool) {
+	if p.lock != nil {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+	}
+	p.led = on
+}
+
+// sense reports whether light is reaching the sensor.
+func (p *irPort) sense() bool {
+	return p.peer != nil && p.peer.Light()
+}
+
+func (p *irPort) loopBack() {
+	p.peer = p
+}
+
+// connectIR links two ports, as if the cartridges were facing each
+// other.
+func connectIR(a, b *irPort) {
+	a.peer, b.peer = b, a
+}
+
+// An IRLink joins the infrared ports of two machines running in the
+// same program, as if the cartridges were facing each other. Give the
+// same link to the Config of each: the first cartridge made takes one
+// end of it, and the second the other. Until the second is made, the
+// first sees nothing.
+//
+// The machines run in their own goroutines, so the link's lock guards
+// both the ends and the LEDs of the ports on them.
+type IRLink struct {
+	lock  sync.Mutex
+	ports [2]*irPort
+	n     int
+}
+
+// An irLinkEnd is what the port at one end of a link sees.
+type irLinkEnd struct {
+	link *IRLink
+	side int
+}
+
+func (e irLinkEnd) Light() bool {
+	e.link.lock.Lock()
+	defer e.link.lock.Unlock()
+	p := e.link.ports[1-e.side]
+	return p != nil && p.led
+}
+
+// attach connects p to the next free end of the link.
+func (l *IRLink) attach(p *irPort) os.Error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.n == len(l.ports) {
+		return os.NewError("infrared link already has two ends")
+	}
+	l.ports[l.n] = p
+	p.peer = irLinkEnd{l, l.n}
+	p.lock = &l.lock
+	l.n++
+	return nil
+}
+
+// An irDevice is a cartridge with an infrared port.
+type irDevice interface {
+	infrared() *irPort
+}
+
+// A huc1Cart maps up to 64 ROM banks and four RAM banks, and switches
+// A000-BFFFh between the RAM and the infrared port.
+type huc1Cart struct {
+	cartridge
+	ir     irPort
+	irMode bool
+}
+
+func newHuC1(rom romImage) Cartridge {
+	c := &huc1Cart{cartridge: newBaseCartridge(rom)}
+	c.ramEnable = true
+	return c
+}
+
+func (c *huc1Cart) infrared() *irPort {
+	return &c.ir
+}
+
+func (c *huc1Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.irMode = x&0x0F == 0x0E
+	case addr < 0x4000:
+		x &= 0x3F
+		if x == 0 {
+			x++
+		}
+		c.romBank = int(x)
+	case addr < 0x6000:
+		c.ramBank = int(x & 3)
+	}
+}
+
+func (c *huc1Cart) ReadRAM(addr uint16) byte {
+	if c.irMode {
+		return irRegister(&c.ir)
+	}
+	return c.cartridge.ReadRAM(addr)
+}
+
+func (c *huc1Cart) WriteRAM(addr uint16, x byte) {
+	if c.irMode {
+		c.ir.setLED(x&1 != 0)
+		return
+	}
+	c.cartridge.WriteRAM(addr, x)
+}
+
+func (c *huc1Cart) StateFields() []interface{} {
+	return append(c.cartridge.StateFields(), &c.irMode, &c.ir.led)
+}
+
+// irRegister reads the infrared port: C1h if light is seen, C0h if
+// not.
+func irRegister(p *irPort) byte {
+	if p.sense() {
+		return 0xC1
+	}
+	return 0xC0
+}
+
+// The HuC3 maps the RAM, the clock or the infrared port into
+// A000-BFFFh according to the mode written to 0000-1FFFh.
+const (
+	huc3ReadRAM  = 0x0
+	huc3RAM      = 0xA
+	huc3Command  = 0xB
+	huc3Response = 0xC
+	huc3Status   = 0xD
+	huc3IR       = 0xE
+)
+
+const (
+	// The clock is saved after the RAM: the minute of the day and
+	// the day as 16-bit numbers, then the time of saving in seconds
+	// since 1970, as a 64-bit number.
+	huc3SaveSize = 12
+
+	minuteTicks = 60 * ticksFreq
+)
+
+// A huc3Cart maps up to 128 ROM banks and four RAM banks, and has a
+// clock counting minutes and days, which is read and set through a
+// small command interface, and an infrared port.
+type huc3Cart struct {
+	cartridge
+	ir   irPort
+	mode int
+
+	// The clock's registers are nibbles, selected by index: 0-2
+	// hold the minute of the day and 3-5 the day.
+	minutes, days int
+	ticks         int // into the current minute
+	index         int
+	response      byte
+	flags         byte // from command 6
+}
+
+func newHuC3(rom romImage) Cartridge {
+	c := &huc3Cart{cartridge: newBaseCartridge(rom)}
+	c.ramEnable = true
+	return c
+}
+
+func (c *huc3Cart) infrared() *irPort {
+	return &c.ir
+}
+
+func (c *huc3Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.mode = int(x & 0x0F)
+	case addr < 0x4000:
+		x &= 0x7F
+		if x == 0 {
+			x++
+		}
+		c.romBank = int(x)
+	case addr < 0x6000:
+		c.ramBank = int(x & 3)
+	}
+}
+
+func (c *huc3Cart) ReadRAM(addr uint16) byte {
+	switch c.mode {
+	case huc3ReadRAM, huc3RAM:
+		return c.cartridge.ReadRAM(addr)
+	case huc3Response:
+		if c.flags == 2 {
+			return 1
+		}
+		return c.response
+	case huc3IR:
+		return irRegister(&c.ir)
+	}
+	return 1
+}
+
+func (c *huc3Cart) WriteRAM(addr uint16, x byte) {
+	switch c.mode {
+	case huc3RAM:
+		c.cartridge.WriteRAM(addr, x)
+	case huc3Command:
+		c.command(x>>4, int(x&0x0F))
+	case huc3IR:
+		c.ir.setLED(x&1 != 0)
+	}
+}
+
+// command runs a clock command: 1 reads the register at the index
+// and moves on to the next, 2 writes it, 3 writes it and moves on, 4
+// and 5 set the low and high nibbles of the index, and 6 sets flags.
+func (c *huc3Cart) command(cmd byte, arg int) {
+	switch cmd {
+	case 1:
+		c.response = byte(c.register(c.index))
+		c.index++
+	case 2, 3:
+		c.setRegister(c.index, arg)
+		if cmd == 3 {
+			c.index++
+		}
+	case 4:
+		c.index = c.index&0xF0 | arg
+	case 5:
+		c.index = c.index&0x0F | arg<<4
+	case 6:
+		c.flags = byte(arg)
+	}
+	c.index &= 0xFF
+}
+
+func (c *huc3Cart) register(i int) int {
+	switch {
+	case i < 3:
+		return c.minutes >> uint(i*4) & 0x0F
+	case i < 6:
+		return c.days >> uint((i-3)*4) & 0x0F
+	}
+	return 0
+}
+
+func (c *huc3Cart) setRegister(i, x int) {
+	switch {
+	case i < 3:
+		shift := uint(i * 4)
+		c.minutes = c.minutes&^(0x0F<<shift) | x<<shift
+	case i < 6:
+		shift := uint((i - 3) * 4)
+		c.days = c.days&^(0x0F<<shift) | x<<shift
+	}
+}
+
+func (c *huc3Cart) Tick(t int) {
+	if c.ticks += t; c.ticks >= minuteTicks {
+		c.advance(c.ticks / minuteTicks)
+		c.ticks %= minuteTicks
+	}
+}
+
+// advance moves the clock on by n minutes.
+func (c *huc3Cart) advance(n int) {
+	c.minutes += n
+	c.days = (c.days + c.minutes/1440) & 0xFFF
+	c.minutes %= 1440
+}
+
+func (c *huc3Cart) Battery() []byte {
+	if !c.battery {
+		return nil
+	}
+	clock := make([]byte, huc3SaveSize)
+	le := binary.LittleEndian
+	le.PutUint16(clock, uint16(c.minutes))
+	le.PutUint16(clock[2:], uint16(c.days))
+	le.PutUint64(clock[4:], uint64(time.Seconds()))
+	return append(append([]byte{}, c.ram...), clock...)
+}
+
+func (c *huc3Cart) SetBattery(data []byte) os.Error {
+	return c.setBattery(data, true)
+}
+
+func (c *huc3Cart) restoreBattery(data []byte) os.Error {
+	return c.setBattery(data, false)
+}
+
+// setBattery restores the RAM and the clock, moving the clock on by
+// the time since it was saved if catchUp is set. A save without the
+// clock is accepted.
+func (c *huc3Cart) setBattery(data []byte, catchUp bool) os.Error {
+	if len(data) == len(c.ram) {
+		return c.cartridge.SetBattery(data)
+	}
+	if len(data) != len(c.ram)+huc3SaveSize {
+		return fmt.Errorf("save should be %d bytes (%d found)",
+			len(c.ram)+huc3SaveSize, len(data))
+	}
+	clock := data[len(c.ram):]
+	le := binary.LittleEndian
+	c.minutes = int(le.Uint16(clock)) % 1440
+	c.days = int(le.Uint16(clock[2:])) & 0xFFF
+	then := int64(le.Uint64(clock[4:]))
+	if now := time.Seconds(); catchUp && now > then {
+		c.advance(int((now - then) / 60))
+	}
+	return c.cartridge.SetBattery(data[:len(c.ram)])
+}
+
+func (c *huc3Cart) StateFields() []interface{} {
+	return append(c.cartridge.StateFields(), &c.mode, &c.ir.led,
+		&c.minutes, &c.days, &c.ticks, &c.index, &c.response, &c.flags)
+}
@@ -0,0 +1,666 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Things which may be bound to an input. The first eight are the
+// Game Boy's buttons, in the order of their bits in the JOYP
+// register (d-pad first).
+const (
+	actRight = iota
+	actLeft
+	actUp
+	actDown
+	actA
+	actB
+	actSelect
+	actStart
+	actQuit
+	actFullscreen
+	actSaveState
+	actLoadState
+	actNextSlot
+	actPrevSlot
+	actPause
+	actFastForward
+	actTurbo
+	actSlowMotion
+	actFrameAdvance
+	actScreenshot
+	actRecordVideo
+	actRecordGIF
+	actSaveReplay
+	actNextPalette
+	actNextView
+	actToggleBG
+	actToggleWindow
+	actToggleSprites
+	actTintLayers
+	actToggleOSD
+	actToggleFPS
+	actToggleInput
+	actMute1
+	actMute2
+	actMute3
+	actMute4
+	actSolo1
+	actSolo2
+	actSolo3
+	actSolo4
+	actScope
+	actReadOnly
+	actTiltLeft
+	actTiltRight
+	actTiltUp
+	actTiltDown
+
+	// Not bindable: how far a joystick axis or the mouse tilts the
+	// Game Boy (see postTilt).
+	actTiltX
+	actTiltY
+)
+
+var actionNames = map[string]int{
+	"right":          actRight,
+	"left":           actLeft,
+	"up":             actUp,
+	"down":           actDown,
+	"a":              actA,
+	"b":              actB,
+	"select":         actSelect,
+	"start":          actStart,
+	"quit":           actQuit,
+	"fullscreen":     actFullscreen,
+	"save-state":     actSaveState,
+	"load-state":     actLoadState,
+	"next-slot":      actNextSlot,
+	"prev-slot":      actPrevSlot,
+	"pause":          actPause,
+	"fast-forward":   actFastForward,
+	"turbo":          actTurbo,
+	"slow-motion":    actSlowMotion,
+	"frame-advance":  actFrameAdvance,
+	"screenshot":     actScreenshot,
+	"record-video":   actRecordVideo,
+	"record-gif":     actRecordGIF,
+	"save-replay":    actSaveReplay,
+	"next-palette":   actNextPalette,
+	"next-view":      actNextView,
+	"toggle-bg":      actToggleBG,
+	"toggle-window":  actToggleWindow,
+	"toggle-sprites": actToggleSprites,
+	"tint-layers":    actTintLayers,
+	"toggle-osd":     actToggleOSD,
+	"toggle-fps":     actToggleFPS,
+	"toggle-input":   actToggleInput,
+	"mute1":          actMute1,
+	"mute2":          actMute2,
+	"mute3":          actMute3,
+	"mute4":          actMute4,
+	"solo1":          actSolo1,
+	"solo2":          actSolo2,
+	"solo3":          actSolo3,
+	"solo4":          actSolo4,
+	"scope":          actScope,
+	"read-only":      actReadOnly,
+	"tilt-left":      actTiltLeft,
+	"tilt-right":     actTiltRight,
+	"tilt-up":        actTiltUp,
+	"tilt-down":      actTiltDown,
+}
+
+// The keyboard controls used unless the configuration file says
+// otherwise.
+var defaultKeys = map[string]string{
+	"key:up":        "up",
+	"key:down":      "down",
+	"key:left":      "left",
+	"key:right":     "right",
+	"key:x":         "a",
+	"key:z":         "b",
+	"key:rshift":    "select",
+	"key:return":    "start",
+	"key:escape":    "quit",
+	"key:f11":       "fullscreen",
+	"key:f1":        "mute1",
+	"key:f2":        "mute2",
+	"key:f3":        "mute3",
+	"key:f4":        "mute4",
+	"key:ctrl+f1":   "solo1",
+	"key:ctrl+f2":   "solo2",
+	"key:ctrl+f3":   "solo3",
+	"key:ctrl+f4":   "solo4",
+	"key:f5":        "scope",
+	"key:f6":        "save-state",
+	"key:f7":        "next-slot",
+	"key:f8":        "load-state",
+	"key:f9":        "screenshot",
+	"key:f12":       "record-video",
+	"key:ctrl+f12":  "record-gif",
+	"key:ctrl+f9":   "save-replay",
+	"key:ctrl+p":    "next-palette",
+	"key:ctrl+v":    "next-view",
+	"key:1":         "toggle-bg",
+	"key:2":         "toggle-window",
+	"key:3":         "toggle-sprites",
+	"key:4":         "tint-layers",
+	"key:ctrl+o":    "toggle-osd",
+	"key:ctrl+f":    "toggle-fps",
+	"key:ctrl+i":    "toggle-input",
+	"key:p":         "pause",
+	"key:tab":       "fast-forward",
+	"key:ctrl+tab":  "turbo",
+	"key:backquote": "slow-motion",
+	"key:backslash": "frame-advance",
+	"key:f10":       "read-only",
+	"key:kp4":       "tilt-left",
+	"key:kp6":       "tilt-right",
+	"key:kp8":       "tilt-up",
+	"key:kp2":       "tilt-down",
+}
+
+// Keys, as the emulator numbers them. Each frontend translates its
+// own key codes to these, so that bindings work the same in all of
+// them. Letters, digits, keypad digits and function keys are
+// numbered consecutively.
+const (
+	keyNone = iota
+	keyBackspace
+	keyTab
+	keyReturn
+	keyEscape
+	keySpace
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyLShift
+	keyRShift
+	keyLCtrl
+	keyRCtrl
+	keyLAlt
+	keyRAlt
+	keyInsert
+	keyDelete
+	keyHome
+	keyEnd
+	keyPageUp
+	keyPageDown
+	keyPause
+	keyBackquote
+	keyMinus
+	keyEquals
+	keyLeftBracket
+	keyRightBracket
+	keyBackslash
+	keySemicolon
+	keyQuote
+	keyComma
+	keyPeriod
+	keySlash
+	keyKPPlus
+	keyKPMinus
+	keyKPEnter
+	keyA
+	key0   = keyA + 26
+	keyKP0 = key0 + 10
+	keyF1  = keyKP0 + 10
+)
+
+// Names of keys for use in bindings, in lower case.
+var keyNames = map[string]int{
+	"backspace":    keyBackspace,
+	"tab":          keyTab,
+	"return":       keyReturn,
+	"enter":        keyReturn,
+	"escape":       keyEscape,
+	"space":        keySpace,
+	"up":           keyUp,
+	"down":         keyDown,
+	"left":         keyLeft,
+	"right":        keyRight,
+	"lshift":       keyLShift,
+	"rshift":       keyRShift,
+	"lctrl":        keyLCtrl,
+	"rctrl":        keyRCtrl,
+	"lalt":         keyLAlt,
+	"ralt":         keyRAlt,
+	"insert":       keyInsert,
+	"delete":       keyDelete,
+	"home":         keyHome,
+	"end":          keyEnd,
+	"pageup":       keyPageUp,
+	"pagedown":     keyPageDown,
+	"pause":        keyPause,
+	"backquote":    keyBackquote,
+	"minus":        keyMinus,
+	"equals":       keyEquals,
+	"leftbracket":  keyLeftBracket,
+	"rightbracket": keyRightBracket,
+	"backslash":    keyBackslash,
+	"semicolon":    keySemicolon,
+	"quote":        keyQuote,
+	"comma":        keyComma,
+	"period":       keyPeriod,
+	"slash":        keySlash,
+	"kp+":          keyKPPlus,
+	"kp-":          keyKPMinus,
+	"kpenter":      keyKPEnter,
+}
+
+func init() {
+	for i := 0; i < 26; i++ {
+		keyNames[fmt.Sprintf("%c", 'a'+i)] = keyA + i
+	}
+	for i := 0; i < 10; i++ {
+		keyNames[fmt.Sprintf("%c", '0'+i)] = key0 + i
+		keyNames[fmt.Sprintf("kp%d", i)] = keyKP0 + i
+	}
+	for i := 0; i < 12; i++ {
+		keyNames[fmt.Sprintf("f%d", i+1)] = keyF1 + i
+	}
+}
+
+// Joystick hat directions, as reported by SDL.
+const (
+	hatUp    = 0x01
+	hatRight = 0x02
+	hatDown  = 0x04
+	hatLeft  = 0x08
+)
+
+var hatNames = map[string]int{"up": 0, "right": 1, "down": 2, "left": 3}
+
+// Axis positions beyond this count as pressed.
+const axisThreshold = 3200
+
+// An inputMap holds the compiled bindings from keys and joystick
+// controls to actions, along with the state needed to turn axis and
+// hat motion into presses and releases.
+type inputMap struct {
+	keys     map[int]int
+	ctrlKeys map[int]int
+	buttons  map[int]int
+	axes     map[int]int // keyed by axis*2, +1 for positive
+	hats     map[int]int // keyed by hat*4 + direction (see hatNames)
+
+	axisState map[int]int  // -1, 0 or 1
+	hatState  map[int]byte // the last reported value
+}
+
+// An input describes one thing which can be bound.
+type input struct {
+	kind  int // 'k'ey, 'b'utton, 'a'xis or 'h'at
+	key   int
+	ctrl  bool
+	index int // button, axis or hat number
+	dir   int // 0/1 for an axis; direction for a hat
+}
+
+// parseInput parses bindable input names, which look like
+//   key:z  key:ctrl+f1  joy:button3  joy:axis1-  joy:hat0:up
+func parseInput(name string) (in input, err interface{}) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "key:"):
+		in.kind = 'k'
+		name = name[4:]
+		if strings.HasPrefix(name, "ctrl+") {
+			in.ctrl = true
+			name = name[5:]
+		}
+		var ok bool
+		if in.key, ok = keyNames[name]; !ok {
+			err = fmt.Sprintf("unknown key '%s'", name)
+		}
+		return
+	case strings.HasPrefix(name, "joy:button"):
+		in.kind = 'b'
+		in.index, err = strconv.Atoi(name[10:])
+		return
+	case strings.HasPrefix(name, "joy:axis") && len(name) > 9:
+		in.kind = 'a'
+		switch name[len(name)-1] {
+		case '+':
+			in.dir = 1
+		case '-':
+			in.dir = 0
+		default:
+			err = "axis binding must end in + or -"
+			return
+		}
+		in.index, err = strconv.Atoi(name[8 : len(name)-1])
+		return
+	case strings.HasPrefix(name, "joy:hat"):
+		in.kind = 'h'
+		name = name[7:]
+		i := strings.Index(name, ":")
+		if i < 0 {
+			err = "hat binding must look like joy:hat0:up"
+			return
+		}
+		var ok bool
+		if in.dir, ok = hatNames[name[i+1:]]; !ok {
+			err = fmt.Sprintf("unknown hat direction '%s'", name[i+1:])
+			return
+		}
+		in.index, err = strconv.Atoi(name[:i])
+		return
+	}
+	err = fmt.Sprintf("unknown input '%s'", name)
+	return
+}
+
+func parseAction(name string) (act int, err interface{}) {
+	act, ok := actionNames[strings.ToLower(name)]
+	if !ok {
+		err = fmt.Sprintf("unknown action '%s'", name)
+	}
+	return
+}
+
+// newInputMap combines the default controls, the joystick flags and
+// the bindings from the configuration file, in that order of
+// precedence (lowest first). Binding an input to "none" removes it.
+func newInputMap(cfg *Config) (im *inputMap, err interface{}) {
+	im = &inputMap{
+		keys:      make(map[int]int),
+		ctrlKeys:  make(map[int]int),
+		buttons:   make(map[int]int),
+		axes:      make(map[int]int),
+		hats:      make(map[int]int),
+		axisState: make(map[int]int),
+		hatState:  make(map[int]byte),
+	}
+
+	bindings := make(map[string]string)
+	for k, v := range defaultKeys {
+		bindings[k] = v
+	}
+	joy := map[int]string{
+		cfg.JoyButtonA:      "a",
+		cfg.JoyButtonB:      "b",
+		cfg.JoyButtonSelect: "select",
+		cfg.JoyButtonStart:  "start",
+	}
+	for button, act := range joy {
+		bindings[fmt.Sprintf("joy:button%d", button)] = act
+	}
+	bindings[fmt.Sprintf("joy:axis%d-", cfg.JoyAxisX)] = "left"
+	bindings[fmt.Sprintf("joy:axis%d+", cfg.JoyAxisX)] = "right"
+	bindings[fmt.Sprintf("joy:axis%d-", cfg.JoyAxisY)] = "up"
+	bindings[fmt.Sprintf("joy:axis%d+", cfg.JoyAxisY)] = "down"
+	for dir := range hatNames {
+		bindings["joy:hat0:"+dir] = dir
+	}
+	for k, v := range cfg.Bindings {
+		bindings[k] = v
+	}
+
+	for name, act := range bindings {
+		if act == "none" {
+			continue
+		}
+		if err = im.bind(name, act); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (im *inputMap) bind(name, action string) interface{} {
+	in, err := parseInput(name)
+	if err != nil {
+		return err
+	}
+	act, err := parseAction(action)
+	if err != nil {
+		return err
+	}
+	switch in.kind {
+	case 'k':
+		if in.ctrl {
+			im.ctrlKeys[in.key] = act
+		} else {
+			im.keys[in.key] = act
+		}
+	case 'b':
+		im.buttons[in.index] = act
+	case 'a':
+		im.axes[in.index*2+in.dir] = act
+	case 'h':
+		im.hats[in.index*4+in.dir] = act
+	}
+	return nil
+}
+
+// An inputEvent is a bound input being pressed or released, or for
+// actTiltX and actTiltY, an analog value from -1 to 1.
+type inputEvent struct {
+	act   int
+	down  bool
+	value float64
+}
+
+// initInput prepares the bindings from the configuration, and the
+// queue on which input events are sent to the main loop.
+func (m *memory) initInput() (err interface{}) {
+	m.input, err = newInputMap(m.config)
+	m.events = make(chan inputEvent, 64)
+	return
+}
+
+// updateKey posts the action bound to a key (one of the key
+// constants), preferring a binding with ctrl held if there is one. It
+// reports whether the key is bound.
+func (m *memory) updateKey(key int, ctrl, down bool) bool {
+	im := m.input
+	act, ok := -1, false
+	if ctrl {
+		act, ok = im.ctrlKeys[key]
+	}
+	if !ok {
+		act, ok = im.keys[key]
+	}
+	if ok {
+		m.post(act, down)
+	}
+	return ok
+}
+
+func (m *memory) post(act int, down bool) {
+	m.events <- inputEvent{act: act, down: down}
+}
+
+// postTilt posts how far the Game Boy is tilted along an axis (0 for
+// left and right, 1 for up and down), from an analog input.
+func (m *memory) postTilt(axis int, value float64) {
+	m.events <- inputEvent{act: actTiltX + axis, value: value}
+}
+
+// action carries out whatever act is bound to. Buttons are pressed
+// and released directly (taking effect from the next frame); for
+// anything which affects the emulator as a whole, the command to
+// carry out is returned.
+func (m *memory) action(act int, down bool) (c interface{}) {
+	switch {
+	case act <= actStart:
+		m.press(byte(1)<<uint(act), down)
+		return
+	case act >= actTiltLeft && act <= actTiltDown:
+		mask := byte(1) << uint(act-actTiltLeft)
+		if down {
+			m.tiltKeys |= mask
+		} else {
+			m.tiltKeys &^= mask
+		}
+		return
+	case act == actFastForward:
+		return FastForward{down}
+	case !down:
+		return
+	}
+
+	switch act {
+	case actQuit:
+		c = Quit{}
+	case actFullscreen:
+		c = ToggleFullscreen{}
+	case actSaveState:
+		c = SaveState{m.slot}
+	case actLoadState:
+		c = LoadState{m.slot}
+	case actNextSlot:
+		c = SelectSlot{(m.slot + 1) % stateSlots}
+	case actPrevSlot:
+		c = SelectSlot{(m.slot + stateSlots - 1) % stateSlots}
+	case actPause:
+		c = Pause{!m.paused}
+	case actTurbo:
+		c = FastForward{!m.turbo}
+	case actSlowMotion:
+		c = SlowMotion{!m.slow}
+	case actFrameAdvance:
+		c = FrameAdvance{}
+	case actScreenshot:
+		c = Screenshot{}
+	case actRecordVideo:
+		c = RecordVideo{m.video == nil}
+	case actRecordGIF:
+		c = RecordGIF{m.gif == nil}
+	case actSaveReplay:
+		c = SaveReplay{}
+	case actNextPalette:
+		c = SetPalette{m.lcd.nextPalette()}
+	case actNextView:
+		c = ShowView{(m.lcd.view + 1) % numViews}
+	case actToggleBG, actToggleWindow, actToggleSprites:
+		n := act - actToggleBG
+		c = ShowLayer{n, m.lcd.hidden[n]}
+	case actTintLayers:
+		c = TintLayers{!m.lcd.tint}
+	case actToggleOSD:
+		c = ShowOSD{!m.lcd.osd.show}
+	case actToggleFPS:
+		c = ShowFPS{!m.lcd.osd.showFPS}
+	case actToggleInput:
+		c = ShowInput{!m.lcd.osd.showInput}
+	case actMute1, actMute2, actMute3, actMute4:
+		n := act - actMute1 + 1
+		c = MuteChannel{n, !m.audio.mute[n-1]}
+	case actSolo1, actSolo2, actSolo3, actSolo4:
+		n := act - actSolo1 + 1
+		if m.audio.solo == n {
+			n = 0
+		}
+		c = SoloChannel{n}
+	case actScope:
+		c = ShowScope{m.audio.scope == nil}
+	case actReadOnly:
+		c = ReadOnlyMovie{m.movie != nil && m.movie.mode != MovieReadOnly}
+	}
+	return
+}
+
+func (m *memory) press(mask byte, down bool) {
+	if down {
+		m.held &^= mask
+	} else {
+		m.held |= mask
+	}
+}
+
+// latchInput sets the buttons seen by the game for the next frame.
+// Buttons only change between frames so that a movie can reproduce
+// them exactly.
+func (m *memory) latchInput() {
+	bits := m.held
+	if mv := m.movie; mv != nil {
+		done := mv.finished
+		bits = mv.input(m.frame, bits)
+		if mv.finished && !done {
+			m.message("movie finished at frame %d", m.frame)
+		}
+	}
+	old := m.joypLines()
+	m.dpadBits = bits & 0xF
+	m.btnBits = bits >> 4
+	m.joypadInterrupt(old)
+	m.latchTilt()
+	m.frame++
+}
+
+// latchTilt passes how the Game Boy is tilted to the cartridge, if it
+// has an accelerometer: the tilt keys count as a full tilt, added to
+// any from analog inputs. Like the buttons, tilt is recorded in a
+// movie, and comes from the movie when playing it.
+func (m *memory) latchTilt() {
+	s, ok := m.cart.(tiltSensor)
+	if !ok {
+		return
+	}
+	k := m.tiltKeys
+	x := clampTilt(m.tiltAxes[0] + float64(k>>1&1) - float64(k&1))
+	y := clampTilt(m.tiltAxes[1] + float64(k>>3&1) - float64(k>>2&1))
+	if m.movie != nil {
+		x, y = m.movie.tiltAt(m.frame, x, y)
+	}
+	s.tilt(x, y)
+}
+
+func clampTilt(x float64) float64 {
+	switch {
+	case x < -1:
+		return -1
+	case x > 1:
+		return 1
+	}
+	return x
+}
+
+// joypLines returns the low nibble of JOYP: the lines of whichever
+// button groups are selected, pulled low by held buttons.
+func (m *memory) joypLines() byte {
+	sel := m.hram[portJOYP-0xFF00]
+	x := byte(0x0F)
+	if sel&0x10 == 0 {
+		x &= m.dpadBits
+	}
+	if sel&0x20 == 0 {
+		x &= m.btnBits
+	}
+	return x
+}
+
+// joypadInterrupt requests the joypad interrupt if any of the JOYP
+// lines have gone from high to low since they were old.
+func (m *memory) joypadInterrupt(old byte) {
+	if old&^m.joypLines() != 0 {
+		m.hram[portIF-0xFF00] |= 0x10
+	}
+}
+
+// The slow motion speed used if Config.SlowSpeed is not set.
+const defaultSlowSpeed = 50
+
+// currentSpeed returns the emulation speed as a percentage of normal,
+// or 0 if unthrottled.
+func (m *memory) currentSpeed() int {
+	switch {
+	case m.turbo:
+		return m.config.TurboSpeed
+	case m.slow:
+		if m.config.SlowSpeed <= 0 {
+			return defaultSlowSpeed
+		}
+		return m.config.SlowSpeed
+	}
+	return m.speed
+}
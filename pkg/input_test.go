@@ -0,0 +1,96 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "testing"
+
+func TestJoypad(t *testing.T) {
+	m := &memory{dpadBits: 0xF, btnBits: 0xF, held: 0xFF}
+	irq := func() bool {
+		x := m.hram[portIF-0xFF00]&0x10 != 0
+		m.hram[portIF-0xFF00] = 0
+		return x
+	}
+	tests := []struct {
+		sel  byte // written to JOYP
+		held byte // latched for the frame
+		joyp byte // read back
+		irq  bool
+	}{
+		{0x20, 0xFF, 0xEF, false}, // d-pad selected
+		{0x20, 0xFE, 0xEE, true},  // right pressed
+		{0x20, 0xFE, 0xEE, false}, // still held
+		{0x10, 0xFE, 0xDF, false}, // buttons: right not seen
+		{0x10, 0xEE, 0xDE, true},  // A pressed
+		{0x10, 0xFF, 0xDF, false}, // released
+		{0x20, 0x7F, 0xEF, false}, // start pressed, not selected
+		{0x10, 0x7F, 0xD7, true},  // start now selected
+		{0x30, 0x7F, 0xFF, false},
+		{0x00, 0x7E, 0xC6, true},
+	}
+	for i, test := range tests {
+		m.writePort(portJOYP, test.sel)
+		m.held = test.held
+		m.latchInput()
+		if x := m.readPort(portJOYP); x != test.joyp {
+			t.Errorf("%d: JOYP = %02X, want %02X", i, x, test.joyp)
+		}
+		if x := irq(); x != test.irq {
+			t.Errorf("%d: interrupt %t, want %t", i, x, test.irq)
+		}
+	}
+}
+
+func TestInputText(t *testing.T) {
+	// left and A held (the bits are low when pressed)
+	if s := inputText(0xF&^0x02, 0xF&^0x01); s != "<    A        " {
+		t.Errorf("got %q", s)
+	}
+	if s := inputText(0, 0); s != "<^V> A B SE ST" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestReadTermKey(t *testing.T) {
+	tests := []struct {
+		in  string
+		key termKey
+		n   int
+	}{
+		{"z", termKey{keyA + 'z' - 'a', false}, 1},
+		{"Zx", termKey{keyA + 'z' - 'a', false}, 1},
+		{"\r", termKey{keyReturn, false}, 1},
+		{"\x12", termKey{keyA + 'r' - 'a', true}, 1},
+		{"\x1b", termKey{0, false}, 0}, // may be the start of a sequence
+		{"\x1b\x1b", termKey{keyEscape, false}, 1},
+		{"\x1bx", termKey{0, false}, 2}, // Alt+X
+		{"\x1b[", termKey{0, false}, 0},
+		{"\x1b[24;5", termKey{0, false}, 0},
+		{"\x1b[A", termKey{keyUp, false}, 3},
+		{"\x1bOD\x1bOC", termKey{keyLeft, false}, 3},
+		{"\x1b[15~", termKey{keyF1 + 4, false}, 5},
+		{"\x1b[24;5~", termKey{keyF1 + 11, true}, 7},
+		{"\x1b[1;5P", termKey{keyF1, true}, 6},
+		{"\x1b[99~", termKey{0, false}, 5},
+		// Ctrl+I is Tab, so the terminal has toggle-input on Ctrl+N.
+		{"\t", termKey{keyTab, false}, 1},
+		{"\x0e", termKey{keyA + 'n' - 'a', true}, 1},
+	}
+	for _, test := range tests {
+		k, n := readTermKey([]byte(test.in))
+		if k != test.key || n != test.n {
+			t.Errorf("%q: got %v, %d; want %v, %d", test.in, k, n,
+				test.key, test.n)
+		}
+	}
+
+	im, err := newInputMap(&Config{Bindings: termDefaultKeys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := readTermKey([]byte("\x0e")); im.ctrlKeys[k.key] != actToggleInput {
+		t.Error("toggle-input cannot be reached from the terminal")
+	}
+}
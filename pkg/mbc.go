@@ -0,0 +1,274 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"os"
+)
+
+// mappers makes the cartridge for each kind of memory bank
+// controller, as found by romImage.mbcType. A new kind of controller
+// needs only a type implementing Cartridge and an entry here.
+var mappers = map[int]func(rom romImage) Cartridge{
+	mbcNone:   newROMOnly,
+	mbc1:      newMBC1,
+	mbc1m:     newMBC1M,
+	mbc2:      newMBC2,
+	mbc3:      newMBC3,
+	mbc5:      newMBC5,
+	mbc7:      newMBC7,
+	mbcCamera: newCamera,
+	mbcHuC1:   newHuC1,
+	mbcHuC3:   newHuC3,
+}
+
+// A romOnlyCart has no controller: 32K of ROM, and perhaps 8K
+// of RAM which is always there.
+type romOnlyCart struct {
+	cartridge
+}
+
+func newROMOnly(rom romImage) Cartridge {
+	c := &romOnlyCart{newBaseCartridge(rom)}
+	c.ramEnable = true
+	return c
+}
+
+// An mbc1Cart selects ROM banks with a 5-bit register (bank1), and either
+// the high bits of the ROM bank or the RAM bank with a 2-bit one
+// (bank2). In mode 1, bank2 also applies to 0000-3FFFh.
+type mbc1Cart struct {
+	cartridge
+	bank1, bank2 int
+	mode         bool
+	shift        uint // of bank2 in the ROM bank number
+}
+
+func newMBC1(rom romImage) Cartridge {
+	return &mbc1Cart{cartridge: newBaseCartridge(rom), bank1: 1,
+		shift: 5}
+}
+
+func (c *mbc1Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.ramEnable = x&0x0F == 0x0A
+	case addr < 0x4000:
+		c.bank1 = int(x & 0x1F)
+		if c.bank1 == 0 {
+			c.bank1 = 1
+		}
+	case addr < 0x6000:
+		c.bank2 = int(x & 3)
+	default:
+		c.mode = x&1 != 0
+	}
+	c.remap()
+}
+
+func (c *mbc1Cart) remap() {
+	high := c.bank2 << c.shift
+	c.romBank = high | c.bank1&(1<<c.shift-1)
+	c.romBank0, c.ramBank = 0, 0
+	if c.mode {
+		c.romBank0, c.ramBank = high, c.bank2
+	}
+}
+
+func (c *mbc1Cart) StateFields() []interface{} {
+	return append(c.cartridge.StateFields(), &c.bank1, &c.bank2, &c.mode)
+}
+
+// An mbc1mCart is an MBC1 wired for a multicart, with only the low 4
+// bits of bank1 connected. bank2 then picks one of four 256K games,
+// and in mode 1 maps the first bank of that game at 0000h.
+type mbc1mCart struct {
+	mbc1Cart
+}
+
+func newMBC1M(rom romImage) Cartridge {
+	return &mbc1mCart{mbc1Cart{cartridge: newBaseCartridge(rom),
+		bank1: 1, shift: 4}}
+}
+
+// An mbc2Cart has 512 half-bytes of RAM built in, and selects ROM banks
+// or enables the RAM according to bit 8 of the address written.
+type mbc2Cart struct {
+	cartridge
+}
+
+func newMBC2(rom romImage) Cartridge {
+	c := &mbc2Cart{newBaseCartridge(rom)}
+	c.ram = make([]byte, 512)
+	return c
+}
+
+func (c *mbc2Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr >= 0x4000:
+	case addr&0x0100 == 0:
+		c.ramEnable = x&0x0F == 0x0A
+	default:
+		x &= 0x0F
+		if x == 0 {
+			x++
+		}
+		c.romBank = int(x)
+	}
+}
+
+func (c *mbc2Cart) ReadRAM(addr uint16) byte {
+	if !c.ramEnable {
+		return 0xFF
+	}
+	return 0xF0 | c.ram[addr&0x1FF]
+}
+
+func (c *mbc2Cart) WriteRAM(addr uint16, x byte) {
+	if c.ramEnable {
+		c.ram[addr&0x1FF] = x & 0x0F
+	}
+}
+
+// An mbc3Cart has a 7-bit ROM bank register, up to four RAM banks, and in
+// some cartridges a clock, whose registers are selected in place of
+// the RAM by banks 08-0Ch.
+type mbc3Cart struct {
+	cartridge
+	sel   int // RAM bank or clock register
+	latch byte
+	clock *rtc // or nil
+}
+
+func newMBC3(rom romImage) Cartridge {
+	c := &mbc3Cart{cartridge: newBaseCartridge(rom)}
+	if rom.hasTimer() {
+		c.clock = new(rtc)
+	}
+	return c
+}
+
+func (c *mbc3Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.ramEnable = x&0x0F == 0x0A
+	case addr < 0x4000:
+		x &= 0x7F
+		if x == 0 {
+			x++
+		}
+		c.romBank = int(x)
+	case addr < 0x6000:
+		c.sel = int(x & 0x0F)
+		if c.sel < 4 {
+			c.ramBank = c.sel
+		}
+	default:
+		if c.latch == 0 && x == 1 && c.clock != nil {
+			c.clock.latch()
+		}
+		c.latch = x
+	}
+}
+
+// clockSelected reports whether a clock register is selected in
+// place of the RAM.
+func (c *mbc3Cart) clockSelected() bool {
+	return c.sel >= 8 && c.sel <= 0x0C
+}
+
+func (c *mbc3Cart) ReadRAM(addr uint16) byte {
+	switch {
+	case !c.clockSelected():
+		return c.cartridge.ReadRAM(addr)
+	case !c.ramEnable || c.clock == nil:
+		return 0xFF
+	}
+	return c.clock.read(c.sel - 8)
+}
+
+func (c *mbc3Cart) WriteRAM(addr uint16, x byte) {
+	switch {
+	case !c.clockSelected():
+		c.cartridge.WriteRAM(addr, x)
+	case c.ramEnable && c.clock != nil:
+		c.clock.write(c.sel-8, x)
+	}
+}
+
+func (c *mbc3Cart) Tick(t int) {
+	if c.clock != nil {
+		c.clock.tick(t)
+	}
+}
+
+// The clock is kept after the RAM in the battery file; see rtc.save.
+
+func (c *mbc3Cart) Battery() []byte {
+	if c.clock == nil || !c.battery {
+		return c.cartridge.Battery()
+	}
+	return append(append([]byte{}, c.ram...), c.clock.save()...)
+}
+
+func (c *mbc3Cart) SetBattery(data []byte) os.Error {
+	return c.setBattery(data, true)
+}
+
+func (c *mbc3Cart) restoreBattery(data []byte) os.Error {
+	return c.setBattery(data, false)
+}
+
+// setBattery restores the RAM and the clock, moving the clock on by
+// the time since it was saved if catchUp is set.
+func (c *mbc3Cart) setBattery(data []byte, catchUp bool) os.Error {
+	if c.clock != nil && len(data) > len(c.ram) {
+		then, err := c.clock.load(data[len(c.ram):])
+		if err != nil {
+			return err
+		}
+		if catchUp {
+			c.clock.catchUp(then)
+		}
+		data = data[:len(c.ram)]
+	}
+	return c.cartridge.SetBattery(data)
+}
+
+func (c *mbc3Cart) StateFields() []interface{} {
+	fields := append(c.cartridge.StateFields(), &c.sel, &c.latch)
+	if c.clock != nil {
+		fields = append(fields, c.clock.stateFields()...)
+	}
+	return fields
+}
+
+// An mbc5Cart has a 9-bit ROM bank register, written in two parts, and
+// up to sixteen RAM banks. Bank 0 can be mapped at 4000h. In rumble
+// cartridges, bit 3 of the RAM bank drives the motor instead.
+type mbc5Cart struct {
+	cartridge
+	rumble bool
+}
+
+func newMBC5(rom romImage) Cartridge {
+	return &mbc5Cart{newBaseCartridge(rom), rom.hasRumble()}
+}
+
+func (c *mbc5Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.ramEnable = x&0x0F == 0x0A
+	case addr < 0x3000:
+		c.romBank = c.romBank&0x100 | int(x)
+	case addr < 0x4000:
+		c.romBank = c.romBank&0xFF | int(x&1)<<8
+	case addr < 0x6000:
+		c.ramBank = int(x & 0x0F)
+		if c.rumble {
+			c.ramBank &= 0x07
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	// What the accelerometer reads when level, and how much that
+	// changes for a full tilt (1g) along an axis.
+	accelCentre = 0x81D0
+	accelRange  = 0x70
+
+	// Read from the accelerometer after it is erased, until the
+	// next reading is latched.
+	accelErased = 0x8000
+)
+
+// A tiltSensor is a cartridge which can tell how the Game Boy is
+// tilted; see latchTilt.
+type tiltSensor interface {
+	tilt(x, y float64)
+}
+
+// An mbc7Cart maps up to 128 ROM banks, and in place of RAM has an
+// accelerometer and an EEPROM (see eeprom), whose registers are in
+// A000-AFFFh (the address's bits 4-7 select one) once enabled by
+// writing 0Ah to 0000-1FFFh and 40h to 4000-5FFFh.
+//
+//   Ax0xh  write 55h to erase the reading
+//   Ax1xh  write AAh to latch a new reading, if it was erased
+//   Ax2xh  X reading, low byte (then high at Ax3xh)
+//   Ax4xh  Y reading, low byte (then high at Ax5xh)
+//   Ax8xh  the EEPROM's lines
+type mbc7Cart struct {
+	cartridge
+	enable2 bool
+	erased  bool
+	x, y    int     // the latched reading
+	tiltX   float64 // from -1 (left) to 1 (right)
+	tiltY   float64 // from -1 (away) to 1 (towards the player)
+	eeprom  *eeprom
+}
+
+func newMBC7(rom romImage) Cartridge {
+	return &mbc7Cart{cartridge: newBaseCartridge(rom),
+		x: accelErased, y: accelErased, eeprom: newEEPROM()}
+}
+
+func (c *mbc7Cart) WriteROM(addr uint16, x byte) {
+	switch {
+	case addr < 0x2000:
+		c.ramEnable = x&0x0F == 0x0A
+	case addr < 0x4000:
+		c.romBank = int(x & 0x7F)
+	case addr < 0x6000:
+		c.enable2 = x == 0x40
+	}
+}
+
+func (c *mbc7Cart) enabled(addr uint16) bool {
+	return c.ramEnable && c.enable2 && addr < 0xB000
+}
+
+func (c *mbc7Cart) ReadRAM(addr uint16) byte {
+	if !c.enabled(addr) {
+		return 0xFF
+	}
+	switch addr >> 4 & 0x0F {
+	case 2:
+		return byte(c.x)
+	case 3:
+		return byte(c.x >> 8)
+	case 4:
+		return byte(c.y)
+	case 5:
+		return byte(c.y >> 8)
+	case 6:
+		return 0x00
+	case 8:
+		return c.eeprom.read()
+	}
+	return 0xFF
+}
+
+func (c *mbc7Cart) WriteRAM(addr uint16, x byte) {
+	if !c.enabled(addr) {
+		return
+	}
+	switch addr >> 4 & 0x0F {
+	case 0:
+		if x == 0x55 {
+			c.erased = true
+			c.x, c.y = accelErased, accelErased
+		}
+	case 1:
+		if x == 0xAA && c.erased {
+			c.erased = false
+			c.x = accelCentre - int(c.tiltX*accelRange)
+			c.y = accelCentre + int(c.tiltY*accelRange)
+		}
+	case 8:
+		c.eeprom.write(x)
+	}
+}
+
+func (c *mbc7Cart) tilt(x, y float64) {
+	c.tiltX, c.tiltY = x, y
+}
+
+func (c *mbc7Cart) Battery() []byte {
+	if !c.battery {
+		return nil
+	}
+	return c.eeprom.bytes()
+}
+
+func (c *mbc7Cart) SetBattery(data []byte) os.Error {
+	if len(data) != 2*len(c.eeprom.data) {
+		return fmt.Errorf("save should be %d bytes (%d found)",
+			2*len(c.eeprom.data), len(data))
+	}
+	c.eeprom.setBytes(data)
+	return nil
+}
+
+func (c *mbc7Cart) StateFields() []interface{} {
+	fields := append(c.cartridge.StateFields(), &c.enable2, &c.erased,
+		&c.x, &c.y)
+	return append(fields, c.eeprom.stateFields()...)
+}
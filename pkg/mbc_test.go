@@ -0,0 +1,439 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+)
+
+// testROM makes a ROM image of n banks, each filled with its number,
+// with the given cartridge type and RAM size in the header.
+func testROM(n int, cartType, ramSize byte) romImage {
+	rom := make(romImage, n*0x4000)
+	for i := range rom {
+		rom[i] = byte(i / 0x4000)
+	}
+	rom[0x0147] = cartType
+	rom[0x0149] = ramSize
+	return rom
+}
+
+func newTestCartridge(t *testing.T, rom romImage) Cartridge {
+	c, err := newCartridge(rom, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMBC1(t *testing.T) {
+	c := newTestCartridge(t, testROM(128, 0x03, 3))
+	for _, x := range []struct {
+		addr      uint16
+		value     byte
+		low, high byte // banks at 0000h and 4000h
+	}{
+		{0x2000, 0x00, 0, 1}, // bank 0 selects 1
+		{0x2000, 0x05, 0, 5},
+		{0x4000, 0x02, 0, 0x45},
+		{0x2000, 0x20, 0, 0x41}, // and so does 20h, with bank2
+		{0x6000, 0x01, 0x40, 0x41},
+		{0x6000, 0x00, 0, 0x41},
+	} {
+		c.WriteROM(x.addr, x.value)
+		if low, high := c.ReadROM(0x0200), c.ReadROM(0x4000); low != x.low ||
+			high != x.high {
+			t.Errorf("after %02X to %04X: banks %02X, %02X; want %02X, %02X",
+				x.value, x.addr, low, high, x.low, x.high)
+		}
+	}
+
+	// RAM is only there when enabled, and banked in mode 1.
+	if x := c.ReadRAM(0xA000); x != 0xFF {
+		t.Errorf("disabled RAM read %02X", x)
+	}
+	c.WriteROM(0x0000, 0x0A)
+	c.WriteRAM(0xA000, 1)
+	c.WriteROM(0x6000, 0x01)
+	c.WriteRAM(0xA000, 2)
+	if x := c.ReadRAM(0xA000); x != 2 {
+		t.Errorf("bank 2 read %02X", x)
+	}
+	c.WriteROM(0x6000, 0x00)
+	if x := c.ReadRAM(0xA000); x != 1 {
+		t.Errorf("bank 0 read %02X", x)
+	}
+}
+
+func TestMBC5(t *testing.T) {
+	c := newTestCartridge(t, testROM(512, 0x1B, 4))
+	c.WriteROM(0x2000, 0x00)
+	if x := c.ReadROM(0x4000); x != 0 {
+		t.Errorf("bank 0 read %02X", x)
+	}
+	c.WriteROM(0x2000, 0x34)
+	c.WriteROM(0x3000, 0x01)
+	if rom, _ := c.Banks(); rom != 0x134 {
+		t.Errorf("ROM bank %X, want 134", rom)
+	}
+
+	c.WriteROM(0x0000, 0x0A)
+	c.WriteROM(0x4000, 0x0F)
+	c.WriteRAM(0xBFFF, 0x77)
+	if data := c.Battery(); len(data) != 131072 || data[131071] != 0x77 {
+		t.Errorf("battery of %d bytes", len(data))
+	}
+}
+
+func TestMBC3Clock(t *testing.T) {
+	c := newTestCartridge(t, testROM(4, 0x10, 2))
+	c.WriteROM(0x0000, 0x0A)
+	read := func(reg byte) byte {
+		c.WriteROM(0x4000, reg)
+		return c.ReadRAM(0xA000)
+	}
+	write := func(reg, x byte) {
+		c.WriteROM(0x4000, reg)
+		c.WriteRAM(0xA000, x)
+	}
+	write(0x08, 59)
+	write(0x09, 59)
+	write(0x0A, 23)
+	write(0x0B, 0xFF)
+	write(0x0C, 0x01)
+	c.Tick(ticksFreq)
+
+	// Nothing changes until the clock is latched again.
+	if x := read(0x08); x != 59 {
+		t.Errorf("seconds %d before latching", x)
+	}
+	c.WriteROM(0x6000, 0)
+	c.WriteROM(0x6000, 1)
+	got := []byte{read(0x08), read(0x09), read(0x0A), read(0x0B), read(0x0C)}
+	if want := []byte{0, 0, 0, 0, rtcCarry}; !bytes.Equal(got, want) {
+		t.Errorf("after a second: % X, want % X", got, want)
+	}
+
+	// The clock is saved after the RAM, and kept when loaded.
+	write(0x00, 0)
+	c.WriteRAM(0xA000, 0x42)
+	write(0x08, 30)
+	data := c.Battery()
+	if len(data) != 8192+rtcSaveSize {
+		t.Fatalf("battery of %d bytes", len(data))
+	}
+	d := newTestCartridge(t, testROM(4, 0x10, 2))
+	if err := d.SetBattery(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Battery()[:8192], data[:8192]) {
+		t.Error("RAM not restored")
+	}
+	if err := d.SetBattery(data[:8192]); err != nil {
+		t.Errorf("save without a clock: %v", err)
+	}
+
+	// A movie restores the clock as saved; loading a save moves it
+	// on by the time since.
+	binary.LittleEndian.PutUint64(data[8192+40:],
+		uint64(time.Seconds()-100))
+	if err := restoreBattery(d, data); err != nil {
+		t.Fatal(err)
+	}
+	if x := d.(*mbc3Cart).clock.regs[0]; x != 30 {
+		t.Errorf("seconds %d after restoring", x)
+	}
+	if err := d.SetBattery(data); err != nil {
+		t.Fatal(err)
+	}
+	if x := d.(*mbc3Cart).clock.regs[0]; x < 10 || x > 12 {
+		t.Errorf("seconds %d after loading, want 10", x)
+	}
+}
+
+// multicartROM makes a 1M MBC1 ROM with a header at the start of
+// each 256K game.
+func multicartROM() romImage {
+	rom := testROM(64, 0x01, 0)
+	for base := 0; base < len(rom); base += 0x40000 {
+		copy(rom[base+0x0104:], nintendoLogo)
+	}
+	return rom
+}
+
+func TestMBC1M(t *testing.T) {
+	c := newTestCartridge(t, multicartROM())
+	if _, ok := c.(*mbc1mCart); !ok {
+		t.Fatalf("got %T, want a multicart", c)
+	}
+	for _, x := range []struct {
+		addr      uint16
+		value     byte
+		low, high byte
+	}{
+		{0x2000, 0x13, 0, 0x03}, // bit 4 is not connected
+		{0x2000, 0x10, 0, 0x00}, // but still counts as not 0
+		{0x4000, 0x02, 0, 0x20},
+		{0x2000, 0x05, 0, 0x25},
+		{0x6000, 0x01, 0x20, 0x25},
+		{0x4000, 0x03, 0x30, 0x35},
+	} {
+		c.WriteROM(x.addr, x.value)
+		if low, high := c.ReadROM(0x0200), c.ReadROM(0x4000); low != x.low ||
+			high != x.high {
+			t.Errorf("after %02X to %04X: banks %02X, %02X; want %02X, %02X",
+				x.value, x.addr, low, high, x.low, x.high)
+		}
+	}
+}
+
+func TestMulticartDetection(t *testing.T) {
+	for _, x := range []struct {
+		rom       romImage
+		setting   string
+		multicart bool
+	}{
+		{multicartROM(), "auto", true},
+		{multicartROM(), "no", false},
+		{testROM(64, 0x01, 0), "", false},
+		{testROM(64, 0x01, 0), "yes", true},
+		{testROM(32, 0x01, 0), "auto", false},
+		{testROM(64, 0x19, 0), "yes", false}, // only MBC1 is affected
+	} {
+		c, err := newCartridge(x.rom, &Config{Multicart: x.setting})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.(*mbc1mCart); ok != x.multicart {
+			t.Errorf("%d banks, type %02X, %q: got %T", len(x.rom)/0x4000,
+				x.rom[0x0147], x.setting, c)
+		}
+	}
+	bad := &Config{Multicart: "maybe"}
+	if _, err := newCartridge(multicartROM(), bad); err == nil {
+		t.Error("no error for a bad setting")
+	}
+}
+
+func TestHuC1Infrared(t *testing.T) {
+	a := newTestCartridge(t, testROM(64, 0xFF, 3))
+	b := newTestCartridge(t, testROM(64, 0xFF, 3))
+	a.WriteRAM(0xA000, 0x42)
+	a.WriteROM(0x0000, 0x0E)
+	if x := a.ReadRAM(0xA000); x != 0xC0 {
+		t.Errorf("unconnected port read %02X", x)
+	}
+
+	a.(irDevice).infrared().loopBack()
+	a.WriteRAM(0xA000, 1)
+	if x := a.ReadRAM(0xA000); x != 0xC1 {
+		t.Errorf("looped back port read %02X", x)
+	}
+
+	connectIR(a.(irDevice).infrared(), b.(irDevice).infrared())
+	b.WriteROM(0x0000, 0x0E)
+	if x := b.ReadRAM(0xA000); x != 0xC1 {
+		t.Errorf("connected port read %02X", x)
+	}
+	a.WriteRAM(0xA000, 0)
+	if x := b.ReadRAM(0xA000); x != 0xC0 {
+		t.Errorf("connected port read %02X after LED off", x)
+	}
+
+	a.WriteROM(0x0000, 0x00)
+	if x := a.ReadRAM(0xA000); x != 0x42 {
+		t.Errorf("RAM read %02X", x)
+	}
+}
+
+// lamp is an IRPeer whose light is switched by hand.
+type lamp bool
+
+func (l *lamp) Light() bool {
+	return bool(*l)
+}
+
+func TestIRConfig(t *testing.T) {
+	link := new(IRLink)
+	cfg := &Config{IRLink: link}
+	var ports [3]Cartridge
+	for i := range ports {
+		c, err := newCartridge(testROM(64, 0xFF, 3), cfg)
+		if i == 2 {
+			if err == nil {
+				t.Error("no error for a third end of a link")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.WriteROM(0x0000, 0x0E)
+		ports[i] = c
+	}
+	ports[0].WriteRAM(0xA000, 1)
+	if x := ports[1].ReadRAM(0xA000); x != 0xC1 {
+		t.Errorf("linked port read %02X", x)
+	}
+	if x := ports[0].ReadRAM(0xA000); x != 0xC0 {
+		t.Errorf("linked port read %02X from its own LED", x)
+	}
+
+	light := lamp(true)
+	c, err := newCartridge(testROM(64, 0xFF, 3), &Config{IRPeer: &light})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WriteROM(0x0000, 0x0E)
+	if x := c.ReadRAM(0xA000); x != 0xC1 {
+		t.Errorf("port read %02X with the peer's light on", x)
+	}
+	light = false
+	if x := c.ReadRAM(0xA000); x != 0xC0 {
+		t.Errorf("port read %02X with the peer's light off", x)
+	}
+}
+
+func TestHuC3Clock(t *testing.T) {
+	c := newTestCartridge(t, testROM(64, 0xFE, 2))
+	command := func(cmd, arg byte) {
+		c.WriteROM(0x0000, huc3Command)
+		c.WriteRAM(0xA000, cmd<<4|arg)
+	}
+	read := func() byte {
+		command(1, 0)
+		c.WriteROM(0x0000, huc3Response)
+		return c.ReadRAM(0xA000)
+	}
+
+	// Set 1439 minutes (59Fh) and day 3, then let a minute pass.
+	command(4, 0)
+	command(5, 0)
+	for _, x := range []byte{0xF, 0x9, 0x5, 0x3, 0x0, 0x0} {
+		command(3, x)
+	}
+	c.Tick(minuteTicks)
+	command(4, 0)
+	var got []byte
+	for i := 0; i < 6; i++ {
+		got = append(got, read())
+	}
+	if want := []byte{0, 0, 0, 4, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("registers % X, want % X", got, want)
+	}
+
+	data := c.Battery()
+	if len(data) != 8192+huc3SaveSize {
+		t.Fatalf("battery of %d bytes", len(data))
+	}
+	d := newTestCartridge(t, testROM(64, 0xFE, 2))
+	if err := d.SetBattery(data); err != nil {
+		t.Fatal(err)
+	}
+	if h := d.(*huc3Cart); h.days != 4 {
+		t.Errorf("day %d after loading", h.days)
+	}
+	binary.LittleEndian.PutUint64(data[8192+4:],
+		uint64(time.Seconds()-3600))
+	if err := restoreBattery(d, data); err != nil {
+		t.Fatal(err)
+	}
+	if h := d.(*huc3Cart); h.minutes != 0 {
+		t.Errorf("minute %d after restoring", h.minutes)
+	}
+	if err := d.SetBattery(data); err != nil {
+		t.Fatal(err)
+	}
+	if h := d.(*huc3Cart); h.minutes != 60 {
+		t.Errorf("minute %d after loading, want 60", h.minutes)
+	}
+}
+
+func TestMBC7(t *testing.T) {
+	c := newTestCartridge(t, testROM(64, 0x22, 0))
+	c.WriteROM(0x0000, 0x0A)
+	if x := c.ReadRAM(0xA020); x != 0xFF {
+		t.Errorf("read %02X before the second enable", x)
+	}
+	c.WriteROM(0x4000, 0x40)
+
+	reading := func() (x, y int) {
+		return int(c.ReadRAM(0xA020)) | int(c.ReadRAM(0xA030))<<8,
+			int(c.ReadRAM(0xA040)) | int(c.ReadRAM(0xA050))<<8
+	}
+	c.(tiltSensor).tilt(1, -0.5)
+	c.WriteRAM(0xA010, 0xAA)
+	if x, y := reading(); x != accelErased || y != accelErased {
+		t.Errorf("latched %04X, %04X without erasing", x, y)
+	}
+	c.WriteRAM(0xA000, 0x55)
+	c.WriteRAM(0xA010, 0xAA)
+	if x, y := reading(); x != accelCentre-accelRange ||
+		y != accelCentre-accelRange/2 {
+		t.Errorf("latched %04X, %04X", x, y)
+	}
+
+	c.WriteRAM(0xA080, 0x00)
+	if x := c.ReadRAM(0xA080); x != 0x01 {
+		t.Errorf("EEPROM lines read %02X", x)
+	}
+	if data := c.Battery(); len(data) != 256 {
+		t.Errorf("battery of %d bytes", len(data))
+	}
+	if err := c.SetBattery(make([]byte, 8192)); err == nil {
+		t.Error("no error for a save of the wrong size")
+	}
+}
+
+// TestIRLinkMachines runs two machines whose cartridges are linked, each
+// in its own goroutine, as a program would; run it with -race.
+func TestIRLinkMachines(t *testing.T) {
+	// Switch A000h to the infrared port, then keep setting the LED to
+	// the opposite of what the sensor sees.
+	rom := testROM(64, 0xFF, 3)
+	copy(rom[0x0100:], []byte{
+		0x3E, 0x0E, // LD A,0Eh
+		0xEA, 0x00, 0x00, // LD (0000h),A
+		0xFA, 0x00, 0xA0, // LD A,(A000h)
+		0x2F,             // CPL
+		0xEA, 0x00, 0xA0, // LD (A000h),A
+		0x18, 0xF7, // JR -9
+	})
+	cfg := &Config{AudioFreq: 48000, IRLink: new(IRLink)}
+	done := make(chan os.Error)
+	for i := 0; i < 2; i++ {
+		mem, err := newMemory(rom, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sys := newMachine(mem)
+		lcd := &display{memory: mem}
+		lcd.initPalette()
+		mem.connect(lcd, newMixerOutput(mem, nullOutput{}))
+		go func() {
+			defer sys.audio.close()
+			var state bytes.Buffer
+			for frame := 0; frame < 10; frame++ {
+				sys.runFrame()
+				if frame == 5 {
+					if err := sys.saveState(&state); err != nil {
+						done <- err
+						return
+					}
+				}
+			}
+			done <- sys.loadState(&state)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
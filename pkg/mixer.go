@@ -4,11 +4,6 @@
 
 package gameboy
 
-import (
-	"fmt"
-	"ao"
-)
-
 const (
 	ticksFreq      = 1 << 20
 	mixerStepTicks = 4096 // 1/256 second
@@ -281,22 +276,26 @@ func (ch *wave) mix(buf []int16, onleft, onright int16, mem *memory) {
 }
 
 type mixer struct {
-	ao.SampleFormat
 	*memory
 
-	dev *ao.Device
+	rate int // samples per second, from Config.AudioFreq
+
+	out audioOutput
 
 	clock int
 
-	buf   [][]int16
-	bufi  int
-	frame uint
+	buf       [][]int16
+	bufi      int
+	frame     uint
+	captured  uint      // up to where buf[bufi] was passed to the video
+	stretched [][]int16 // buf stretched to the current speed
 
 	send   chan []int16
 	status chan bool
 	quit   chan int
 
 	enable bool
+	live   bool // the output is played as it is made, setting the pace
 
 	volL int16
 	volR int16
@@ -310,51 +309,36 @@ type mixer struct {
 	ch2 tone
 	ch3 wave
 	ch4 noise
-}
 
-func newMixer(mem *memory) (mix *mixer, err interface{}) {
-	format := ao.SampleFormat{
-		Bits:       16,
-		Rate:       mem.config.AudioFreq,
-		Channels:   2,
-		ByteFormat: ao.FormatNative,
-		Matrix:     "L,R",
-	}
-
-	ao.Initialize()
-
-	id := ao.DriverID(mem.config.AudioDriver)
-	if id < 0 {
-		id = ao.DefaultDriverID()
-	}
+	// Debugging aids: channels may be muted individually, or one
+	// may be soloed (numbered 1-4, or 0 for none). When scope is
+	// non-nil each channel's output is also recorded there.
+	mute  [4]bool
+	solo  int
+	scope *scope
+}
 
-	var device *ao.Device
-	device, err = ao.OpenLive(id, &format)
-	if err != nil {
-		ao.Shutdown()
-		return
-	}
+// An audioOutput consumes buffers of mixed, interleaved stereo
+// samples.
+type audioOutput interface {
+	play(buf []int16)
+	close()
+}
 
+// newMixerOutput creates a mixer which sends its output to out,
+// rather than opening an audio device.
+func newMixerOutput(mem *memory, out audioOutput) *mixer {
 	if mem.config.AudioBuffers < 3 {
 		mem.config.AudioBuffers = 3
 	}
 
-	if mem.config.Verbose {
-		info, _ := ao.DriverInfo(id)
-		fmt.Println("Opened audio:")
-		fmt.Printf("  driver:      [%s] %s\n", info.ShortName, info.Name)
-		fmt.Printf("  rate:        %dHz\n", format.Rate)
-		fmt.Printf("  channels:    %d\n", format.Channels)
-		fmt.Printf("  buffer size: %d samples\n", 1024)
-		fmt.Printf("  buffers:     %d\n", mem.config.AudioBuffers)
-	}
-
-	mix = &mixer{SampleFormat: format, dev: device, memory: mem}
+	mix := &mixer{rate: mem.config.AudioFreq, out: out, memory: mem}
 
 	mix.buf = make([][]int16, mem.config.AudioBuffers)
 	for i := 0; i < len(mix.buf); i++ {
 		mix.buf[i] = make([]int16, 1024*2)
 	}
+	mix.stretched = make([][]int16, len(mix.buf))
 
 	mix.ch4.initialize()
 
@@ -364,10 +348,16 @@ func newMixer(mem *memory) (mix *mixer, err interface{}) {
 
 	go mix.runAudio()
 
-	return mix, nil
+	return mix
 }
 
+// close sends any partially mixed buffer to the output, then waits
+// for it to finish.
 func (mix *mixer) close() {
+	if mix.frame > 0 {
+		mix.send <- mix.buf[mix.bufi][:mix.frame]
+		mix.frame = 0
+	}
 	mix.quit <- 1
 	<-mix.quit // wait for audio thread to finish
 }
@@ -381,16 +371,16 @@ func (mix *mixer) step(t int) {
 	mix.clock += t
 	if mix.clock >= mixerStepTicks {
 		mix.clock -= mixerStepTicks
-		mix.ch1.step(mix.Rate)
-		mix.ch2.step(mix.Rate)
-		mix.ch3.step(mix.Rate)
-		mix.ch4.step(mix.Rate)
+		mix.ch1.step(mix.rate)
+		mix.ch2.step(mix.rate)
+		mix.ch3.step(mix.rate)
+		mix.ch4.step(mix.rate)
 		mix.mix()
 	}
 }
 
 func (mix *mixer) mix() {
-	frames := 2 * (mixerStepTicks * uint(mix.Rate) / ticksFreq)
+	frames := 2 * (mixerStepTicks * uint(mix.rate) / ticksFreq)
 	size := uint(len(mix.buf[mix.bufi]))
 	if mix.frame+frames >= size {
 		slice := size - mix.frame
@@ -413,17 +403,16 @@ func (mix *mixer) slice(frames uint) {
 		buf[f] = 0
 	}
 
-	if mix.ch1.active {
-		mix.ch1.mix(buf, mix.ch1L, mix.ch1R)
-	}
-	if mix.ch2.active {
-		mix.ch2.mix(buf, mix.ch2L, mix.ch2R)
-	}
-	if mix.ch3.active {
-		mix.ch3.mix(buf, mix.ch3L, mix.ch3R, mix.memory)
-	}
-	if mix.ch4.active {
-		mix.ch4.mix(buf, mix.ch4L, mix.ch4R)
+	for n := 1; n <= 4; n++ {
+		l, r := mix.panning(n)
+		if !mix.audible(n) {
+			l, r = 0, 0
+		}
+		if mix.scope != nil {
+			mix.scope.mix(mix, n, buf, l, r)
+		} else {
+			mix.mixChannel(n, buf, l, r)
+		}
 	}
 
 	for f := 0; f < len(buf); f += 2 {
@@ -434,13 +423,159 @@ func (mix *mixer) slice(frames uint) {
 	mix.frame += frames
 }
 
+// mixChannel adds the output of sound channel n (1-4) to buf.
+func (mix *mixer) mixChannel(n int, buf []int16, l, r int16) {
+	switch n {
+	case 1:
+		if mix.ch1.active {
+			mix.ch1.mix(buf, l, r)
+		}
+	case 2:
+		if mix.ch2.active {
+			mix.ch2.mix(buf, l, r)
+		}
+	case 3:
+		if mix.ch3.active {
+			mix.ch3.mix(buf, l, r, mix.memory)
+		}
+	case 4:
+		if mix.ch4.active {
+			mix.ch4.mix(buf, l, r)
+		}
+	}
+}
+
+func (mix *mixer) panning(n int) (l, r int16) {
+	switch n {
+	case 1:
+		return mix.ch1L, mix.ch1R
+	case 2:
+		return mix.ch2L, mix.ch2R
+	case 3:
+		return mix.ch3L, mix.ch3R
+	case 4:
+		return mix.ch4L, mix.ch4R
+	}
+	return 0, 0
+}
+
+func (mix *mixer) audible(n int) bool {
+	if mix.solo != 0 {
+		return n == mix.solo
+	}
+	return !mix.mute[n-1]
+}
+
+func (mix *mixer) setMute(n int, on bool) {
+	if n >= 1 && n <= 4 {
+		mix.mute[n-1] = on
+	}
+}
+
+func (mix *mixer) setSolo(n int) {
+	if n < 0 || n > 4 {
+		n = 0
+	}
+	mix.solo = n
+}
+
+func (mix *mixer) showScope(on bool) {
+	if !on {
+		mix.scope = nil
+	} else if mix.scope == nil {
+		mix.scope = new(scope)
+	}
+}
+
 func (mix *mixer) next() {
-	mix.send <- mix.buf[mix.bufi]
+	mix.capture()
+
+	// Blocking on the audio device keeps the emulator in time, so
+	// away from normal speed the sound is stretched to match. If
+	// running flat out, it is dropped. A stretched buffer is kept
+	// with the one it came from, and so is not reused until that
+	// one is.
+	switch speed := mix.currentSpeed(); speed {
+	case 0:
+	case 100:
+		mix.send <- mix.buf[mix.bufi]
+	default:
+		out := stretch(mix.stretched[mix.bufi], mix.buf[mix.bufi], speed)
+		mix.stretched[mix.bufi] = out
+		mix.send <- out
+	}
 	mix.bufi++
 	if mix.bufi >= len(mix.buf) {
 		mix.bufi = 0
 	}
 	mix.frame = 0
+	mix.captured = 0
+}
+
+// capture passes the samples mixed since the last call to the video
+// being recorded.
+func (mix *mixer) capture() {
+	if w := mix.video; w != nil && w.started {
+		w.audio(mix.buf[mix.bufi][mix.captured:mix.frame])
+	}
+	mix.captured = mix.frame
+}
+
+// outputRate is the true number of samples mixed per second, which
+// is a little under the rate asked for since a whole number are
+// mixed at each step.
+func (mix *mixer) outputRate() int {
+	return int(mixerStepTicks*uint(mix.rate)/ticksFreq) *
+		(ticksFreq / mixerStepTicks)
+}
+
+// The sound is stretched in grains of this many frames, crossfaded
+// over fadeFrames.
+const (
+	grainFrames = 512
+	fadeFrames  = 64
+)
+
+// stretch changes the length of interleaved stereo samples played at
+// speed percent of normal to suit the normal rate, without changing
+// their pitch. Grains of the sound are played from points spread
+// evenly through buf, so that some of it is repeated (or skipped),
+// and each is faded in over the last one carrying on. The result is
+// put in out, which is grown if need be.
+func stretch(out, buf []int16, speed int) []int16 {
+	n := len(buf) / 2
+	m := n * 100 / speed
+	if cap(out) < 2*m {
+		out = make([]int16, 2*m)
+	}
+	out = out[:2*m]
+
+	grain := grainFrames
+	if grain > n {
+		grain = n
+	}
+	start := func(g int) int {
+		s := g * grain * speed / 100
+		if s > n-grain {
+			s = n - grain
+		}
+		return s
+	}
+	for i := 0; i < m; i++ {
+		g, off := i/grain, i%grain
+		j := start(g) + off
+		k := start(g-1) + grain + off // the last grain carrying on
+		fade := g > 0 && off < fadeFrames && k < n
+		for c := 0; c < 2; c++ {
+			x := int(buf[2*j+c])
+			if fade {
+				y := int(buf[2*k+c])
+				x = (x*off + y*(fadeFrames-off)) / fadeFrames
+			}
+			out[2*i+c] = int16(x)
+		}
+	}
+	return out
 }
 
 func (mix *mixer) runAudio() {
@@ -449,13 +584,19 @@ func (mix *mixer) runAudio() {
 		select {
 		case buf := <-mix.send:
 			if !pause {
-				mix.dev.Play16(buf)
+				mix.out.play(buf)
 			}
 		case pause = <-mix.status:
 			// okay, pause updated
 		case <-mix.quit:
-			mix.dev.Close()
-			ao.Shutdown()
+			// play out whatever is still queued
+			for len(mix.send) > 0 {
+				buf := <-mix.send
+				if !pause {
+					mix.out.play(buf)
+				}
+			}
+			mix.out.close()
 			mix.quit <- 1
 			return
 		}
@@ -0,0 +1,56 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "testing"
+
+// sawtooth makes n frames of a sawtooth wave with a period of 32
+// frames, rising by 100 each frame.
+func sawtooth(n int) []int16 {
+	buf := make([]int16, 2*n)
+	for i := 0; i < n; i++ {
+		buf[2*i] = int16(i % 32 * 100)
+		buf[2*i+1] = buf[2*i]
+	}
+	return buf
+}
+
+func TestStretch(t *testing.T) {
+	buf := sawtooth(1024)
+	for _, speed := range []int{25, 50, 200} {
+		out := stretch(nil, buf, speed)
+		if n := 1024 * 100 / speed * 2; len(out) != n {
+			t.Errorf("%d%%: %d samples, want %d", speed, len(out), n)
+			continue
+		}
+
+		// Away from the crossfades the wave is the same shape, so
+		// the pitch is unchanged.
+		for i := 0; i+1 < len(out)/2; i++ {
+			if i%grainFrames < fadeFrames || i%grainFrames == grainFrames-1 {
+				continue
+			}
+			d := out[2*i+2] - out[2*i]
+			if d != 100 && d != -3100 || out[2*i+1] != out[2*i] {
+				t.Errorf("%d%%: frame %d is %d, then %d", speed, i,
+					out[2*i], out[2*i+2])
+				break
+			}
+		}
+	}
+
+	// The output buffer is reused if it is big enough.
+	out := make([]int16, 0, 4096)
+	if got := stretch(out, buf, 50); &got[0] != &out[:1][0] {
+		t.Error("new buffer allocated")
+	}
+}
+
+func TestSlowSpeedDefault(t *testing.T) {
+	m := &memory{config: &Config{}, slow: true}
+	if s := m.currentSpeed(); s != defaultSlowSpeed {
+		t.Errorf("slow motion at %d%% with no SlowSpeed", s)
+	}
+}
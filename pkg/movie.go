@@ -0,0 +1,348 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Movie modes, for Config.MovieMode.
+const (
+	MovieOff      = iota
+	MovieRecord   // record a new movie, replacing any existing file
+	MoviePlay     // play back; loading a state resumes recording
+	MovieReadOnly // play back without ever changing the movie
+)
+
+const (
+	movieMagic   = "GBMOVIE"
+	movieVersion = 3 // versions 1 (without tilt) and 2 (no ID) can be played
+
+	// The most a movie's start data or frames may take up: over a
+	// week of frames, far more than any movie needs.
+	movieMaxBlock = 1 << 26
+)
+
+// How a movie begins.
+const (
+	movieFromPowerOn = byte(iota) // with blank battery-backed RAM
+	movieFromSRAM                 // with a snapshot of the RAM
+	movieFromState                // from a saved state
+)
+
+// A movie is a record of the buttons held during each frame of a
+// session, which replays it exactly when played back from the same
+// starting point.
+//
+// Frames are stored one byte each, in the JOYP layout: the d-pad in
+// the low nibble, the other buttons in the high nibble, and a clear
+// bit for each button held. For a cartridge with an accelerometer,
+// the tilt in each frame follows, as two signed bytes (x then y,
+// from -127 to 127); see latchTilt.
+type movie struct {
+	emulator  string // Version of the emulator which recorded it
+	hsum      byte   // ROM checksums, as in saveName
+	gsum      uint16
+	id        uint32 // chosen at random, and kept in states saved from it
+	rerecords uint32
+	start     byte
+	startData []byte // the RAM or state to start from
+	frames    []byte
+	tilt      []byte // two for each frame, or none
+
+	name     string
+	mode     int
+	dirty    bool // changed since being read
+	finished bool // played past the end
+}
+
+func (mv *movie) writeTo(w io.Writer) os.Error {
+	b := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	for _, f := range []interface{}{
+		[]byte(movieMagic), byte(movieVersion),
+		byte(len(mv.emulator)), []byte(mv.emulator),
+		mv.hsum, mv.gsum, mv.id, mv.rerecords,
+		mv.start, uint32(len(mv.startData)), mv.startData,
+		uint32(len(mv.frames)), mv.frames,
+		uint32(len(mv.tilt)), mv.tilt,
+	} {
+		if err := binary.Write(b, le, f); err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+func readMovie(r io.Reader) (mv *movie, err os.Error) {
+	b := bufio.NewReader(r)
+	le := binary.LittleEndian
+	read := func(f interface{}) {
+		if err == nil {
+			err = binary.Read(b, le, f)
+		}
+	}
+	// A block's length is checked, and it is read as it comes rather
+	// than all allocated at once, so that a corrupt length fails
+	// before using much memory.
+	block := func() []byte {
+		var n uint32
+		read(&n)
+		if err == nil && n > movieMaxBlock {
+			err = fmt.Errorf("bad movie block length %d", n)
+		}
+		if err != nil {
+			return nil
+		}
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, b, int64(n)); err == os.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf.Bytes()
+	}
+
+	magic := make([]byte, len(movieMagic))
+	var version, n byte
+	read(magic)
+	read(&version)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case string(magic) != movieMagic:
+		return nil, os.NewError("not a movie")
+	case version < 1 || version > movieVersion:
+		return nil, fmt.Errorf("unsupported movie version %d", version)
+	}
+
+	mv = new(movie)
+	read(&n)
+	emulator := make([]byte, n)
+	read(emulator)
+	mv.emulator = string(emulator)
+	read(&mv.hsum)
+	read(&mv.gsum)
+	if version >= 3 {
+		read(&mv.id)
+	} else if err == nil {
+		// Older movies get a new ID each time they are read, which
+		// is kept once they are saved again.
+		mv.id, err = newMovieID()
+	}
+	read(&mv.rerecords)
+	read(&mv.start)
+	mv.startData = block()
+	mv.frames = block()
+	if version >= 2 {
+		mv.tilt = block()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mv, nil
+}
+
+// newMovieID picks an ID for a movie, which tells states saved while
+// it runs apart from those saved from any other movie, or with none
+// (which have an ID of 0).
+func newMovieID() (id uint32, err os.Error) {
+	for id == 0 && err == nil {
+		err = binary.Read(rand.Reader, binary.LittleEndian, &id)
+	}
+	return
+}
+
+func (mv *movie) save() os.Error {
+	var buf bytes.Buffer
+	if err := mv.writeTo(&buf); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(mv.name, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	mv.dirty = false
+	return nil
+}
+
+// startMovie sets the machine up to record or play the movie named
+// in the configuration. This must happen before anything is run.
+func (sys *machine) startMovie() os.Error {
+	cfg := sys.config
+	if cfg.MovieMode == MovieRecord {
+		return sys.recordMovie(cfg.MovieFile, cfg.MovieStart)
+	}
+
+	data, err := ioutil.ReadFile(cfg.MovieFile)
+	if err != nil {
+		return err
+	}
+	mv, err := readMovie(bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	if mv.hsum != sys.rom.headerChecksum() ||
+		mv.gsum != sys.rom.globalChecksum() {
+		return os.NewError("movie was recorded with a different ROM")
+	}
+	if mv.emulator != Version {
+		sys.error("movie was recorded with version %s (this is %s)",
+			mv.emulator, Version)
+	}
+	mv.name = cfg.MovieFile
+	mv.mode = cfg.MovieMode
+
+	switch mv.start {
+	case movieFromSRAM:
+		if len(mv.startData) > 0 {
+			err = restoreBattery(sys.cart, mv.startData)
+			if err != nil {
+				return err
+			}
+		}
+	case movieFromState:
+		if err = sys.loadState(bytes.NewBuffer(mv.startData)); err != nil {
+			return err
+		}
+	}
+	sys.frame = 0
+	sys.movie = mv
+	sys.message("playing movie: %d frames, %d rerecords",
+		len(mv.frames), mv.rerecords)
+	return nil
+}
+
+// recordMovie begins a new movie from power on (with battery-backed
+// RAM cleared), from the battery-backed RAM in the save directory if
+// start is "sram", or from a state slot if start is a slot number.
+func (sys *machine) recordMovie(name, start string) os.Error {
+	mv := &movie{name: name, mode: MovieRecord, dirty: true,
+		emulator: Version, hsum: sys.rom.headerChecksum(),
+		gsum: sys.rom.globalChecksum()}
+	var err os.Error
+	if mv.id, err = newMovieID(); err != nil {
+		return err
+	}
+
+	switch start {
+	case "", "power-on":
+		mv.start = movieFromPowerOn
+	case "sram":
+		if e := sys.load(sys.config.SaveDir); e != nil {
+			return fmt.Errorf("%v", e)
+		}
+		mv.start = movieFromSRAM
+		mv.startData = sys.cart.Battery()
+	default:
+		slot, err := strconv.Atoi(start)
+		if err != nil || slot < 0 || slot >= stateSlots {
+			return fmt.Errorf("bad movie start '%s'", start)
+		}
+		data, err := ioutil.ReadFile(sys.stateName(slot))
+		if err != nil {
+			return err
+		}
+		if err = sys.loadState(bytes.NewBuffer(data)); err != nil {
+			return err
+		}
+		mv.start = movieFromState
+		mv.startData = data
+	}
+	sys.frame = 0
+	sys.movie = mv
+	sys.message("recording movie")
+	return nil
+}
+
+// input returns the buttons for the given frame: those recorded in
+// the movie when playing, otherwise those held on the controls.
+func (mv *movie) input(frame int, held byte) byte {
+	if mv.mode == MovieRecord {
+		mv.frames = append(mv.frames[:frame], held)
+		mv.dirty = true
+		return held
+	}
+	if frame < len(mv.frames) {
+		return mv.frames[frame]
+	}
+	mv.finished = true
+	return held
+}
+
+// tiltAt returns the tilt for the given frame: that recorded in the
+// movie when playing (none if it has no tilt), otherwise x and y as
+// they will be recorded.
+func (mv *movie) tiltAt(frame int, x, y float64) (float64, float64) {
+	if mv.mode == MovieRecord {
+		for len(mv.tilt) < frame*2 {
+			mv.tilt = append(mv.tilt, 0)
+		}
+		mv.tilt = append(mv.tilt[:frame*2], byte(int8(x*127)),
+			byte(int8(y*127)))
+		mv.dirty = true
+	} else if frame >= len(mv.frames) {
+		return x, y
+	} else if frame*2 >= len(mv.tilt) {
+		return 0, 0
+	}
+	t := mv.tilt[frame*2:]
+	return float64(int8(t[0])) / 127, float64(int8(t[1])) / 127
+}
+
+// checkState is called after loading a state while a movie is
+// running, with the state's frame and movie ID, to move the movie to
+// that frame. Unless the movie is read-only, anything after that
+// frame is discarded and recording resumes.
+func (mv *movie) checkState(frame int, id uint32) os.Error {
+	if id != mv.id || frame > len(mv.frames) {
+		return os.NewError("state is not from this movie")
+	}
+	mv.finished = frame == len(mv.frames)
+	if mv.mode != MovieReadOnly {
+		mv.frames = mv.frames[:frame]
+		if len(mv.tilt) > frame*2 {
+			mv.tilt = mv.tilt[:frame*2]
+		}
+		mv.rerecords++
+		mv.mode = MovieRecord
+		mv.dirty = true
+	}
+	return nil
+}
+
+// setReadOnly switches between read-only playback and recording
+// from the current frame.
+func (mv *movie) setReadOnly(frame int, on bool) os.Error {
+	if on {
+		mv.mode = MovieReadOnly
+	} else if mv.mode == MovieReadOnly {
+		mv.mode = MoviePlay
+		if err := mv.checkState(frame, mv.id); err != nil {
+			mv.mode = MovieReadOnly
+			return err
+		}
+	}
+	return nil
+}
+
+// status describes what the movie is doing, with the frame counter.
+func (mv *movie) status(frame int) string {
+	switch {
+	case mv.mode == MovieRecord:
+		return fmt.Sprintf("recording %d", frame)
+	case mv.finished:
+		return fmt.Sprintf("finished %d", len(mv.frames))
+	case mv.mode == MovieReadOnly:
+		return fmt.Sprintf("read-only %d/%d", frame, len(mv.frames))
+	}
+	return fmt.Sprintf("playing %d/%d", frame, len(mv.frames))
+}
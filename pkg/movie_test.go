@@ -0,0 +1,136 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"testing"
+	"testing/quick"
+)
+
+func TestMovieRoundTrip(t *testing.T) {
+	f := func(id, rerecords uint32, start byte, data, frames, tilt []byte) bool {
+		mv := &movie{emulator: Version, hsum: 0x5A, gsum: 0x1234,
+			id: id, rerecords: rerecords, start: start % 3,
+			startData: data, frames: frames, tilt: tilt}
+		var buf bytes.Buffer
+		if err := mv.writeTo(&buf); err != nil {
+			t.Log(err)
+			return false
+		}
+		got, err := readMovie(&buf)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		return got.emulator == mv.emulator &&
+			got.hsum == mv.hsum && got.gsum == mv.gsum && got.id == mv.id &&
+			got.rerecords == mv.rerecords && got.start == mv.start &&
+			bytes.Equal(got.startData, mv.startData) &&
+			bytes.Equal(got.frames, mv.frames) &&
+			bytes.Equal(got.tilt, mv.tilt)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMovieCorrupt(t *testing.T) {
+	mv := &movie{emulator: Version, startData: []byte{1, 2, 3},
+		frames: []byte{0xFF, 0xFE}}
+	var buf bytes.Buffer
+	if err := mv.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// The frames' length is just before the frames, which are
+	// followed by the empty tilt block.
+	huge := append([]byte{}, data...)
+	for i := len(huge) - 10; i < len(huge)-6; i++ {
+		huge[i] = 0xFF
+	}
+	if _, err := readMovie(bytes.NewBuffer(huge)); err == nil {
+		t.Error("no error for a huge block")
+	}
+	if _, err := readMovie(bytes.NewBuffer(data[:len(data)-1])); err == nil {
+		t.Error("no error for a truncated movie")
+	}
+}
+
+func TestMovieRerecord(t *testing.T) {
+	m := &memory{dpadBits: 0xF, btnBits: 0xF, held: 0xFF}
+	m.movie = &movie{mode: MovieRecord, id: 1}
+	for _, held := range []byte{0xFF, 0xFE, 0xEF, 0xFF} {
+		m.held = held
+		m.latchInput()
+	}
+	if m.hram[portIF-0xFF00]&0x10 == 0 {
+		t.Error("no joypad interrupt")
+	}
+
+	// as if loading a state saved at frame 2
+	m.movie.mode = MovieReadOnly
+	if m.movie.checkState(2, 2) == nil {
+		t.Error("accepted a state from another movie")
+	}
+	if m.movie.checkState(2, 0) == nil {
+		t.Error("accepted a state saved with no movie")
+	}
+	if err := m.movie.checkState(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	m.frame = 2
+	m.held = 0x00
+	m.latchInput()
+	if m.dpadBits != 0xF || m.btnBits != 0xE {
+		t.Errorf("read-only played %X%X, want EF", m.btnBits, m.dpadBits)
+	}
+	if len(m.movie.frames) != 4 {
+		t.Errorf("read-only movie changed")
+	}
+
+	if err := m.movie.setReadOnly(2, false); err != nil {
+		t.Fatal(err)
+	}
+	m.frame = 2
+	m.latchInput()
+	want := []byte{0xFF, 0xFE, 0x00}
+	if !bytes.Equal(m.movie.frames, want) || m.movie.rerecords != 1 {
+		t.Errorf("after rerecord got %X (%d rerecords), want %X",
+			m.movie.frames, m.movie.rerecords, want)
+	}
+	if m.movie.checkState(4, 1) == nil {
+		t.Error("accepted a state past the end")
+	}
+}
+
+func TestMovieTilt(t *testing.T) {
+	c := newTestCartridge(t, testROM(64, 0x22, 0)).(*mbc7Cart)
+	m := &memory{config: new(Config), cart: c, dpadBits: 0xF, btnBits: 0xF,
+		held: 0xFF}
+	m.movie = &movie{mode: MovieRecord}
+	for _, x := range []float64{0.5, -1, 0} {
+		m.tiltAxes[0] = x
+		m.latchInput()
+	}
+	if want := []byte{63, 0, 0x81, 0, 0, 0}; !bytes.Equal(m.movie.tilt, want) {
+		t.Errorf("recorded tilt % X, want % X", m.movie.tilt, want)
+	}
+
+	// Playing back ignores the live tilt.
+	m.movie.mode = MoviePlay
+	m.frame = 1
+	m.tiltAxes[0] = 1
+	m.latchInput()
+	if c.tiltX != -1 {
+		t.Errorf("played tilt %g, want -1", c.tiltX)
+	}
+	m.frame = 3
+	m.latchInput()
+	if c.tiltX != 1 {
+		t.Errorf("tilt %g after the movie finished, want 1", c.tiltX)
+	}
+}
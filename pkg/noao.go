@@ -0,0 +1,15 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "os"
+
+// This file replaces aoaudio.go when the package is built without SDL
+// (make NOSDL=1), so that it needs no native libraries at all. There
+// is no audio device then, and the terminal frontend runs silently.
+
+func newMixer(mem *memory) (*mixer, interface{}) {
+	return nil, os.NewError("built without libao; there is no sound")
+}
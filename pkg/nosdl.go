@@ -0,0 +1,22 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "os"
+
+// This file replaces sdlfront.go when the package is built without
+// SDL (make NOSDL=1). There is no window then: Start and StartGBS
+// fail, and only the terminal frontend and the headless runners
+// (tests, rendering and dumps) are available.
+
+var errNoSDL = os.NewError("built without SDL; only -term is available")
+
+func Start(path string, cfg Config, in <-chan interface{}, out chan<- interface{}) {
+	out <- errNoSDL
+}
+
+func StartGBS(path string, track int, cfg Config, in <-chan interface{}, out chan<- interface{}) {
+	out <- errNoSDL
+}
@@ -0,0 +1,156 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"time"
+)
+
+const (
+	osdMessages    = 3          // most shown at once
+	osdMessageTime = 2000000000 // nanoseconds each is shown for
+	osdLineH       = glyphH + 3
+)
+
+// The on-screen display shows messages and status over the picture.
+// It is drawn on the screen after each frame, so it is never part of
+// the frame itself (or of screenshots, unless Config.ScreenshotOSD).
+type osd struct {
+	show      bool // anything at all
+	showFPS   bool
+	showInput bool
+
+	lock     sync.Mutex // messages may come from other goroutines
+	messages []osdMessage
+
+	fps       int
+	fpsFrames int
+	fpsTime   int64
+}
+
+type osdMessage struct {
+	text    string
+	expires int64
+}
+
+// post adds a message, pushing out the oldest if there are too many.
+func (o *osd) post(text string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.messages) == osdMessages {
+		o.messages = o.messages[1:]
+	}
+	o.messages = append(o.messages,
+		osdMessage{text, time.Nanoseconds() + osdMessageTime})
+}
+
+// current returns the messages still to be shown.
+func (o *osd) current() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	now := time.Nanoseconds()
+	for len(o.messages) > 0 && o.messages[0].expires <= now {
+		o.messages = o.messages[1:]
+	}
+	texts := make([]string, len(o.messages))
+	for i, m := range o.messages {
+		texts[i] = m.text
+	}
+	return texts
+}
+
+// countFrame updates the frame rate once a second.
+func (o *osd) countFrame() {
+	now := time.Nanoseconds()
+	o.fpsFrames++
+	if d := now - o.fpsTime; d >= 1000000000 {
+		o.fps = int((int64(o.fpsFrames)*1000000000 + d/2) / d)
+		o.fpsFrames = 0
+		o.fpsTime = now
+	}
+}
+
+// inputText shows the buttons held in this frame, each in its own
+// place so the display stays steady.
+func inputText(dpad, btn byte) string {
+	b := []byte("<^V> A B SE ST")
+	for i, pos := range []int{3, 0, 1, 2} { // right, left, up, down
+		if dpad&(1<<uint(i)) != 0 {
+			b[pos] = ' '
+		}
+	}
+	for i, pos := range []int{5, 7, 9, 12} { // A, B, select, start
+		if btn&(1<<uint(i)) != 0 {
+			for ; pos < len(b) && b[pos] != ' '; pos++ {
+				b[pos] = ' '
+			}
+		}
+	}
+	return string(b)
+}
+
+// drawOSD draws the on-screen display using fill, which is given a
+// rectangle in display coordinates and a shade of the background
+// palette.
+func (lcd *display) drawOSD(fill func(x, y, w, h int, shade byte)) {
+	o := &lcd.osd
+	label := func(x, y int, s string) {
+		if s == "" {
+			return
+		}
+		w := len(s) * (glyphW + 1)
+		if x < 0 {
+			x += displayW - w // from the right
+		}
+		fill(x, y, w+1, glyphH+2, 3)
+		textPixels(x+1, y+1, s, func(x, y int) {
+			fill(x, y, 1, 1, 0)
+		})
+	}
+
+	if mv := lcd.movie; mv != nil {
+		label(1, 1, mv.status(lcd.memory.frame))
+	}
+	if o.showFPS {
+		label(-1, 1, fmt.Sprintf("%d FPS %d%%", o.fps,
+			o.fps*refreshTicks*100/ticksFreq))
+	}
+	y := displayH - 1 - osdLineH
+	if o.showInput {
+		label(-1, y, inputText(lcd.dpadBits, lcd.btnBits))
+		y -= osdLineH
+	}
+	texts := o.current()
+	for i := len(texts) - 1; i >= 0; i-- {
+		label(1, y, texts[i])
+		y -= osdLineH
+	}
+}
+
+// showOSD draws the on-screen display over the screen.
+func (lcd *display) showOSD() {
+	if lcd.osd.show {
+		lcd.drawOSD(func(x, y, w, h int, shade byte) {
+			lcd.fillRect(x, y, w, h, lcd.pal[shade])
+		})
+	}
+}
+
+// drawOSDImage draws the on-screen display over an image of the
+// frame enlarged by scale, as made by frameImage.
+func (lcd *display) drawOSDImage(img *image.Paletted, scale int) {
+	lcd.drawOSD(func(x, y, w, h int, shade byte) {
+		for j := y * scale; j < (y+h)*scale && j < displayH*scale; j++ {
+			for i := x * scale; i < (x+w)*scale && i < displayW*scale; i++ {
+				if i >= 0 && j >= 0 {
+					img.Pix[j*img.Stride+i] = shade
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,209 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Each pixel of a frame holds its shade (0-3, after the BGP or OBP
+// registers are applied) in the low two bits, and the layer it was
+// drawn by in the next two.
+const (
+	layerBG = iota
+	layerWindow
+	layerOBJ0
+	layerOBJ1
+)
+
+const defaultPalette = "green"
+
+var layerNames = [...]string{"background", "window", "sprites"}
+
+// The colours mixed in to tell the layers apart, indexed by layer.
+var layerTints = [4]uint32{0x0000FF, 0x00FF00, 0xFF0000, 0xFF00FF}
+
+// A palette gives the colours of the four shades for the background
+// and window, and for sprites using OBP0 and OBP1, like the CGB's
+// palettes for DMG games.
+type palette [3][4]image.RGBAColor
+
+func rgb(x uint32) image.RGBAColor {
+	return image.RGBAColor{byte(x >> 16), byte(x >> 8), byte(x), 0xFF}
+}
+
+func shades(c0, c1, c2, c3 uint32) [4]image.RGBAColor {
+	return [4]image.RGBAColor{rgb(c0), rgb(c1), rgb(c2), rgb(c3)}
+}
+
+func mono(c0, c1, c2, c3 uint32) palette {
+	s := shades(c0, c1, c2, c3)
+	return palette{s, s, s}
+}
+
+// The built-in palettes. Those named after CGB colours are the ones
+// chosen with button combinations when starting a DMG game on a CGB.
+var palettes = map[string]palette{
+	"green":     mono(0x9BBC0F, 0x8BAC0F, 0x306230, 0x0F380F),
+	"grey":      mono(0xFFFFFF, 0xAAAAAA, 0x555555, 0x000000),
+	"pocket":    mono(0xC4CFA1, 0x8B956D, 0x4D533C, 0x1F1F1F),
+	"light":     mono(0x00B581, 0x009A71, 0x00694A, 0x004F3B),
+	"cgb-brown": mono(0xFFFFFF, 0xFFAD63, 0x843100, 0x000000),
+	"cgb-pastel": palette{
+		shades(0xFFFFA5, 0xFF9494, 0x9494FF, 0x000000),
+		shades(0xFFFFA5, 0xFF9494, 0x9494FF, 0x000000),
+		shades(0xFFFFA5, 0xFF9494, 0x9494FF, 0x000000)},
+	"cgb-green": palette{
+		shades(0xFFFFFF, 0x7BFF31, 0x0063C5, 0x000000),
+		shades(0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000),
+		shades(0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000)},
+	"cgb-blue": palette{
+		shades(0xFFFFFF, 0x63A5FF, 0x0000FF, 0x000000),
+		shades(0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000),
+		shades(0xFFFFFF, 0x7BFF31, 0x008400, 0x000000)},
+	"cgb-red": palette{
+		shades(0xFFFFFF, 0xFF8484, 0x943A3A, 0x000000),
+		shades(0xFFFFFF, 0x7BFF31, 0x008400, 0x000000),
+		shades(0xFFFFFF, 0x63A5FF, 0x0000FF, 0x000000)},
+	"cgb-yellow": palette{
+		shades(0xFFFFFF, 0xFFFF00, 0x7B4A00, 0x000000),
+		shades(0xFFFFFF, 0x63A5FF, 0x0000FF, 0x000000),
+		shades(0xFFFFFF, 0x7BFF31, 0x008400, 0x000000)},
+	"cgb-inverted": mono(0x000000, 0x008484, 0xFFDE00, 0xFFFFFF),
+}
+
+// parsePalette reads 4 colours (used for everything) or 12 (for the
+// background, OBJ0 and OBJ1 in turn) given as hex RGB values.
+func parsePalette(s string) (p palette, err interface{}) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 && len(fields) != 12 {
+		return p, "a palette needs 4 or 12 colours"
+	}
+	for i := 0; i < 12; i++ {
+		f := fields[i%len(fields)]
+		f = strings.TrimLeft(strings.ToLower(f), "#")
+		if strings.HasPrefix(f, "0x") {
+			f = f[2:]
+		}
+		x, e := strconv.Btoui64(f, 16)
+		if e != nil || len(f) != 6 {
+			return p, fmt.Sprintf("bad colour '%s'", fields[i%len(fields)])
+		}
+		p[i/4][i%4] = rgb(uint32(x))
+	}
+	return
+}
+
+// lookupPalette finds a palette defined in the configuration file, or
+// one of the built-in ones.
+func lookupPalette(cfg *Config, name string) (p palette, ok bool) {
+	if def, found := cfg.Palettes[name]; found {
+		if p, err := parsePalette(def); err == nil {
+			return p, true
+		}
+	}
+	p, ok = palettes[name]
+	return
+}
+
+// paletteNames lists all palettes, in the order they are cycled.
+func paletteNames(cfg *Config) []string {
+	var names []string
+	for name := range palettes {
+		names = append(names, name)
+	}
+	for name := range cfg.Palettes {
+		if _, ok := palettes[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// romPalette chooses the palette for the ROM: one given for it in
+// the configuration file (by its checksums, as in save file names,
+// or its header checksum alone), or else Config.Palette.
+func (m *memory) romPalette() string {
+	cfg := m.config
+	for _, key := range []string{
+		fmt.Sprintf("%02X-%04X", m.rom.headerChecksum(),
+			m.rom.globalChecksum()),
+		fmt.Sprintf("%02X", m.rom.headerChecksum()),
+	} {
+		if name, ok := cfg.ROMPalettes[key]; ok {
+			return name
+		}
+	}
+	if cfg.Palette != "" {
+		return cfg.Palette
+	}
+	return defaultPalette
+}
+
+// initPalette sets the palette chosen for the ROM.
+func (lcd *display) initPalette() {
+	name := lcd.romPalette()
+	if !lcd.setPalette(name) {
+		lcd.error("unknown palette '%s'", name)
+		lcd.setPalette(defaultPalette)
+	}
+}
+
+// setPalette switches to the named palette, keeping the colour of
+// each kind of pixel in colors (indexed like the frame) and their
+// screen values in pal.
+func (lcd *display) setPalette(name string) bool {
+	p, ok := lookupPalette(lcd.config, name)
+	if !ok {
+		return false
+	}
+	lcd.palName = name
+	for i := range lcd.colors {
+		sub := 0
+		switch i >> 2 {
+		case layerOBJ0:
+			sub = 1
+		case layerOBJ1:
+			sub = 2
+		}
+		lcd.colors[i] = p[sub][i&3]
+		if lcd.tint {
+			c := mix(rgbOf(lcd.colors[i]), layerTints[i>>2], 112)
+			lcd.colors[i] = rgb(c)
+		}
+	}
+	if lcd.screen != nil {
+		for i, c := range lcd.colors {
+			lcd.pal[i] = lcd.screen.mapColor(c)
+		}
+	}
+	return true
+}
+
+// colorModel returns the colours of the pixels in a frame, for
+// making images of it.
+func (lcd *display) colorModel() image.PalettedColorModel {
+	m := make(image.PalettedColorModel, len(lcd.colors))
+	for i, c := range lcd.colors {
+		m[i] = c
+	}
+	return m
+}
+
+// nextPalette returns the name of the palette after the current one.
+func (lcd *display) nextPalette() string {
+	names := paletteNames(lcd.config)
+	for i, name := range names {
+		if name == lcd.palName && i+1 < len(names) {
+			return names[i+1]
+		}
+	}
+	return names[0]
+}
@@ -0,0 +1,357 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+// The I/O registers are kept in high RAM, with the side effects of
+// writing them (and the values of those read from elsewhere) handled
+// here.
+
+const (
+	portJOYP = 0xFF00
+	portSB   = 0xFF01
+	portSC   = 0xFF02
+	portDIV  = 0xFF04
+	portTIMA = 0xFF05
+	portTMA  = 0xFF06
+	portTAC  = 0xFF07
+	portIF   = 0xFF0F
+	portNR10 = 0xFF10
+	portNR11 = 0xFF11
+	portNR12 = 0xFF12
+	portNR13 = 0xFF13
+	portNR14 = 0xFF14
+	portNR21 = 0xFF16
+	portNR22 = 0xFF17
+	portNR23 = 0xFF18
+	portNR24 = 0xFF19
+	portNR30 = 0xFF1A
+	portNR31 = 0xFF1B
+	portNR32 = 0xFF1C
+	portNR33 = 0xFF1D
+	portNR34 = 0xFF1E
+	portNR41 = 0xFF20
+	portNR42 = 0xFF21
+	portNR43 = 0xFF22
+	portNR44 = 0xFF23
+	portNR50 = 0xFF24
+	portNR51 = 0xFF25
+	portNR52 = 0xFF26
+	portWAVE = 0xFF30
+	portLCDC = 0xFF40
+	portSTAT = 0xFF41
+	portSCY  = 0xFF42
+	portSCX  = 0xFF43
+	portLY   = 0xFF44
+	portLYC  = 0xFF45
+	portDMA  = 0xFF46
+	portBGP  = 0xFF47
+	portOBP0 = 0xFF48
+	portOBP1 = 0xFF49
+	portWY   = 0xFF4A
+	portWX   = 0xFF4B
+	portIE   = 0xFFFF
+)
+
+const (
+	vblankAddr    = 0x0040
+	lcdStatusAddr = 0x0048
+	timerAddr     = 0x0050
+	serialAddr    = 0x0058
+	joypadAddr    = 0x0060
+)
+
+const (
+	divOverflow = 64
+	serialTicks = 8 * 128 // to send a byte at 8192 bits per second
+)
+
+func (m *memory) initPorts() {
+	m.writePort(portJOYP, 0x30)
+	m.writePort(portSC, 0x7E)
+	m.writePort(portNR10, 0x80)
+	m.writePort(portNR11, 0xBF)
+	m.writePort(portNR12, 0xF3)
+	m.writePort(portNR14, 0x24) //0xB4)
+	m.writePort(portNR21, 0x3F)
+	m.writePort(portNR24, 0x2F) //0xBF)
+	m.writePort(portNR30, 0x7F)
+	m.writePort(portNR31, 0xFF)
+	m.writePort(portNR32, 0x9F)
+	m.writePort(portNR33, 0xBF)
+	m.writePort(portNR41, 0xFF)
+	m.writePort(portNR44, 0x2F) //0xBF)
+	m.writePort(portNR50, 0x77)
+	m.writePort(portNR51, 0xF3)
+	m.writePort(portNR52, 0xF1)
+	m.writePort(portLCDC, 0x91)
+	m.writePort(portBGP, 0xFC)
+	m.writePort(portOBP0, 0xFF)
+	m.writePort(portOBP1, 0xFF)
+}
+
+func (m *memory) readPort(addr uint16) byte {
+	x := m.hram[addr-0xFF00]
+	switch addr {
+	case portJOYP:
+		x = 0xC0 | x&0x30 | m.joypLines()
+	case portNR52:
+		x &= 0x80
+		if m.audio.ch1.active {
+			x |= 0x01
+		}
+		if m.audio.ch2.active {
+			x |= 0x02
+		}
+		if m.audio.ch3.active {
+			x |= 0x04
+		}
+		if m.audio.ch4.active {
+			x |= 0x08
+		}
+	}
+	return x
+}
+
+func (m *memory) writePort(addr uint16, x byte) {
+	if m.vgm != nil && isSoundPort(addr) {
+		m.vgm.write(m.ticks, addr, x)
+	}
+	switch addr {
+	case portJOYP:
+		// Only the select bits are stored; the rest is read
+		// from the buttons as they are at the time.
+		old := m.joypLines()
+		m.hram[addr-0xFF00] = x & 0x30
+		m.joypadInterrupt(old)
+		return
+	case portSC:
+		// Nothing is ever on the other end of the link cable, so
+		// a transfer on the internal clock receives 0xFF (see
+		// serialStep), and one on the external clock never starts.
+		// The unused bits read as 1.
+		x = x&0x81 | 0x7E
+		if x == 0xFF {
+			m.serialTicks = serialTicks
+		}
+	case portDIV:
+		x = 0
+	case portTAC:
+		switch x & 3 {
+		case 0:
+			m.timaOverflow = 256
+		case 1:
+			m.timaOverflow = 4
+		case 2:
+			m.timaOverflow = 16
+		case 3:
+			m.timaOverflow = 64
+		}
+		m.timaTicks = 0
+	case portNR10:
+		m.audio.ch1.sweepTime = int(x>>4) & 3
+		m.audio.ch1.sweepDir = 1
+		if x&0x08 == 0x08 {
+			m.audio.ch1.sweepDir = -1
+		}
+		m.audio.ch1.sweepShift = uint(x & 3)
+	case portNR11:
+		m.audio.ch1.waveDuty = int(x >> 6)
+		m.audio.ch1.length = int(x & 0x3F)
+	case portNR12:
+		m.audio.ch1.volumeInit = int(x >> 4)
+		m.audio.ch1.volumeDir = 1
+		if x&0x08 == 0 {
+			m.audio.ch1.volumeDir = -1
+		}
+		m.audio.ch1.volumeTime = int(x & 0x07)
+		if m.audio.ch1.volumeInit == 0 {
+			m.audio.ch1.volume = 0
+		}
+	case portNR13:
+		freq := int(m.hram[portNR14-0xFF00]&0x07) << 8
+		freq |= int(x)
+		m.audio.ch1.freq = 131072 / (2048 - freq)
+	case portNR14:
+		m.audio.ch1.init = x&0x80 == 0x80
+		m.audio.ch1.loop = x&0x40 == 0
+		freq := int(m.hram[portNR13-0xFF00])
+		freq |= int(x&0x07) << 8
+		m.audio.ch1.freq = 131072 / (2048 - freq)
+	case portNR21:
+		m.audio.ch2.waveDuty = int(x >> 6)
+		m.audio.ch2.length = int(x & 0x3F)
+	case portNR22:
+		m.audio.ch2.volumeInit = int(x >> 4)
+		m.audio.ch2.volumeDir = 1
+		if x&0x08 == 0 {
+			m.audio.ch2.volumeDir = -1
+		}
+		m.audio.ch1.volumeTime = int(x & 0x07)
+		if m.audio.ch2.volumeInit == 0 {
+			m.audio.ch2.volume = 0
+		}
+	case portNR23:
+		freq := int(m.hram[portNR24-0xFF00]&0x07) << 8
+		freq |= int(x)
+		m.audio.ch2.freq = 131072 / (2048 - freq)
+	case portNR24:
+		m.audio.ch2.init = x&0x80 == 0x80
+		m.audio.ch2.loop = x&0x40 == 0
+		freq := int(m.hram[portNR23-0xFF00])
+		freq |= int(x&0x07) << 8
+		m.audio.ch2.freq = 131072 / (2048 - freq)
+	case portNR30:
+		m.audio.ch3.on = x&0x80 == 0x80
+	case portNR31:
+		m.audio.ch3.length = int(x)
+	case portNR32:
+		m.audio.ch3.level = int(x>>5) & 0x03
+	case portNR33:
+		freq := int(m.hram[portNR34-0xFF00]&0x07) << 8
+		freq |= int(x)
+		m.audio.ch3.freq = 65536 / (2048 - freq)
+	case portNR34:
+		m.audio.ch3.init = x&0x80 == 0x80
+		m.audio.ch3.loop = x&0x40 == 0
+		freq := int(m.hram[portNR33-0xFF00])
+		freq |= int(x&0x07) << 8
+		m.audio.ch3.freq = 65536 / (2048 - freq)
+	case portNR41:
+		m.audio.ch4.length = int(x & 0x3F)
+	case portNR42:
+		m.audio.ch4.volumeInit = int(x >> 4)
+		m.audio.ch4.volumeDir = 1
+		if x&0x08 == 0 {
+			m.audio.ch4.volumeDir = -1
+		}
+		m.audio.ch4.volumeTime = int(x & 0x07)
+		if m.audio.ch4.volumeInit == 0 {
+			m.audio.ch4.volume = 0
+		}
+	case portNR43:
+		m.audio.ch4.shiftClockFreq = uint(x >> 4)
+		m.audio.ch4.counterStepWidth = 15
+		if x&0x08 == 0x08 {
+			m.audio.ch4.counterStepWidth = 7
+		}
+		m.audio.ch4.dividingRatio = int(x & 0x07)
+	case portNR44:
+		m.audio.ch4.init = x&0x80 == 0x80
+		m.audio.ch4.loop = x&0x40 == 0
+	case portNR50:
+		//m.audio.vinL = x&0x80 == 0x80
+		m.audio.volL = int16(x&0x70) >> 4
+		//m.audio.vinR = x&0x08 == 0x08
+		m.audio.volR = int16(x & 0x07)
+	case portNR51:
+		m.audio.ch1L = int16(x) & 1
+		m.audio.ch2L = int16(x>>1) & 1
+		m.audio.ch3L = int16(x>>2) & 1
+		m.audio.ch4L = int16(x>>3) & 1
+		m.audio.ch1R = int16(x>>4) & 1
+		m.audio.ch2R = int16(x>>5) & 1
+		m.audio.ch3R = int16(x>>6) & 1
+		m.audio.ch4R = int16(x>>7) & 1
+	case portNR52:
+		enable := x&0x80 == 0x80
+		if enable != m.audio.enable {
+			m.audio.pause(!enable)
+		}
+	case portLCDC:
+		m.lcd.enable = x&0x80 != 0
+		m.lcd.windowMap = x&0x40 != 0
+		m.lcd.windowEnable = x&0x20 != 0
+		m.lcd.tileData = x&0x10 != 0
+		m.lcd.bgMap = x&0x08 != 0
+		m.lcd.spriteSize = x&0x04 != 0
+		m.lcd.spriteEnable = x&0x02 != 0
+		m.lcd.bgEnable = x&0x01 != 0
+	case portSTAT:
+		m.lcd.lycInterrupt = x&0x40 != 0
+		m.lcd.oamInterrupt = x&0x20 != 0
+		m.lcd.vblankInterrupt = x&0x10 != 0
+		m.lcd.hblankInterrupt = x&0x08 != 0
+	case portLY:
+		m.lcd.ly = 0
+		m.lcd.clock = 0
+		x = 0
+	case portSCY:
+		m.lcd.scy = x
+	case portSCX:
+		m.lcd.scx = x
+	case portWY:
+		m.lcd.wy = x
+	case portWX:
+		m.lcd.wx = x
+	case portBGP:
+		m.lcd.bgp[0] = x & 3
+		m.lcd.bgp[1] = (x >> 2) & 3
+		m.lcd.bgp[2] = (x >> 4) & 3
+		m.lcd.bgp[3] = (x >> 6)
+	case portOBP0:
+		m.lcd.obp[0][0] = x & 3
+		m.lcd.obp[0][1] = (x >> 2) & 3
+		m.lcd.obp[0][2] = (x >> 4) & 3
+		m.lcd.obp[0][3] = x >> 6
+	case portOBP1:
+		m.lcd.obp[1][0] = x & 3
+		m.lcd.obp[1][1] = (x >> 2) & 3
+		m.lcd.obp[1][2] = (x >> 4) & 3
+		m.lcd.obp[1][3] = x >> 6
+	case portDMA:
+		src := uint16(x) << 8
+		m.dma(src)
+	}
+	m.hram[addr-0xFF00] = x
+}
+
+func (m *memory) updateTimers(t int) {
+	m.ticks += int64(t)
+	m.divTicks += t
+	if m.divTicks > divOverflow {
+		d := m.divTicks / divOverflow
+		m.hram[0x04] += byte(d)
+		m.divTicks -= d * divOverflow
+	}
+	m.serialStep(t)
+	if m.hram[0x07]&4 == 0 {
+		return
+	}
+	m.timaTicks += t
+	if m.timaTicks > m.timaOverflow {
+		d := m.timaTicks / m.timaOverflow
+		x := int(m.hram[0x05]) + d
+		if x > 0xFF {
+			m.hram[0x05] = m.hram[0x06] + byte(x)
+			m.hram[0x0F] |= 0x04
+		} else {
+			m.hram[0x05] = byte(x)
+		}
+		m.timaTicks -= d * m.timaOverflow
+	}
+}
+
+// serialStep finishes a link cable transfer once it has taken long
+// enough.
+func (m *memory) serialStep(t int) {
+	if m.serialTicks <= 0 {
+		return
+	}
+	if m.serialTicks -= t; m.serialTicks <= 0 {
+		if m.serial != nil {
+			m.serial.Write([]byte{m.hram[portSB-0xFF00]})
+		}
+		m.hram[portSB-0xFF00] = 0xFF
+		m.hram[portSC-0xFF00] = 0x7E
+		m.hram[portIF-0xFF00] |= 0x08
+	}
+}
+
+func (m *memory) dma(src uint16) {
+	for i := 0; i < 0xA0; i++ {
+		m.oam[i] = m.Read(src)
+		src++
+	}
+}
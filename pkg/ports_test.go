@@ -0,0 +1,37 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import "testing"
+
+func TestSerialControl(t *testing.T) {
+	m := new(memory)
+	for _, x := range []struct {
+		write, read byte
+		busy        bool
+	}{
+		{0x00, 0x7E, false},
+		{0x01, 0x7F, false},
+		{0x80, 0xFE, false}, // waits for a clock which never comes
+		{0x81, 0xFF, true},
+	} {
+		m.serialTicks = 0
+		m.writePort(portSC, x.write)
+		if got := m.readPort(portSC); got != x.read ||
+			(m.serialTicks > 0) != x.busy {
+			t.Errorf("wrote %02X: read %02X, busy %t; want %02X, %t",
+				x.write, got, m.serialTicks > 0, x.read, x.busy)
+		}
+	}
+
+	m.serialStep(serialTicks)
+	if sc, sb := m.readPort(portSC), m.readPort(portSB); sc != 0x7E ||
+		sb != 0xFF {
+		t.Errorf("after a transfer: SC %02X, SB %02X", sc, sb)
+	}
+	if m.hram[portIF-0xFF00]&0x08 == 0 {
+		t.Error("no serial interrupt")
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+// internalRAM is the RAM in the Game Boy itself: work RAM at C000h
+// (echoed at E000h), and high RAM from FF00h, the bottom of which
+// holds the I/O registers (see readPort) and the top IE.
+type internalRAM struct {
+	wram [0x2000]byte
+	hram [0x100]byte
+}
+
+func (r *internalRAM) readWorkRAM(addr uint16) byte {
+	return r.wram[addr-0xC000]
+}
+
+func (r *internalRAM) writeWorkRAM(addr uint16, x byte) {
+	r.wram[addr-0xC000] = x
+}
@@ -15,6 +15,15 @@ const (
 	mbc1
 	mbc2
 	mbc3
+	mbc5
+	mbc7
+	mbcCamera
+	mbcHuC1
+	mbcHuC3
+
+	// MBC1 wired for multicarts, which is not told apart in the
+	// header.
+	mbc1m
 )
 
 type romImage []byte
@@ -43,6 +52,22 @@ func (rom romImage) checkLogo() bool {
 	return bytes.Compare(rom[0x0104:0x0134], nintendoLogo) == 0
 }
 
+// isMulticart guesses whether an MBC1 ROM is a multicart. These are
+// 1M, made of 256K games which each have their own header, so the
+// Nintendo logo is found again at a 256K boundary.
+func (rom romImage) isMulticart() bool {
+	if len(rom) != 0x100000 {
+		return false
+	}
+	for base := 0x40000; base < len(rom); base += 0x40000 {
+		logo := rom[base+0x0104 : base+0x0134]
+		if bytes.Compare(logo, nintendoLogo) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (rom romImage) title() string {
 	raw := []byte(rom)
 	for i := 0x0134; i < 0x0144; i++ {
@@ -71,6 +96,8 @@ func (rom romImage) mbcType() (mbc int, err interface{}) {
 		fallthrough
 	case 0x06:
 		mbc = mbc2
+	case 0x0F:
+		fallthrough
 	case 0x10:
 		fallthrough
 	case 0x11:
@@ -79,6 +106,26 @@ func (rom romImage) mbcType() (mbc int, err interface{}) {
 		fallthrough
 	case 0x13:
 		mbc = mbc3
+	case 0x19:
+		fallthrough
+	case 0x1A:
+		fallthrough
+	case 0x1B:
+		fallthrough
+	case 0x1C:
+		fallthrough
+	case 0x1D:
+		fallthrough
+	case 0x1E:
+		mbc = mbc5
+	case 0x22:
+		mbc = mbc7
+	case 0xFC:
+		mbc = mbcCamera
+	case 0xFE:
+		mbc = mbcHuC3
+	case 0xFF:
+		mbc = mbcHuC1
 	default:
 		err = fmt.Sprintf("unknown memory bank controller type (%02Xh)",
 			rom[0x0147])
@@ -105,6 +152,20 @@ func (rom romImage) hasRAM() bool {
 	case 0x12:
 		fallthrough
 	case 0x13:
+		fallthrough
+	case 0x1A:
+		fallthrough
+	case 0x1B:
+		fallthrough
+	case 0x1D:
+		fallthrough
+	case 0x1E:
+		fallthrough
+	case 0xFC:
+		fallthrough
+	case 0xFE:
+		fallthrough
+	case 0xFF:
 		return true
 	}
 	return false
@@ -123,49 +184,43 @@ func (rom romImage) hasBattery() bool {
 	case 0x10:
 		fallthrough
 	case 0x13:
+		fallthrough
+	case 0x1B:
+		fallthrough
+	case 0x1E:
+		fallthrough
+	case 0x22:
+		fallthrough
+	case 0xFC:
+		fallthrough
+	case 0xFE:
+		fallthrough
+	case 0xFF:
 		return true
 	}
 	return false
 }
 
-func (rom romImage) banks() (n int, err interface{}) {
-	switch rom[0x0148] {
-	case 0x00:
-		n = 0
-	case 0x01:
-		n = 4
-	case 0x02:
-		n = 8
-	case 0x03:
-		n = 16
-	case 0x04:
-		n = 32
-	case 0x05:
-		n = 64
-	case 0x06:
-		n = 128
-	case 0x08:
-		n = 256
-	case 0x52:
-		n = 72
-	case 0x53:
-		n = 80
-	case 0x54:
-		n = 96
-	default:
-		err = fmt.Sprintf("invalid ROM banks (%02Xh)", rom[0x0148])
-	}
-	return
+func (rom romImage) hasTimer() bool {
+	return rom[0x0147] == 0x0F || rom[0x0147] == 0x10
+}
+
+func (rom romImage) hasRumble() bool {
+	return rom[0x0147] >= 0x1C && rom[0x0147] <= 0x1E
 }
 
 func (rom romImage) ramSize() int {
-	switch rom[0x0149] & 3 {
+	switch rom[0x0149] {
 	case 1:
 		return 2048
 	case 2:
 		return 8192
 	case 3:
 		return 32768
+	case 4:
+		return 131072
+	case 5:
+		return 65536
 	}
 	return 0
 }
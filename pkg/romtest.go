@@ -0,0 +1,366 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"image/png"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const defaultTestFrames = 600
+
+// A ROMTest is a regression check for a ROM image. The ROM is run
+// without any devices for a number of frames, or until a condition
+// is met, and its last frame is then compared with what is expected.
+//
+// Tests always use the grey palette, so that hashes and reference
+// images do not depend on the configuration.
+type ROMTest struct {
+	Name   string // for reports
+	ROM    string
+	Frames int // run, or the most run if there is a condition
+
+	// Conditions which end the test when met, checked before each
+	// instruction: PC reaching UntilPC, or the byte at UntilAddr
+	// holding UntilValue. Zero addresses are not used. The frame
+	// in which a condition is met is finished, so the picture is
+	// whole, and a test with a condition fails if it is never met.
+	UntilPC    uint16
+	UntilAddr  uint16
+	UntilValue byte
+
+	Input []Press // buttons held, in place of the controls
+
+	Hash      string // of the last frame, as in ROMTestResult
+	Reference string // a PNG file the last frame should look like
+	Output    string // a PNG file to save the last frame in, if any
+}
+
+// A Press holds buttons ("a", "start", "up", ...) down from frame
+// From to frame To, inclusive. The first frame is 0.
+type Press struct {
+	From, To int
+	Buttons  []string
+}
+
+// A ROMTestResult is the outcome of a ROMTest.
+type ROMTestResult struct {
+	Pass   bool
+	Reason string // why it failed
+	Frames int    // run
+	Hash   string // SHA-1 of the shades of the last frame, in hex
+	Diff   int    // pixels unlike the reference image
+}
+
+// RunROMTest runs a test. An error is returned only if the test
+// could not be run at all (because the ROM or reference image could
+// not be read, for instance).
+func RunROMTest(t *ROMTest, cfg Config) (*ROMTestResult, os.Error) {
+	cfg.Palette = "grey"
+	cfg.ROMPalettes = nil
+	sys, err := startHeadless(t.ROM, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer sys.audio.close()
+
+	held, err := t.inputFrames()
+	if err != nil {
+		return nil, err
+	}
+	var stop func(sys *cpu) bool
+	switch {
+	case t.UntilPC != 0 && t.UntilAddr != 0:
+		stop = func(sys *cpu) bool {
+			return sys.pc == t.UntilPC ||
+				sys.readByte(t.UntilAddr) == t.UntilValue
+		}
+	case t.UntilPC != 0:
+		stop = func(sys *cpu) bool { return sys.pc == t.UntilPC }
+	case t.UntilAddr != 0:
+		stop = func(sys *cpu) bool {
+			return sys.readByte(t.UntilAddr) == t.UntilValue
+		}
+	}
+	frames := t.Frames
+	if frames <= 0 {
+		frames = defaultTestFrames
+	}
+
+	res := new(ROMTestResult)
+	stopped := false
+	for ; res.Frames < frames && !stopped; res.Frames++ {
+		sys.held = 0xFF
+		if res.Frames < len(held) {
+			sys.held = held[res.Frames]
+		}
+		stopped = sys.runFrameUntil(stop)
+	}
+
+	lcd := sys.lcd
+	res.Hash = lcd.frameHash()
+	fail := func(format string, args ...interface{}) {
+		if res.Reason == "" {
+			res.Reason = fmt.Sprintf(format, args...)
+		}
+	}
+	if stop != nil && !stopped {
+		fail("condition not met in %d frames", frames)
+	}
+	if t.Hash != "" && !strings.EqualFold(t.Hash, res.Hash) {
+		fail("hash %s, expected %s", res.Hash, t.Hash)
+	}
+	if t.Reference != "" {
+		if res.Diff, err = lcd.diffPNG(t.Reference); err != nil {
+			return nil, err
+		}
+		if res.Diff > 0 {
+			fail("%d pixels differ from %s", res.Diff, t.Reference)
+		}
+	}
+	if t.Output != "" {
+		if err = writePNG(t.Output, lcd.frameImage(1)); err != nil {
+			return nil, err
+		}
+	}
+	res.Pass = res.Reason == ""
+	return res, nil
+}
+
+// inputFrames returns the buttons held in each frame, as latched by
+// latchInput, up to the last frame with any held.
+func (t *ROMTest) inputFrames() ([]byte, os.Error) {
+	var held []byte
+	for _, p := range t.Input {
+		var mask byte
+		for _, name := range p.Buttons {
+			act, e := parseAction(name)
+			if e != nil || act > actStart {
+				return nil, fmt.Errorf("not a button: '%s'", name)
+			}
+			mask |= 1 << uint(act)
+		}
+		for n := p.From; n <= p.To; n++ {
+			for len(held) <= n {
+				held = append(held, 0xFF)
+			}
+			held[n] &^= mask
+		}
+	}
+	return held, nil
+}
+
+// frameHash returns the SHA-1 of the shade of each pixel in the last
+// complete frame, which does not depend on the palette or layers.
+func (lcd *display) frameHash() string {
+	var shades [displayW * displayH]byte
+	for i, b := range lcd.shown {
+		shades[i] = b & 3
+	}
+	h := sha1.New()
+	h.Write(shades[:])
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+// diffPNG counts the pixels in the last complete frame with a different shade
+// from the image in a PNG file, which must be the size of the
+// screen. Shades are judged by brightness, as in the grey palette.
+func (lcd *display) diffPNG(name string) (int, os.Error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+
+	b := img.Bounds()
+	if b.Dx() != displayW || b.Dy() != displayH {
+		return 0, fmt.Errorf("%s: not %dx%d", name, displayW, displayH)
+	}
+	diff := 0
+	for y := 0; y < displayH; y++ {
+		for x := 0; x < displayW; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			luma := (r*299 + g*587 + bl*114) / 1000 >> 8
+			shade := byte((255 - luma + 42) / 85)
+			if shade != lcd.shown[y*displayW+x]&3 {
+				diff++
+			}
+		}
+	}
+	return diff, nil
+}
+
+// ReadROMTests reads a list of tests. Each line is blank, a comment
+// starting with '#', or a ROM followed by options for its test:
+//
+//   tetris.gb     frames=300 press=120-125:start hash=3f1c...
+//   cpu_instrs.gb frames=4000 until-pc=0xC7D2 ref=cpu_instrs.png
+//   game.gb       until=0xA000:0x00 input=game.txt name=game-intro
+//
+// The options are name, frames, until-pc, until (an address and the
+// value to wait for), press (frames and buttons joined by '+', and
+// given any number of times), input (a file of presses, one to a
+// line, such as "120-125 start a"), hash and ref. Files are relative
+// to the list.
+func ReadROMTests(name string) ([]*ROMTest, os.Error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tests []*ROMTest
+	dir := path.Dir(name)
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err == os.EOF && line == "" {
+			break
+		} else if err != nil && err != os.EOF {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		t, e := parseROMTest(line, dir)
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, e)
+		}
+		tests = append(tests, t)
+	}
+	return tests, nil
+}
+
+func parseROMTest(line, dir string) (*ROMTest, interface{}) {
+	fields := strings.Fields(line)
+	t := &ROMTest{Name: fields[0], ROM: path.Join(dir, fields[0])}
+	for _, opt := range fields[1:] {
+		i := strings.Index(opt, "=")
+		if i < 0 {
+			return nil, fmt.Sprintf("expected: option=value, not '%s'", opt)
+		}
+		name, value := opt[:i], opt[i+1:]
+		var err interface{}
+		switch name {
+		case "name":
+			t.Name = value
+		case "frames":
+			t.Frames, err = strconv.Atoi(value)
+		case "until-pc":
+			t.UntilPC, err = parseAddr(value)
+		case "until":
+			parts := strings.Split(value, ":")
+			if len(parts) != 2 {
+				return nil, "expected: until=<address>:<value>"
+			}
+			if t.UntilAddr, err = parseAddr(parts[0]); err == nil {
+				var x uint16
+				x, err = parseAddr(parts[1])
+				if x > 0xFF {
+					err = fmt.Sprintf("not a byte: %s", parts[1])
+				}
+				t.UntilValue = byte(x)
+			}
+		case "press":
+			parts := strings.Split(value, ":")
+			if len(parts) != 2 {
+				return nil, "expected: press=<frames>:<buttons>"
+			}
+			var p Press
+			if p, err = parsePress(parts[0],
+				strings.Split(parts[1], "+")); err == nil {
+				t.Input = append(t.Input, p)
+			}
+		case "input":
+			err = t.readInput(path.Join(dir, value))
+		case "hash":
+			t.Hash = value
+		case "ref":
+			t.Reference = path.Join(dir, value)
+		default:
+			err = fmt.Sprintf("unknown option '%s'", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// readInput adds the presses in a file, one to a line.
+func (t *ROMTest) readInput(name string) interface{} {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadString('\n')
+		if err == os.EOF && line == "" {
+			break
+		} else if err != nil && err != os.EOF {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		p, e := parsePress(fields[0], fields[1:])
+		if e != nil {
+			return fmt.Errorf("%s:%d: %v", name, n, e)
+		}
+		t.Input = append(t.Input, p)
+	}
+	return nil
+}
+
+// parsePress parses a frame ("120") or range of frames ("120-125")
+// and the buttons held in them.
+func parsePress(frames string, buttons []string) (p Press, err interface{}) {
+	from, to := frames, frames
+	if i := strings.Index(frames, "-"); i >= 0 {
+		from, to = frames[:i], frames[i+1:]
+	}
+	if p.From, err = strconv.Atoi(from); err != nil {
+		return
+	}
+	if p.To, err = strconv.Atoi(to); err != nil {
+		return
+	}
+	if p.From < 0 || p.To < p.From {
+		return p, fmt.Sprintf("bad frames: %s", frames)
+	}
+	if len(buttons) == 0 {
+		return p, "no buttons given"
+	}
+	for _, b := range buttons {
+		if act, e := parseAction(b); e != nil || act > actStart {
+			return p, fmt.Sprintf("not a button: '%s'", b)
+		}
+	}
+	p.Buttons = buttons
+	return
+}
+
+func parseAddr(s string) (uint16, interface{}) {
+	x, err := strconv.Btoui64(s, 0)
+	if err != nil || x > 0xFFFF {
+		return 0, fmt.Sprintf("bad address: %s", s)
+	}
+	return uint16(x), nil
+}
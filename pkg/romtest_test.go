@@ -0,0 +1,55 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"testing"
+)
+
+func TestParseROMTest(t *testing.T) {
+	rt, err := parseROMTest("game.gb frames=90 until-pc=0x150 "+
+		"until=0xC000:7 press=2-3:a+up hash=abc ref=game.png", "tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.Name != "game.gb" || rt.ROM != "tests/game.gb" ||
+		rt.Reference != "tests/game.png" || rt.Hash != "abc" {
+		t.Errorf("got %+v", rt)
+	}
+	if rt.Frames != 90 || rt.UntilPC != 0x150 ||
+		rt.UntilAddr != 0xC000 || rt.UntilValue != 7 {
+		t.Errorf("got %+v", rt)
+	}
+	if len(rt.Input) != 1 || rt.Input[0].From != 2 || rt.Input[0].To != 3 {
+		t.Errorf("input %+v", rt.Input)
+	}
+
+	for _, line := range []string{
+		"game.gb frames",
+		"game.gb colour=red",
+		"game.gb until=0xC000:0x100",
+		"game.gb press=5-4:a",
+		"game.gb press=5:pause",
+	} {
+		if _, err := parseROMTest(line, "."); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+}
+
+func TestInputFrames(t *testing.T) {
+	rt := &ROMTest{Input: []Press{
+		{1, 2, []string{"a"}},
+		{2, 3, []string{"start", "right"}},
+	}}
+	held, err := rt.inputFrames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xFF, 0xEF, 0x6E, 0x7E}
+	if string(held) != string(want) {
+		t.Errorf("got % X, want % X", held, want)
+	}
+}
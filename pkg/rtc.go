@@ -0,0 +1,140 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	rtcHalt  = 0x40 // in the high day register
+	rtcCarry = 0x80 // set when the day counter overflows
+
+	// The clock is saved after the RAM in the format most other
+	// emulators use: the registers and the latched registers as
+	// 32-bit numbers, then the time of saving in seconds since
+	// 1970, as a 64-bit number (or a 32-bit one, in older files).
+	rtcSaveSize = 48
+)
+
+// The bits of each register which exist.
+var rtcMasks = [5]byte{0x3F, 0x3F, 0x1F, 0xFF, 0xC1}
+
+// An rtc is the clock in an MBC3 cartridge. It counts seconds,
+// minutes, hours and days (in 9 bits, with a carry when they
+// overflow) while the battery lasts, and is read through a copy
+// latched by the game.
+type rtc struct {
+	regs    [5]byte // seconds, minutes, hours, day low, day high
+	latched [5]byte
+	ticks   int // into the current second
+}
+
+func (r *rtc) tick(t int) {
+	if r.regs[4]&rtcHalt != 0 {
+		return
+	}
+	if r.ticks += t; r.ticks >= ticksFreq {
+		r.advance(int64(r.ticks / ticksFreq))
+		r.ticks %= ticksFreq
+	}
+}
+
+// advance moves the clock on by n seconds.
+func (r *rtc) advance(n int64) {
+	days := n / 86400
+	for n %= 86400; n > 0; n-- {
+		r.step()
+	}
+	if days > 0 {
+		r.addDays(int(days))
+	}
+}
+
+// step counts one second. A register set beyond its range counts on
+// to the top of its bits and wraps to 0 without carrying, as on the
+// chip.
+func (r *rtc) step() {
+	for i, limit := range []byte{60, 60, 24} {
+		r.regs[i] = (r.regs[i] + 1) & rtcMasks[i]
+		if r.regs[i] != limit {
+			return
+		}
+		r.regs[i] = 0
+	}
+	r.addDays(1)
+}
+
+func (r *rtc) addDays(n int) {
+	days := int(r.regs[4]&1)<<8 | int(r.regs[3]) + n
+	if days > 0x1FF {
+		r.regs[4] |= rtcCarry
+	}
+	r.regs[3] = byte(days)
+	r.regs[4] = r.regs[4]&^1 | byte(days>>8)&1
+}
+
+func (r *rtc) latch() {
+	r.latched = r.regs
+}
+
+func (r *rtc) read(reg int) byte {
+	return r.latched[reg]
+}
+
+func (r *rtc) write(reg int, x byte) {
+	x &= rtcMasks[reg]
+	if reg == 0 {
+		r.ticks = 0
+	}
+	r.regs[reg] = x
+	r.latched[reg] = x
+}
+
+func (r *rtc) save() []byte {
+	data := make([]byte, rtcSaveSize)
+	le := binary.LittleEndian
+	for i := range r.regs {
+		le.PutUint32(data[i*4:], uint32(r.regs[i]))
+		le.PutUint32(data[20+i*4:], uint32(r.latched[i]))
+	}
+	le.PutUint64(data[40:], uint64(time.Seconds()))
+	return data
+}
+
+// load restores the clock from what save returned, as it was when
+// saved, and returns when that was.
+func (r *rtc) load(data []byte) (then int64, err os.Error) {
+	le := binary.LittleEndian
+	switch len(data) {
+	case rtcSaveSize:
+		then = int64(le.Uint64(data[40:]))
+	case rtcSaveSize - 4:
+		then = int64(le.Uint32(data[40:]))
+	default:
+		return 0, fmt.Errorf("clock should be %d bytes (%d found)",
+			rtcSaveSize, len(data))
+	}
+	for i := range r.regs {
+		r.regs[i] = byte(le.Uint32(data[i*4:])) & rtcMasks[i]
+		r.latched[i] = byte(le.Uint32(data[20+i*4:])) & rtcMasks[i]
+	}
+	return then, nil
+}
+
+// catchUp moves the clock on by the time since then, as though the
+// battery had kept it running.
+func (r *rtc) catchUp(then int64) {
+	if now := time.Seconds(); now > then && r.regs[4]&rtcHalt == 0 {
+		r.advance(now - then)
+	}
+}
+
+func (r *rtc) stateFields() []interface{} {
+	return []interface{}{r.regs[:], r.latched[:], &r.ticks}
+}
@@ -0,0 +1,135 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+)
+
+const (
+	scopeLen   = 1024 // samples kept per channel
+	scopeLaneH = displayH / 4
+)
+
+// A scope records the recent output of each sound channel so that
+// it can be drawn over the display as a debugging aid.
+type scope struct {
+	wave [4][scopeLen]int16
+	pos  int
+	tmp  []int16
+}
+
+// mix renders channel n separately into a scratch buffer, records
+// it, then adds it to buf with the given panning.
+func (s *scope) mix(mix *mixer, n int, buf []int16, l, r int16) {
+	if cap(s.tmp) < len(buf) {
+		s.tmp = make([]int16, len(buf))
+	}
+	tmp := s.tmp[:len(buf)]
+	for f := 0; f < len(tmp); f++ {
+		tmp[f] = 0
+	}
+	mix.mixChannel(n, tmp, 1, 1)
+
+	pos := s.pos
+	for f := 0; f < len(tmp); f += 2 {
+		s.wave[n-1][pos] = tmp[f]
+		pos = (pos + 1) % scopeLen
+		buf[f] += tmp[f] * l
+		buf[f+1] += tmp[f+1] * r
+	}
+	if n == 4 {
+		s.pos = pos
+	}
+}
+
+// trigger finds a rising edge in the recorded samples for channel n
+// so that periodic waveforms are drawn steadily from frame to frame.
+func (s *scope) trigger(n int) int {
+	w := &s.wave[n]
+	for i := displayW; i < scopeLen; i++ {
+		p := (s.pos - i + scopeLen) % scopeLen
+		q := (p + scopeLen - 1) % scopeLen
+		if w[q] < 0 && w[p] >= 0 {
+			return p
+		}
+	}
+	return (s.pos - displayW + scopeLen) % scopeLen
+}
+
+// drawScope overlays one lane per channel showing the waveform,
+// frequency, volume envelope and remaining length.
+func (lcd *display) drawScope() {
+	mix := lcd.audio
+	s := mix.scope
+	for n := 0; n < 4; n++ {
+		top := n * scopeLaneH
+		mid := top + scopeLaneH/2 + 3
+
+		fg := lcd.pal[0]
+		if !mix.audible(n + 1) {
+			fg = lcd.pal[1]
+		}
+		lcd.fillRect(0, top, displayW, scopeLaneH, lcd.pal[3])
+		lcd.fillRect(0, top+scopeLaneH-1, displayW, 1, lcd.pal[2])
+
+		freq, vol, length, active := mix.channelInfo(n + 1)
+		state := "-"
+		if active {
+			state = "+"
+		}
+		remain := "---"
+		if length >= 0 {
+			remain = fmt.Sprintf("%03d", length)
+		}
+		lcd.drawText(1, top+1, fg, "%d%s %5dHZ V%02d L%s",
+			n+1, state, freq, vol, remain)
+
+		// volume bar along the right edge
+		h := vol * (scopeLaneH - 9) / 15
+		lcd.fillRect(displayW-3, top+scopeLaneH-2-h, 2, h, lcd.pal[1])
+
+		start := s.trigger(n)
+		for x := 0; x < displayW-4; x++ {
+			y := int(s.wave[n][(start+x)%scopeLen]) *
+				(scopeLaneH/2 - 5) / chvolmax
+			lcd.fillRect(x, mid-y, 1, 1, fg)
+		}
+	}
+}
+
+// channelInfo returns the state of channel n for display: the
+// frequency in Hz, the current volume (0-15), and the remaining
+// length in 256Hz steps (or -1 if the channel loops).
+func (mix *mixer) channelInfo(n int) (freq, vol, length int, active bool) {
+	var ch *sound
+	switch n {
+	case 1:
+		ch, freq = &mix.ch1.sound, mix.ch1.freq
+	case 2:
+		ch, freq = &mix.ch2.sound, mix.ch2.freq
+	case 3:
+		w := &mix.ch3
+		length = -1
+		if !w.loop {
+			length = 256 - w.length - w.clock
+		}
+		// scale the output level (0, 100%, 50%, 25%) to 0-15
+		vol = [4]int{0, 15, 7, 3}[w.level]
+		return w.freq, vol, length, w.active
+	case 4:
+		ch = &mix.ch4.sound
+		if mix.ch4.period > 0 {
+			freq = mix.rate / mix.ch4.period
+		}
+	default:
+		return
+	}
+	length = -1
+	if !ch.loop {
+		length = 64 - ch.length - ch.clock
+	}
+	return freq, ch.volume, length, ch.active
+}
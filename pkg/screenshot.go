@@ -0,0 +1,85 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"time"
+)
+
+// frameImage returns the last complete frame as an image, enlarged
+// by scale. Pixels keep their values from the frame (shade and
+// layer), with the colours of the current palette, so nothing is
+// lost by conversion.
+func (lcd *display) frameImage(scale int) *image.Paletted {
+	img := image.NewPaletted(displayW*scale, displayH*scale, lcd.colorModel())
+	for y := 0; y < displayH*scale; y++ {
+		row := lcd.shown[y/scale*displayW:]
+		pix := img.Pix[y*img.Stride:]
+		for x := 0; x < displayW*scale; x++ {
+			pix[x] = row[x/scale]
+		}
+	}
+	return img
+}
+
+func writePNG(name string, img image.Image) os.Error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// screenshotName returns an unused name for a screenshot, made from
+// the ROM title and the time.
+func (m *memory) screenshotName(ext string) string {
+	dir := m.config.ScreenshotDir
+	if dir == "" {
+		dir = m.config.SaveDir
+	}
+	base := path.Join(dir, fmt.Sprintf("%s-%s", m.rom.title(),
+		time.LocalTime().Format("20060102-150405")))
+	name := base + ext
+	for n := 2; ; n++ {
+		if _, err := os.Stat(name); err != nil {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	panic("unreachable")
+}
+
+// screenshot saves the last complete frame as a PNG file, and also at the
+// display scale if Config.ScreenshotScaled is set. The on-screen
+// display is left out unless Config.ScreenshotOSD is set. It returns
+// the name of the (first) file.
+func (lcd *display) screenshot() (name string, err os.Error) {
+	shot := func(scale int) *image.Paletted {
+		img := lcd.frameImage(scale)
+		if lcd.config.ScreenshotOSD && lcd.osd.show {
+			lcd.drawOSDImage(img, scale)
+		}
+		return img
+	}
+	name = lcd.screenshotName(".png")
+	if err = writePNG(name, shot(1)); err != nil {
+		return
+	}
+	if scale := lcd.config.Scale; lcd.config.ScreenshotScaled && scale > 1 {
+		scaled := name[:len(name)-len(".png")] +
+			fmt.Sprintf("-%dx.png", scale)
+		err = writePNG(scaled, shot(scale))
+	}
+	return
+}
@@ -0,0 +1,319 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"⚛sdl"
+	"unsafe"
+)
+
+// Start runs the ROM image at path in an SDL window until it quits,
+// or a Quit command is received on in. Any error is sent on out when
+// finished.
+func Start(path string, cfg Config, in <-chan interface{}, out chan<- interface{}) {
+	var err interface{}
+	defer func() {
+		out <- err
+	}()
+	err = start(path, &cfg, in, new(sdlFrontend))
+}
+
+// StartGBS plays a GBS file in an SDL window, starting at the given
+// track (numbered from 1, or 0 for the file's default). As with
+// Start, any error is sent on out when finished.
+func StartGBS(path string, track int, cfg Config, in <-chan interface{}, out chan<- interface{}) {
+	var err interface{}
+	defer func() {
+		out <- err
+	}()
+	err = startGBS(path, track, &cfg, in, new(sdlFrontend))
+}
+
+// sdlFrontend runs the emulator in an SDL window, with sound through
+// libao and input from the keyboard and a joystick.
+type sdlFrontend struct {
+	joy *sdl.Joystick
+}
+
+func (fe *sdlFrontend) init(cfg *Config) interface{} {
+	if sdl.Init(sdl.INIT_VIDEO|sdl.INIT_JOYSTICK) != 0 {
+		return sdl.GetError()
+	}
+	fe.joy = openJoystick(cfg)
+	return nil
+}
+
+func (fe *sdlFrontend) openScreen(cfg *Config, title string, w, h int) screen {
+	return newSDLScreen(cfg, title, w, h)
+}
+
+func (fe *sdlFrontend) openAudio(m *memory) (*mixer, interface{}) {
+	return newMixer(m)
+}
+
+func (fe *sdlFrontend) monitor(m *memory) {
+	m.monitorEvents()
+}
+
+func (fe *sdlFrontend) close() {
+	if fe.joy != nil {
+		fe.joy.Close()
+	}
+	sdl.Quit()
+}
+
+// sdlScreen is an SDL window.
+type sdlScreen struct {
+	*sdl.Surface
+	cfg *Config
+
+	// The surface last made for blit, and the pixels it wraps.
+	src    *sdl.Surface
+	srcPix *uint32
+}
+
+func newSDLScreen(cfg *Config, title string, w, h int) *sdlScreen {
+	s := &sdlScreen{cfg: cfg}
+	sdl.WM_SetCaption(title, "")
+	s.setMode(w, h)
+	sdl.ShowCursor(sdl.DISABLE)
+	return s
+}
+
+func (s *sdlScreen) setMode(w, h int) {
+	flags := uint32(sdl.DOUBLEBUF)
+	if s.cfg.Fullscreen {
+		flags |= sdl.FULLSCREEN
+	}
+	s.Surface = sdl.SetVideoMode(w, h, 0, flags)
+}
+
+func (s *sdlScreen) mapColor(c image.RGBAColor) uint32 {
+	return sdl.MapRGBA(s.Format, c.R, c.G, c.B, 0)
+}
+
+func (s *sdlScreen) fillRect(x, y, w, h int, color uint32) {
+	r := &sdl.Rect{int16(x), int16(y), uint16(w), uint16(h)}
+	s.FillRect(r, color)
+}
+
+func (s *sdlScreen) blit(pix []uint32, x, y, w, h int) {
+	if s.src == nil || s.srcPix != &pix[0] ||
+		int(s.src.W) != w || int(s.src.H) != h {
+		if s.src != nil {
+			s.src.Free()
+		}
+		s.srcPix = &pix[0]
+		s.src = sdl.CreateRGBSurfaceFrom(unsafe.Pointer(&pix[0]),
+			w, h, 32, w*4, 0xFF0000, 0xFF00, 0xFF, 0)
+	}
+	s.Blit(&sdl.Rect{int16(x), int16(y), 0, 0}, s.src, nil)
+}
+
+func (s *sdlScreen) setCaption(title string) {
+	sdl.WM_SetCaption(title, "")
+}
+
+func (s *sdlScreen) toggleFullScreen() {
+	sdl.WM_ToggleFullScreen(s.Surface)
+}
+
+func (s *sdlScreen) flip() {
+	s.Flip()
+}
+
+// monitorEvents runs in its own goroutine, turning SDL events into
+// input events. It touches nothing but the input map, which belongs
+// to it alone once started; the main loop acts on the events between
+// frames (see poll).
+func (m *memory) monitorEvents() {
+	for {
+		event := <-sdl.Events
+		switch ev := event.(type) {
+		case sdl.QuitEvent:
+			m.post(actQuit, true)
+		case sdl.KeyboardEvent:
+			m.updateKeys(&ev)
+		case sdl.JoyAxisEvent:
+			m.updateAxis(&ev)
+		case sdl.MouseMotionEvent:
+			m.updateMouse(&ev)
+		case sdl.JoyButtonEvent:
+			m.updateButtons(&ev)
+		case sdl.JoyHatEvent:
+			m.updateHat(&ev)
+		}
+	}
+}
+
+// sdlKeys translates SDL key codes to the emulator's.
+var sdlKeys = map[uint32]int{
+	sdl.K_BACKSPACE:    keyBackspace,
+	sdl.K_TAB:          keyTab,
+	sdl.K_RETURN:       keyReturn,
+	sdl.K_ESCAPE:       keyEscape,
+	sdl.K_SPACE:        keySpace,
+	sdl.K_UP:           keyUp,
+	sdl.K_DOWN:         keyDown,
+	sdl.K_LEFT:         keyLeft,
+	sdl.K_RIGHT:        keyRight,
+	sdl.K_LSHIFT:       keyLShift,
+	sdl.K_RSHIFT:       keyRShift,
+	sdl.K_LCTRL:        keyLCtrl,
+	sdl.K_RCTRL:        keyRCtrl,
+	sdl.K_LALT:         keyLAlt,
+	sdl.K_RALT:         keyRAlt,
+	sdl.K_INSERT:       keyInsert,
+	sdl.K_DELETE:       keyDelete,
+	sdl.K_HOME:         keyHome,
+	sdl.K_END:          keyEnd,
+	sdl.K_PAGEUP:       keyPageUp,
+	sdl.K_PAGEDOWN:     keyPageDown,
+	sdl.K_PAUSE:        keyPause,
+	sdl.K_BACKQUOTE:    keyBackquote,
+	sdl.K_MINUS:        keyMinus,
+	sdl.K_EQUALS:       keyEquals,
+	sdl.K_LEFTBRACKET:  keyLeftBracket,
+	sdl.K_RIGHTBRACKET: keyRightBracket,
+	sdl.K_BACKSLASH:    keyBackslash,
+	sdl.K_SEMICOLON:    keySemicolon,
+	sdl.K_QUOTE:        keyQuote,
+	sdl.K_COMMA:        keyComma,
+	sdl.K_PERIOD:       keyPeriod,
+	sdl.K_SLASH:        keySlash,
+	sdl.K_KP_PLUS:      keyKPPlus,
+	sdl.K_KP_MINUS:     keyKPMinus,
+	sdl.K_KP_ENTER:     keyKPEnter,
+}
+
+func init() {
+	// SDL numbers these keys consecutively.
+	for i := 0; i < 26; i++ {
+		sdlKeys[sdl.K_a+uint32(i)] = keyA + i
+	}
+	for i := 0; i < 10; i++ {
+		sdlKeys[sdl.K_0+uint32(i)] = key0 + i
+		sdlKeys[sdl.K_KP0+uint32(i)] = keyKP0 + i
+	}
+	for i := 0; i < 12; i++ {
+		sdlKeys[sdl.K_F1+uint32(i)] = keyF1 + i
+	}
+}
+
+func (m *memory) updateKeys(ev *sdl.KeyboardEvent) {
+	key, ok := sdlKeys[ev.Keysym.Sym]
+	if !ok {
+		return
+	}
+	ctrl := ev.Keysym.Mod&(sdl.KMOD_LCTRL|sdl.KMOD_RCTRL) != 0
+	m.updateKey(key, ctrl, ev.Type == sdl.KEYDOWN)
+}
+
+func (m *memory) updateButtons(ev *sdl.JoyButtonEvent) {
+	if act, ok := m.input.buttons[int(ev.Button)]; ok {
+		m.post(act, ev.Type == sdl.JOYBUTTONDOWN)
+	}
+}
+
+func (m *memory) updateAxis(ev *sdl.JoyAxisEvent) {
+	im := m.input
+	axis := int(ev.Axis)
+	if _, ok := m.cart.(tiltSensor); ok && m.config.TiltAxes {
+		switch axis {
+		case m.config.TiltAxisX:
+			m.postTilt(0, float64(ev.Value)/32768)
+			return
+		case m.config.TiltAxisY:
+			m.postTilt(1, float64(ev.Value)/32768)
+			return
+		}
+	}
+	pos := 0
+	switch {
+	case ev.Value > axisThreshold:
+		pos = 1
+	case ev.Value < -axisThreshold:
+		pos = -1
+	}
+	old := im.axisState[axis]
+	if pos == old {
+		return
+	}
+	im.axisState[axis] = pos
+	if old != 0 {
+		if act, ok := im.axes[axis*2+(old+1)/2]; ok {
+			m.post(act, false)
+		}
+	}
+	if pos != 0 {
+		if act, ok := im.axes[axis*2+(pos+1)/2]; ok {
+			m.post(act, true)
+		}
+	}
+}
+
+// updateMouse tilts the Game Boy by as far as the mouse is from the
+// middle of the screen, if enabled.
+func (m *memory) updateMouse(ev *sdl.MouseMotionEvent) {
+	if !m.config.TiltMouse {
+		return
+	}
+	w := float64(displayW*m.config.Scale) / 2
+	h := float64(displayH*m.config.Scale) / 2
+	m.postTilt(0, (float64(ev.X)-w)/w)
+	m.postTilt(1, (float64(ev.Y)-h)/h)
+}
+
+func (m *memory) updateHat(ev *sdl.JoyHatEvent) {
+	im := m.input
+	hat := int(ev.Hat)
+	old := im.hatState[hat]
+	im.hatState[hat] = ev.Value
+	for dir, bit := range []byte{hatUp, hatRight, hatDown, hatLeft} {
+		if (old^ev.Value)&bit == 0 {
+			continue
+		}
+		if act, ok := im.hats[hat*4+dir]; ok {
+			m.post(act, ev.Value&bit != 0)
+		}
+	}
+}
+
+func openJoystick(cfg *Config) (joy *sdl.Joystick) {
+	n := sdl.NumJoysticks()
+	if n == 0 {
+		if cfg.Verbose {
+			fmt.Println("no joysticks")
+		}
+		return
+	}
+
+	if cfg.Joystick >= n {
+		if cfg.Verbose {
+			fmt.Printf("no such joystick: %d (found %d)\n",
+				cfg.Joystick, n)
+		}
+		return
+	}
+
+	joy = sdl.JoystickOpen(cfg.Joystick)
+	if joy == nil {
+		fmt.Fprintf(os.Stderr,
+			"failed to open joystick: %v\n",
+			sdl.GetError())
+		return
+	}
+
+	sdl.JoystickEventState(sdl.ENABLE)
+
+	if cfg.Verbose {
+		fmt.Printf("using joystick %d\n", cfg.Joystick)
+	}
+
+	return joy
+}
@@ -0,0 +1,274 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The single-step tests are JSON files in the SM83 format used by
+// other emulators, one for each opcode ("00.json" to "ff.json", and
+// "cb 00.json" to "cb ff.json"), in stepDir. None are included;
+// opcodes without a file are skipped.
+const stepDir = "testdata/sm83"
+
+// A stepTest runs one instruction from an initial state, and gives
+// the state after it and what happened on the bus in each M-cycle.
+type stepTest struct {
+	Name    string
+	Initial stepState
+	Final   stepState
+	Cycles  []interface{} // [addr, value, "r-m"/"-wm"], or null
+}
+
+type stepState struct {
+	PC, SP                 uint16
+	A, B, C, D, E, F, H, L byte
+	IME                    byte
+	RAM                    [][2]int
+}
+
+// A busAccess is a read or write seen by flatRAM.
+type busAccess struct {
+	addr  uint16
+	value byte
+	write bool
+}
+
+func (a busAccess) String() string {
+	op := "read"
+	if a.write {
+		op = "write"
+	}
+	return fmt.Sprintf("%s %04X=%02X", op, a.addr, a.value)
+}
+
+// flatRAM is a bus of 64K of plain RAM, which remembers each access.
+type flatRAM struct {
+	mem      [0x10000]byte
+	accesses []busAccess
+}
+
+func (ram *flatRAM) Read(addr uint16) byte {
+	x := ram.mem[addr]
+	ram.accesses = append(ram.accesses, busAccess{addr, x, false})
+	return x
+}
+
+func (ram *flatRAM) Write(addr uint16, x byte) {
+	ram.mem[addr] = x
+	ram.accesses = append(ram.accesses, busAccess{addr, x, true})
+}
+
+func (ram *flatRAM) Tick(t int) {}
+
+// runStepTest runs a test, returning a description of what was wrong
+// with the result, if anything. The reads and writes made are checked
+// in order against the test's bus cycles; cycles with no access
+// (null) are only counted.
+func runStepTest(st *stepTest) (problem string) {
+	ram := new(flatRAM)
+	for _, m := range st.Initial.RAM {
+		ram.mem[uint16(m[0])] = byte(m[1])
+	}
+	in := &st.Initial
+	sys := &cpu{bus: ram, pc: in.PC, sp: in.SP,
+		b: in.B, c: in.C, d: in.D, e: in.E, ime: in.IME != 0}
+	sys.waf(uint16(in.A)<<8 | uint16(in.F))
+	sys.hl = uint16(in.H)<<8 | uint16(in.L)
+
+	defer func() {
+		if e := recover(); e != nil {
+			problem = fmt.Sprintf("panic: %v", e)
+		}
+	}()
+	cycles := sys.fdx()
+
+	var diffs []string
+	check := func(name string, x, want int) {
+		if x != want {
+			diffs = append(diffs, fmt.Sprintf("%s=%X want %X", name, x, want))
+		}
+	}
+	out := &st.Final
+	af := sys.af()
+	check("PC", int(sys.pc), int(out.PC))
+	check("SP", int(sys.sp), int(out.SP))
+	check("A", int(af>>8), int(out.A))
+	check("F", int(af&0xFF), int(out.F))
+	check("B", int(sys.b), int(out.B))
+	check("C", int(sys.c), int(out.C))
+	check("D", int(sys.d), int(out.D))
+	check("E", int(sys.e), int(out.E))
+	check("H", int(sys.hl>>8), int(out.H))
+	check("L", int(sys.hl&0xFF), int(out.L))
+	if sys.ime != (out.IME != 0) {
+		diffs = append(diffs, fmt.Sprintf("IME=%t", sys.ime))
+	}
+	for _, m := range out.RAM {
+		check(fmt.Sprintf("(%04X)", m[0]), int(ram.mem[uint16(m[0])]), m[1])
+	}
+	check("cycles", cycles, len(st.Cycles))
+
+	var want []busAccess
+	for _, c := range st.Cycles {
+		f, ok := c.([]interface{})
+		if !ok || len(f) != 3 {
+			continue
+		}
+		addr, _ := f[0].(float64)
+		value, _ := f[1].(float64)
+		kind, _ := f[2].(string)
+		if strings.Contains(kind, "r") || strings.Contains(kind, "w") {
+			want = append(want, busAccess{uint16(addr), byte(value),
+				strings.Contains(kind, "w")})
+		}
+	}
+	for i := 0; i < len(ram.accesses) || i < len(want); i++ {
+		switch {
+		case i >= len(ram.accesses):
+			diffs = append(diffs, fmt.Sprintf("bus access %d: none, want %v",
+				i, want[i]))
+		case i >= len(want):
+			diffs = append(diffs, fmt.Sprintf("bus access %d: %v, want none",
+				i, ram.accesses[i]))
+		case ram.accesses[i] != want[i]:
+			diffs = append(diffs, fmt.Sprintf("bus access %d: %v, want %v",
+				i, ram.accesses[i], want[i]))
+		default:
+			continue
+		}
+		break
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// readStepTests reads a file of tests, returning nil if there is no
+// such file.
+func readStepTests(t *testing.T, name string) []stepTest {
+	data, err := ioutil.ReadFile(filepath.Join(stepDir, name))
+	if err != nil {
+		if _, e := os.Stat(filepath.Join(stepDir, name)); e == nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+	var tests []stepTest
+	if err := json.Unmarshal(data, &tests); err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+	return tests
+}
+
+// invalidOpcodes are missing from the SM83 and lock it up.
+var invalidOpcodes = map[int]bool{
+	0xD3: true, 0xDB: true, 0xDD: true, 0xE3: true, 0xE4: true, 0xEB: true,
+	0xEC: true, 0xED: true, 0xF4: true, 0xFC: true, 0xFD: true,
+}
+
+// knownExceptions are opcodes the CPU cannot model as the tests expect,
+// and are skipped, with the reason why.
+var knownExceptions = map[string]string{
+	"10.json": "STOP needs the joypad and speed switch",
+}
+
+func TestSingleStep(t *testing.T) {
+	run, files := 0, 0
+	for table := 0; table < 2; table++ {
+		for op := 0; op < 0x100; op++ {
+			name := fmt.Sprintf("%02x.json", op)
+			if table == 1 {
+				name = "cb " + name
+			} else if invalidOpcodes[op] || op == 0xCB {
+				continue
+			}
+			if why, ok := knownExceptions[name]; ok {
+				t.Logf("%s skipped: %s", name, why)
+				continue
+			}
+			tests := readStepTests(t, name)
+			if tests == nil {
+				continue
+			}
+			files++
+			failed := 0
+			for i := range tests {
+				if p := runStepTest(&tests[i]); p != "" {
+					if failed == 0 {
+						t.Errorf("%s: %s", tests[i].Name, p)
+					}
+					failed++
+				}
+				run++
+			}
+			if failed > 1 {
+				t.Errorf("%s: %d of %d tests failed", name, failed,
+					len(tests))
+			}
+		}
+	}
+	if files == 0 {
+		t.Logf("no single-step tests in %s", stepDir)
+		return
+	}
+	t.Logf("ran %d tests from %d files", run, files)
+}
+
+// The harness itself is checked with a few tests written by hand.
+const sampleStepTests = `[
+{"name": "00 nop",
+ "initial": {"pc": 256, "sp": 65534, "a": 1, "b": 2, "c": 3, "d": 4,
+  "e": 5, "f": 176, "h": 6, "l": 7, "ime": 0, "ram": [[256, 0]]},
+ "final": {"pc": 257, "sp": 65534, "a": 1, "b": 2, "c": 3, "d": 4,
+  "e": 5, "f": 176, "h": 6, "l": 7, "ime": 0, "ram": [[256, 0]]},
+ "cycles": [[256, 0, "r-m"]]},
+{"name": "c5 push bc",
+ "initial": {"pc": 512, "sp": 53248, "a": 0, "b": 18, "c": 52, "d": 0,
+  "e": 0, "f": 0, "h": 0, "l": 0, "ime": 0, "ram": [[512, 197]]},
+ "final": {"pc": 513, "sp": 53246, "a": 0, "b": 18, "c": 52, "d": 0,
+  "e": 0, "f": 0, "h": 0, "l": 0, "ime": 0,
+  "ram": [[512, 197], [53247, 18], [53246, 52]]},
+ "cycles": [[512, 197, "r-m"], null, [53247, 18, "-wm"],
+  [53246, 52, "-wm"]]},
+{"name": "cb 37 swap a",
+ "initial": {"pc": 0, "sp": 0, "a": 18, "b": 0, "c": 0, "d": 0,
+  "e": 0, "f": 240, "h": 0, "l": 0, "ime": 1, "ram": [[0, 203], [1, 55]]},
+ "final": {"pc": 2, "sp": 0, "a": 33, "b": 0, "c": 0, "d": 0,
+  "e": 0, "f": 0, "h": 0, "l": 0, "ime": 1, "ram": [[0, 203], [1, 55]]},
+ "cycles": [[0, 203, "r-m"], [1, 55, "r-m"]]}
+]`
+
+func TestSingleStepHarness(t *testing.T) {
+	var tests []stepTest
+	if err := json.Unmarshal([]byte(sampleStepTests), &tests); err != nil {
+		t.Fatal(err)
+	}
+	for i := range tests {
+		if p := runStepTest(&tests[i]); p != "" {
+			t.Errorf("%s: %s", tests[i].Name, p)
+		}
+	}
+
+	// A wrong result must be noticed.
+	tests[0].Final.A = 2
+	tests[0].Cycles = append(tests[0].Cycles, nil)
+	if p := runStepTest(&tests[0]); p != "A=1 want 2, cycles=1 want 2" {
+		t.Errorf("got %q", p)
+	}
+
+	// So must accesses made in the wrong order.
+	c := tests[1].Cycles
+	c[2], c[3] = c[3], c[2]
+	want := "bus access 1: write CFFF=12, want write CFFE=34"
+	if p := runStepTest(&tests[1]); p != want {
+		t.Errorf("got %q, want %q", p, want)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+const (
+	stateSlots   = 10
+	stateMagic   = "GBSTATE"
+	stateVersion = 5
+)
+
+// stateFields lists everything making up the machine state, in the
+// order it is saved. Register-derived state in the display (LCDC,
+// STAT and palette flags) is not included; it is rebuilt from the
+// I/O ports when loading.
+func (sys *machine) stateFields() []interface{} {
+	m := sys.memory
+	lcd := sys.lcd
+	mix := sys.audio
+	ch1, ch2, ch3, ch4 := &mix.ch1, &mix.ch2, &mix.ch3, &mix.ch4
+	fields := []interface{}{
+		&sys.a, &sys.b, &sys.c, &sys.d, &sys.e,
+		&sys.hl, &sys.pc, &sys.sp,
+		&sys.fz, &sys.fn, &sys.fh, &sys.fc,
+		&sys.ime, &sys.halt, &sys.pause,
+		&sys.mar, &sys.stack,
+
+		m.vram[:], m.wram[:], m.oam[:], m.hram[:],
+		&m.ticks, &m.divTicks, &m.timaTicks, &m.timaOverflow,
+		&m.serialTicks,
+		&m.dpadBits, &m.btnBits, &m.frame, &m.movieID,
+
+		&lcd.clock, &lcd.mode, &lcd.ly,
+
+		&mix.clock, &mix.volL, &mix.volR,
+		&mix.ch1L, &mix.ch1R, &mix.ch2L, &mix.ch2R,
+		&mix.ch3L, &mix.ch3R, &mix.ch4L, &mix.ch4R,
+		&ch1.sweepTime, &ch1.sweepDir, &ch1.sweepShift,
+		&ch4.shiftClockFreq, &ch4.counterStepWidth, &ch4.dividingRatio,
+		&ch4.period, &ch4.sign, &ch4.lfsr7, &ch4.lfsr15,
+		&ch3.on, &ch3.length, &ch3.level, &ch3.freq, &ch3.init,
+		&ch3.loop, &ch3.clock, &ch3.active, &ch3.period, &ch3.phase,
+	}
+	for _, t := range []*tone{&ch1.tone, ch2} {
+		fields = append(fields, &t.waveDuty, &t.freq, &t.period, &t.duty)
+	}
+	for _, s := range []*sound{&ch1.sound, &ch2.sound, &ch4.sound} {
+		fields = append(fields, &s.length, &s.volumeInit, &s.volumeDir,
+			&s.volumeTime, &s.loop, &s.init, &s.clock, &s.volume,
+			&s.active, &s.phase)
+	}
+	return append(fields, m.cart.StateFields()...)
+}
+
+func (sys *machine) saveState(w io.Writer) os.Error {
+	sys.movieID = 0
+	if sys.movie != nil {
+		sys.movieID = sys.movie.id
+	}
+
+	b := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	header := []interface{}{
+		[]byte(stateMagic), byte(stateVersion),
+		sys.rom.headerChecksum(), sys.rom.globalChecksum(),
+	}
+	for _, f := range append(header, sys.stateFields()...) {
+		var err os.Error
+		switch f := f.(type) {
+		case *int:
+			err = binary.Write(b, le, int32(*f))
+		case *uint:
+			err = binary.Write(b, le, uint32(*f))
+		case *bool:
+			x := byte(0)
+			if *f {
+				x = 1
+			}
+			err = b.WriteByte(x)
+		default:
+			err = binary.Write(b, le, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+// loadState replaces the machine state with one read from r. If the
+// state cannot be read (or does not belong to the movie being
+// played), the machine is left as it was.
+func (sys *machine) loadState(r io.Reader) os.Error {
+	// The state includes the infrared LED, which a linked machine
+	// may be looking at.
+	if d, ok := sys.cart.(irDevice); ok {
+		if l := d.infrared().lock; l != nil {
+			l.Lock()
+			defer l.Unlock()
+		}
+	}
+
+	var backup bytes.Buffer
+	if err := sys.saveState(&backup); err != nil {
+		return err
+	}
+	err := sys.readState(r)
+	if err == nil && sys.movie != nil {
+		err = sys.movie.checkState(sys.frame, sys.movieID)
+	}
+	if err != nil {
+		sys.readState(&backup)
+		return err
+	}
+	return nil
+}
+
+func (sys *machine) readState(r io.Reader) os.Error {
+	b := bufio.NewReader(r)
+	le := binary.LittleEndian
+
+	magic := make([]byte, len(stateMagic))
+	var version, hsum byte
+	var gsum uint16
+	for _, f := range []interface{}{magic, &version, &hsum, &gsum} {
+		if err := binary.Read(b, le, f); err != nil {
+			return err
+		}
+	}
+	switch {
+	case string(magic) != stateMagic:
+		return os.NewError("not a saved state")
+	case version != stateVersion:
+		return fmt.Errorf("unsupported state version %d", version)
+	case hsum != sys.rom.headerChecksum() ||
+		gsum != sys.rom.globalChecksum():
+		return os.NewError("state was saved from a different ROM")
+	}
+
+	for _, f := range sys.stateFields() {
+		var err os.Error
+		switch f := f.(type) {
+		case *int:
+			var x int32
+			err = binary.Read(b, le, &x)
+			*f = int(x)
+		case *uint:
+			var x uint32
+			err = binary.Read(b, le, &x)
+			*f = uint(x)
+		case *bool:
+			var x byte
+			x, err = b.ReadByte()
+			*f = x != 0
+		default:
+			err = binary.Read(b, le, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sys.restorePorts()
+	return nil
+}
+
+// restorePorts brings the display and sound flags back in line with
+// the I/O registers after loading a state.
+func (sys *machine) restorePorts() {
+	m := sys.memory
+	for _, port := range []uint16{portLCDC, portSTAT, portSCY, portSCX,
+		portWY, portWX, portBGP, portOBP0, portOBP1} {
+		m.writePort(port, m.hram[port-0xFF00])
+	}
+	if on := m.hram[portNR52-0xFF00]&0x80 != 0; on != m.audio.enable {
+		m.audio.pause(!on)
+	}
+}
+
+func (m *memory) stateName(slot int) string {
+	name := m.fileName(fmt.Sprintf("state%d", slot))
+	return path.Join(m.config.SaveDir, name)
+}
+
+func (sys *machine) saveStateSlot(slot int) os.Error {
+	f, err := os.Create(sys.stateName(slot))
+	if err != nil {
+		return err
+	}
+	err = sys.saveState(f)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (sys *machine) loadStateSlot(slot int) os.Error {
+	f, err := os.Open(sys.stateName(slot))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sys.loadState(f)
+}
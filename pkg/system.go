@@ -7,10 +7,13 @@ package gameboy
 import (
 	"fmt"
 	"io"
-	"⚛sdl"
 	"os"
+	"time"
 )
 
+// Version identifies the emulator in the files it writes.
+const Version = "0.2"
+
 type Config struct {
 	SaveDir      string
 	Verbose      bool
@@ -20,6 +23,72 @@ type Config struct {
 	AudioBuffers int
 	AudioDriver  string
 	Fullscreen   bool
+	VGMFile      string
+
+	// Screenshots go in ScreenshotDir (or SaveDir if empty), and
+	// are also saved at the display scale if ScreenshotScaled. They
+	// include the on-screen display if ScreenshotOSD.
+	ScreenshotDir    string
+	ScreenshotScaled bool
+	ScreenshotOSD    bool
+
+	// What the on-screen display shows, if anything: messages and
+	// the movie frame counter if OSD, and optionally the frame rate
+	// and the buttons held.
+	OSD       bool
+	ShowFPS   bool
+	ShowInput bool
+
+	// GIF clips use every (GIFSkip+1)th frame. If GIFSeconds is
+	// positive, that much is kept for saving as a replay.
+	GIFSeconds int
+	GIFSkip    int
+
+	// Speeds, as a percentage of normal, for fast-forward (0 for
+	// as fast as possible) and slow motion (0 for half speed).
+	TurboSpeed int
+	SlowSpeed  int
+
+	// An input movie to record or play (see the Movie* modes), and
+	// where a new recording starts: "power-on", "sram", or the
+	// number of a saved state slot.
+	MovieFile  string
+	MovieMode  int
+	MovieStart string
+
+	// Whether an MBC1 cartridge is a multicart (MBC1M): "yes",
+	// "no", or "auto" to guess from the ROM.
+	Multicart string
+
+	// What the infrared port of a cartridge which has one sees:
+	// "none" (nothing) or "loop" (its own LED). IRPeer, if set, is
+	// seen instead; IRLink, if set, connects the port to another
+	// machine's given the same link.
+	IR     string
+	IRPeer IRPeer
+	IRLink *IRLink
+
+	// What the Pocket Camera sees: a PNG image, or a directory of
+	// them to be taken in turn. It sees plain grey if empty.
+	Camera string
+
+	// Bindings from inputs to buttons and actions, as read from the
+	// configuration file; see ReadConfig.
+	Bindings map[string]string
+
+	// The palette to use, palettes defined in the configuration
+	// file, and palettes to use for particular ROMs (keyed by their
+	// checksums, as in save file names, or the header checksum).
+	Palette     string
+	Palettes    map[string]string
+	ROMPalettes map[string]string
+
+	// Software filters for the screen: Filter enlarges it (and sets
+	// the scale), Effect makes it look like an LCD, and Blend mixes
+	// each frame with the last, like the DMG's slow pixels.
+	Filter string
+	Effect string
+	Blend  bool
 
 	Joystick        int
 	JoyButtonA      int
@@ -28,16 +97,29 @@ type Config struct {
 	JoyButtonSelect int
 	JoyAxisX        int
 	JoyAxisY        int
-}
 
-func Start(path string, cfg Config, in <-chan int, out chan<- interface{}) {
-	var rom romImage
-	var err interface{}
+	// For cartridges with an accelerometer: whether joystick axes
+	// tilt the Game Boy, and which (-1 for none), and whether the
+	// mouse does. The axes are used only if TiltAxes is set, and
+	// are not then used for the d-pad.
+	TiltAxes  bool
+	TiltAxisX int
+	TiltAxisY int
+	TiltMouse bool
+}
 
-	defer func() {
-		out <- err
-	}()
+// A frontend provides the devices the emulator runs with.
+type frontend interface {
+	init(cfg *Config) interface{}
+	openScreen(cfg *Config, title string, w, h int) screen
+	openAudio(m *memory) (*mixer, interface{})
+	monitor(m *memory) // runs in its own goroutine, posting input
+	close()
+}
 
+// start runs the ROM image at path with the devices provided by fe.
+func start(path string, cfg *Config, in <-chan interface{}, fe frontend) (err interface{}) {
+	var rom romImage
 	if rom, err = loadROM(path); err != nil {
 		return
 	}
@@ -46,47 +128,74 @@ func Start(path string, cfg Config, in <-chan int, out chan<- interface{}) {
 		rom.printInfo()
 	}
 
-	if sdl.Init(sdl.INIT_VIDEO|sdl.INIT_JOYSTICK) != 0 {
-		err = sdl.GetError()
+	if err = fe.init(cfg); err != nil {
 		return
 	}
-	defer sdl.Quit()
+	defer fe.close()
 
 	var mem *memory
-	if mem, err = newMemory(rom, &cfg); err != nil {
+	if mem, err = newMemory(rom, cfg); err != nil {
+		return
+	}
+	if err = mem.initInput(); err != nil {
 		return
 	}
 
-	if e := mem.load(cfg.SaveDir); e != nil && cfg.Verbose {
-		fmt.Fprintf(os.Stderr, "load failed: %v\n", e)
+	// A movie supplies its own battery-backed RAM, if any.
+	if cfg.MovieMode == MovieOff {
+		if e := mem.load(cfg.SaveDir); e != nil && cfg.Verbose {
+			fmt.Fprintf(os.Stderr, "load failed: %v\n", e)
+		}
 	}
 
 	var audio *mixer
-	if audio, err = newMixer(mem); err != nil {
+	if audio, err = fe.openAudio(mem); err != nil {
 		return
 	}
 	defer audio.close()
 
-	sys := newCPU(mem)
-	lcd := newDisplay(mem)
+	var post *postProcessor
+	if post, err = newPostProcessor(cfg); err != nil {
+		return
+	}
+	sys := newMachine(mem)
+	scr := fe.openScreen(cfg, rom.title(), displayW*cfg.Scale,
+		displayH*cfg.Scale)
+	lcd := newDisplay(mem, scr, post)
 
-	mem.connect(sys, lcd, audio)
+	if cfg.VGMFile != "" {
+		mem.vgm = newVGMLog(mem.ticks)
+	}
+	mem.connect(lcd, audio)
+	if cfg.GIFSeconds > 0 {
+		mem.gifReplay = newGIFClip(cfg.GIFSeconds)
+	}
 
-	joy := openJoystick(&cfg)
-	if joy != nil {
-		defer joy.Close()
+	if cfg.MovieMode != MovieOff {
+		if err = sys.startMovie(); err != nil {
+			return
+		}
 	}
 
-	go mem.monitorEvents()
+	go fe.monitor(mem)
 
-	run(&cfg, sys, in)
+	run(cfg, sys, in)
+	mem.stopVideo()
 
-	if e := mem.save(cfg.SaveDir); e != nil && cfg.Verbose {
+	if mv := mem.movie; mv != nil {
+		if mv.dirty {
+			err = mv.save()
+		}
+	} else if e := mem.save(cfg.SaveDir); e != nil && cfg.Verbose {
 		fmt.Fprintf(os.Stderr, "save failed: %v\n", e)
 	}
+	if mem.vgm != nil && err == nil {
+		err = mem.vgm.save(cfg.VGMFile, mem.ticks)
+	}
+	return
 }
 
-func run(cfg *Config, sys *cpu, in <-chan int) {
+func run(cfg *Config, sys *machine, in <-chan interface{}) {
 	defer func() {
 		if e := recover(); e != nil {
 			if cfg.Debug {
@@ -99,54 +208,79 @@ func run(cfg *Config, sys *cpu, in <-chan int) {
 	}()
 
 	for !sys.quit {
-		for t := 0; t < refreshTicks; {
-			s := sys.step()
-			sys.updateTimers(s)
-			sys.lcd.step(s)
-			sys.audio.step(s)
-			t += s
-		}
-		select {
-		case <-in:
-			sys.quit = true
-		default:
-			// non-blocking
+		if sys.paused && !sys.advance {
+			// Keep showing the on-screen display, for messages
+			// posted while paused.
+			sys.lcd.redraw()
+			time.Sleep(frameNanos)
+		} else {
+			sys.advance = false
+			if sys.movie != nil && sys.frame%15 == 0 {
+				sys.lcd.screen.setCaption(sys.rom.title() +
+					" - " + sys.movie.status(sys.frame))
+			}
+			sys.runFrame()
 		}
+		sys.poll(in, sys.command)
 	}
 }
 
-func openJoystick(cfg *Config) (joy *sdl.Joystick) {
-	n := sdl.NumJoysticks()
-	if n == 0 {
-		if cfg.Verbose {
-			fmt.Println("no joysticks")
-		}
-		return
-	}
+// A machine is the CPU and the memory map it runs on.
+type machine struct {
+	*cpu
+	*memory
+}
+
+func newMachine(m *memory) *machine {
+	return &machine{newCPU(m), m}
+}
+
+// runFrame runs the machine for one frame, up to the start of the
+// next VBlank. An instruction which runs past it shortens the next
+// frame, so frames stay in step with the display.
+func (sys *machine) runFrame() {
+	sys.runFrameUntil(nil)
+}
 
-	if cfg.Joystick >= n {
-		if cfg.Verbose {
-			fmt.Printf("no such joystick: %d (found %d)\n",
-				cfg.Joystick, n)
+// runFrameUntil runs a frame like runFrame, but also calls stop (if
+// not nil) before each instruction until it returns true, reporting
+// whether it did. The rest of the frame is run regardless.
+func (sys *machine) runFrameUntil(stop func(sys *cpu) bool) (stopped bool) {
+	sys.latchInput()
+	vblank := displayH * scanlineTicks
+	end := (vblank-sys.lcd.clock+refreshTicks-1)%refreshTicks + 1
+	for t := 0; t < end; {
+		if stop != nil && !stopped {
+			stopped = stop(sys.cpu)
 		}
-		return
+		t += sys.step()
 	}
+	return
+}
 
-	joy = sdl.JoystickOpen(cfg.Joystick)
-	if joy == nil {
-		fmt.Fprintf(os.Stderr,
-			"failed to open joystick: %v\n",
-			sdl.GetError())
-		return
+// startHeadless loads the ROM image at path and connects it to a
+// display and sound output that are never seen or heard, starting
+// any movie given in cfg. The caller must close sys.audio.
+func startHeadless(path string, cfg *Config) (*machine, os.Error) {
+	rom, e := loadROM(path)
+	if e != nil {
+		return nil, fmt.Errorf("%v", e)
 	}
-
-	sdl.JoystickEventState(sdl.ENABLE)
-
-	if cfg.Verbose {
-		fmt.Printf("using joystick %d\n", cfg.Joystick)
+	mem, e := newMemory(rom, cfg)
+	if e != nil {
+		return nil, fmt.Errorf("%v", e)
 	}
-
-	return joy
+	sys := newMachine(mem)
+	lcd := &display{memory: mem}
+	lcd.initPalette()
+	mem.connect(lcd, newMixerOutput(mem, nullOutput{}))
+	if cfg.MovieMode != MovieOff {
+		if err := sys.startMovie(); err != nil {
+			sys.audio.close()
+			return nil, err
+		}
+	}
+	return sys, nil
 }
 
 func (rom romImage) printInfo() {
@@ -160,7 +294,7 @@ func (rom romImage) printInfo() {
 	}
 }
 
-func (sys *cpu) dump(w io.Writer) {
+func (sys *machine) dump(w io.Writer) {
 	fmt.Fprintf(w,
 		"LAST INSTRUCTION\n"+
 			"%04X\t%s\n\n"+
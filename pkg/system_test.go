@@ -0,0 +1,62 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFramesEndAtVBlank(t *testing.T) {
+	// A ROM which draws nothing, running a loop of JR -2 (12 ticks
+	// a time, so that instructions run past the end of a frame).
+	rom := testROM(2, 0x00, 0)
+	rom[0x0100], rom[0x0101] = 0x18, 0xFE
+	mem, err := newMemory(rom, &Config{AudioFreq: 48000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := newMachine(mem)
+	lcd := &display{memory: mem}
+	lcd.initPalette()
+	mem.connect(lcd, newMixerOutput(mem, nullOutput{}))
+	defer sys.audio.close()
+
+	vblank := displayH * scanlineTicks
+	for i := 0; i < 5; i++ {
+		sys.runFrame()
+		if d := lcd.clock - vblank; d < 0 || d >= 12 {
+			t.Fatalf("frame %d ended %d ticks from VBlank", i, d)
+		}
+	}
+}
+
+func TestViewBesideScreen(t *testing.T) {
+	cfg := &Config{AudioFreq: 48000, Scale: 1}
+	mem, err := newMemory(testROM(2, 0x00, 0), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scr := &termScreen{out: bufio.NewWriter(ioutil.Discard)}
+	scr.setMode(displayW, displayH)
+	lcd := newDisplay(mem, scr, nil)
+	mem.connect(lcd, newMixerOutput(mem, nullOutput{}))
+	defer mem.audio.close()
+
+	lcd.setView(ViewTiles)
+	lcd.shown[0] = 3
+	lcd.redraw()
+	if w := displayW + 16*tileW; scr.w != w || scr.h != 24*tileH {
+		t.Errorf("window is %dx%d, want %dx%d", scr.w, scr.h, w, 24*tileH)
+	}
+	if scr.pix[0] != lcd.pal[3] {
+		t.Errorf("screen pixel is %06X, want %06X", scr.pix[0], lcd.pal[3])
+	}
+	if scr.pix[displayW] != lcd.canvas.pix[0] {
+		t.Errorf("view pixel is %06X, want %06X", scr.pix[displayW],
+			lcd.canvas.pix[0])
+	}
+}
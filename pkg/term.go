@@ -0,0 +1,381 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bufio"
+	"exec"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Terminals report keys being pressed (and repeated) but not
+	// released, so each press holds its button for this long.
+	termHold = 150000000
+
+	termFrameNanos = 1000000000 / 30 // the most often the screen is drawn
+
+	// How long to wait for the rest of an escape sequence. Escape on
+	// its own is only the Escape key if nothing follows in this time.
+	termEscWait = 50000000
+)
+
+// Ctrl+H, I, J and M reach the terminal as Backspace, Tab and Return,
+// so toggle-input has another key there.
+var termDefaultKeys = map[string]string{
+	"key:ctrl+n": "toggle-input",
+}
+
+// StartTerminal runs the ROM image at path like Start, but draws the
+// screen in the terminal using 24-bit colour and half-block
+// characters (two pixels to each character cell) and reads keys from
+// it, with no need for a display. The terminal must be at least
+// 160x72. Sound is played if it can be, unless the audio driver is
+// "none".
+func StartTerminal(path string, cfg Config, in <-chan interface{}, out chan<- interface{}) {
+	var err interface{}
+	defer func() {
+		out <- err
+	}()
+	cfg.Scale = 1
+	cfg.Filter = ""
+	cfg.Effect = ""
+	bindings := make(map[string]string)
+	for k, v := range termDefaultKeys {
+		bindings[k] = v
+	}
+	for k, v := range cfg.Bindings {
+		bindings[k] = v
+	}
+	cfg.Bindings = bindings
+	err = start(path, &cfg, in, new(termFrontend))
+}
+
+// termFrontend uses the terminal on stdin and stdout.
+type termFrontend struct {
+	saved string // the terminal settings to restore
+}
+
+// stty runs stty(1) on the terminal, returning its output.
+func stty(args ...string) (string, os.Error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (fe *termFrontend) init(cfg *Config) interface{} {
+	saved, err := stty("-g")
+	if err != nil {
+		return fmt.Errorf("not a terminal: %v", err)
+	}
+	if _, err = stty("raw", "-echo"); err != nil {
+		return err
+	}
+	fe.saved = saved
+	// the alternate screen, without a cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l\x1b[2J")
+	return nil
+}
+
+func (fe *termFrontend) openScreen(cfg *Config, title string, w, h int) screen {
+	s := &termScreen{out: bufio.NewWriter(os.Stdout)}
+	s.setCaption(title)
+	s.setMode(w, h)
+	return s
+}
+
+func (fe *termFrontend) openAudio(m *memory) (*mixer, interface{}) {
+	if m.config.AudioDriver != "none" {
+		if mix, err := newMixer(m); err == nil {
+			return mix, nil
+		}
+	}
+	return newMixerOutput(m, nullOutput{}), nil
+}
+
+func (fe *termFrontend) monitor(m *memory) {
+	m.monitorTerminal()
+}
+
+func (fe *termFrontend) close() {
+	fmt.Print("\x1b[0m\x1b[?25h\x1b[?1049l")
+	stty(fe.saved)
+}
+
+// termScreen keeps the picture in memory, and draws what has changed
+// on the terminal when flipped.
+type termScreen struct {
+	out   *bufio.Writer
+	w, h  int
+	pix   []uint32
+	last  []uint32 // as last drawn, or nil to draw everything
+	drawn int64
+}
+
+func (s *termScreen) setMode(w, h int) {
+	s.w, s.h = w, h
+	s.pix = make([]uint32, w*(h+1)) // room for an odd last row
+	s.last = nil
+	s.out.WriteString("\x1b[0m\x1b[2J")
+}
+
+func (s *termScreen) mapColor(c image.RGBAColor) uint32 {
+	return rgbOf(c)
+}
+
+func (s *termScreen) fillRect(x, y, w, h int, color uint32) {
+	if x < 0 {
+		w += x
+		x = 0
+	}
+	if y < 0 {
+		h += y
+		y = 0
+	}
+	if x+w > s.w {
+		w = s.w - x
+	}
+	if y+h > s.h {
+		h = s.h - y
+	}
+	for j := y; j < y+h; j++ {
+		row := s.pix[j*s.w:]
+		for i := x; i < x+w; i++ {
+			row[i] = color
+		}
+	}
+}
+
+func (s *termScreen) blit(pix []uint32, x, y, w, h int) {
+	cw, ch := w, h
+	if x+cw > s.w {
+		cw = s.w - x
+	}
+	if y+ch > s.h {
+		ch = s.h - y
+	}
+	for j := 0; j < ch; j++ {
+		row := s.pix[(y+j)*s.w+x:]
+		copy(row[:cw], pix[j*w:])
+	}
+}
+
+func (s *termScreen) setCaption(title string) {
+	fmt.Fprintf(s.out, "\x1b]2;%s\x07", title)
+}
+
+func (s *termScreen) toggleFullScreen() {}
+
+// flip draws each pair of rows as a line of upper half blocks, with
+// the top pixel in the foreground colour and the bottom one in the
+// background.
+func (s *termScreen) flip() {
+	now := time.Nanoseconds()
+	if now-s.drawn < termFrameNanos {
+		return
+	}
+	s.drawn = now
+
+	full := s.last == nil
+	if full {
+		s.last = make([]uint32, len(s.pix))
+	}
+	fg, bg := -1, -1
+	for y := 0; y < s.h; y += 2 {
+		top := s.pix[y*s.w : (y+1)*s.w]
+		bottom := s.pix[(y+1)*s.w : (y+2)*s.w]
+		lastTop := s.last[y*s.w : (y+1)*s.w]
+		lastBottom := s.last[(y+1)*s.w : (y+2)*s.w]
+		moved := true
+		for x := 0; x < s.w; x++ {
+			t, b := top[x], bottom[x]
+			if !full && t == lastTop[x] && b == lastBottom[x] {
+				moved = true
+				continue
+			}
+			if moved {
+				fmt.Fprintf(s.out, "\x1b[%d;%dH", y/2+1, x+1)
+				moved = false
+			}
+			if int(t) != fg {
+				fmt.Fprintf(s.out, "\x1b[38;2;%d;%d;%dm",
+					t>>16, t>>8&0xFF, t&0xFF)
+				fg = int(t)
+			}
+			if int(b) != bg {
+				fmt.Fprintf(s.out, "\x1b[48;2;%d;%d;%dm",
+					b>>16, b>>8&0xFF, b&0xFF)
+				bg = int(b)
+			}
+			s.out.WriteString("▀")
+			lastTop[x], lastBottom[x] = t, b
+		}
+	}
+	s.out.Flush()
+}
+
+// Keys with escape sequences, by the final byte of the sequence (or
+// its number, for those ending in ~).
+var (
+	termLetterKeys = map[byte]int{
+		'A': keyUp, 'B': keyDown, 'C': keyRight,
+		'D': keyLeft, 'H': keyHome, 'F': keyEnd,
+		'P': keyF1, 'Q': keyF1 + 1, 'R': keyF1 + 2, 'S': keyF1 + 3,
+	}
+	termNumberKeys = map[int]int{
+		2: keyInsert, 3: keyDelete,
+		5: keyPageUp, 6: keyPageDown,
+		15: keyF1 + 4, 17: keyF1 + 5, 18: keyF1 + 6, 19: keyF1 + 7,
+		20: keyF1 + 8, 21: keyF1 + 9, 23: keyF1 + 10, 24: keyF1 + 11,
+	}
+	termCharKeys = map[byte]int{
+		'\r': keyReturn, '\n': keyReturn, '\t': keyTab,
+		' ': keySpace, 0x7F: keyBackspace, 0x08: keyBackspace,
+		'`': keyBackquote, '-': keyMinus,
+		'=': keyEquals, '[': keyLeftBracket,
+		']': keyRightBracket, '\\': keyBackslash,
+		';': keySemicolon, '\'': keyQuote, ',': keyComma,
+		'.': keyPeriod, '/': keySlash,
+	}
+)
+
+// A termKey is a key read from the terminal, as one of the key
+// constants.
+type termKey struct {
+	key  int
+	ctrl bool
+}
+
+// readTermKey parses the first key in b, returning it and the number
+// of bytes used, or 0 if b ends before the key does (as an escape
+// sequence split between reads may). Keys which cannot be bound have
+// key 0, as does Alt with another key (escape, then the key). A lone
+// escape is left for monitorTerminal to decide on.
+func readTermKey(b []byte) (k termKey, n int) {
+	c := b[0]
+	switch {
+	case c == 0x1B && len(b) == 1:
+		return k, 0
+	case c == 0x1B && (b[1] == '[' || b[1] == 'O'):
+		// CSI or SS3: parameters, then a final byte
+		n = 2
+		for n < len(b) && (b[n] >= '0' && b[n] <= '9' || b[n] == ';') {
+			n++
+		}
+		if n == len(b) {
+			return k, 0
+		}
+		params := strings.Split(string(b[2:n]), ";")
+		final := b[n]
+		n++
+		if len(params) > 1 {
+			mod, _ := strconv.Atoi(params[1])
+			k.ctrl = (mod-1)&4 != 0
+		}
+		if final == '~' {
+			num, _ := strconv.Atoi(params[0])
+			k.key = termNumberKeys[num]
+		} else {
+			k.key = termLetterKeys[final]
+		}
+		return k, n
+	case c == 0x1B && b[1] == 0x1B:
+		k.key = keyEscape
+	case c == 0x1B:
+		return k, 2
+	case c >= 'a' && c <= 'z':
+		k.key = keyA + int(c-'a')
+	case c >= 'A' && c <= 'Z':
+		k.key = keyA + int(c-'A')
+	case c >= '0' && c <= '9':
+		k.key = key0 + int(c-'0')
+	case termCharKeys[c] != 0:
+		k.key = termCharKeys[c]
+	case c >= 1 && c <= 26:
+		k.key = keyA + int(c-1)
+		k.ctrl = true
+	}
+	return k, 1
+}
+
+// monitorTerminal runs in its own goroutine, like monitorEvents,
+// turning keys read from the terminal into input events. Ctrl+C
+// always quits, since the terminal no longer sends a signal for it.
+func (m *memory) monitorTerminal() {
+	keys := make(chan []byte)
+	go func() {
+		for {
+			buf := make([]byte, 64)
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[:n]
+		}
+	}()
+
+	held := make(map[termKey]int64) // when each is released
+	press := func(k termKey) {
+		if k.key == 0 {
+			return
+		}
+		if _, ok := held[k]; !ok {
+			if !m.updateKey(k.key, k.ctrl, true) {
+				return
+			}
+		}
+		held[k] = time.Nanoseconds() + termHold
+	}
+
+	var pending []byte // the start of a key, waiting for the rest
+	var since int64
+	tick := time.Tick(termHold / 4)
+	for {
+		select {
+		case b, ok := <-keys:
+			if !ok {
+				m.post(actQuit, true)
+				return
+			}
+			b = append(pending, b...)
+			pending = nil
+			for len(b) > 0 {
+				if b[0] == 0x03 {
+					m.post(actQuit, true)
+				}
+				k, n := readTermKey(b)
+				if n == 0 {
+					pending, since = b, time.Nanoseconds()
+					break
+				}
+				b = b[n:]
+				press(k)
+			}
+		case <-tick:
+			now := time.Nanoseconds()
+			// With nothing more after it, a lone escape was the Escape
+			// key; an unfinished sequence is dropped.
+			if pending != nil && now-since >= termEscWait {
+				if len(pending) == 1 {
+					press(termKey{keyEscape, false})
+				}
+				pending = nil
+			}
+			for k, t := range held {
+				if t <= now {
+					held[k] = 0, false
+					m.updateKey(k.key, k.ctrl, false)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	vgmRate       = 44100 // all VGM timings are in samples at this rate
+	vgmVersion    = 0x161
+	vgmHeaderSize = 0x100
+	vgmClockDMG   = 4194304
+
+	vgmCmdDMG    = 0xB3
+	vgmCmdWait   = 0x61
+	vgmCmdWait60 = 0x62
+	vgmCmdWait50 = 0x63
+	vgmCmdEnd    = 0x66
+	vgmCmdWaitN  = 0x70 // 0x70-0x7F wait 1-16 samples
+)
+
+// A vgmLog records writes to the sound registers (NR10-NR52 and
+// wave RAM) so they can be saved as a VGM file.
+type vgmLog struct {
+	data    []byte
+	start   int64 // ticks when logging began
+	samples int64 // samples waited so far
+}
+
+// A vgmWrite is a single register write read back from a VGM file.
+type vgmWrite struct {
+	sample int64
+	addr   uint16
+	x      byte
+}
+
+func newVGMLog(ticks int64) *vgmLog {
+	return &vgmLog{start: ticks}
+}
+
+func isSoundPort(addr uint16) bool {
+	return addr >= portNR10 && addr < portWAVE+0x10
+}
+
+func (v *vgmLog) write(ticks int64, addr uint16, x byte) {
+	v.wait(ticks)
+	v.data = append(v.data, vgmCmdDMG, byte(addr-portNR10), x)
+}
+
+// wait emits wait commands up to the sample corresponding to ticks.
+func (v *vgmLog) wait(ticks int64) {
+	target := (ticks - v.start) * vgmRate / ticksFreq
+	for n := target - v.samples; n > 0; {
+		switch {
+		case n <= 16:
+			v.data = append(v.data, byte(vgmCmdWaitN+n-1))
+			n = 0
+		case n == 735:
+			v.data = append(v.data, vgmCmdWait60)
+			n = 0
+		case n == 882:
+			v.data = append(v.data, vgmCmdWait50)
+			n = 0
+		default:
+			k := n
+			if k > 0xFFFF {
+				k = 0xFFFF
+			}
+			v.data = append(v.data, vgmCmdWait, byte(k), byte(k>>8))
+			n -= k
+		}
+	}
+	if target > v.samples {
+		v.samples = target
+	}
+}
+
+// writeTo finishes the log at the given time and writes it out as
+// a VGM file.
+func (v *vgmLog) writeTo(w io.Writer, ticks int64) os.Error {
+	v.wait(ticks)
+	data := append(v.data, vgmCmdEnd)
+
+	var h [vgmHeaderSize]byte
+	le := binary.LittleEndian
+	copy(h[0:], "Vgm ")
+	le.PutUint32(h[0x04:], uint32(vgmHeaderSize+len(data)-0x04))
+	le.PutUint32(h[0x08:], vgmVersion)
+	le.PutUint32(h[0x18:], uint32(v.samples))
+	le.PutUint32(h[0x34:], vgmHeaderSize-0x34)
+	le.PutUint32(h[0x80:], vgmClockDMG)
+
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (v *vgmLog) save(name string, ticks int64) os.Error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = v.writeTo(f, ticks)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// readVGM returns the Game Boy register writes in a VGM file. Other
+// chips' commands are not supported.
+func readVGM(data []byte) (writes []vgmWrite, err os.Error) {
+	if len(data) < 0x40 || string(data[0:4]) != "Vgm " {
+		return nil, os.NewError("not a VGM file")
+	}
+	le := binary.LittleEndian
+	pos := 0x40
+	if le.Uint32(data[0x08:]) >= 0x150 {
+		if off := le.Uint32(data[0x34:]); off != 0 {
+			pos = 0x34 + int(off)
+		}
+	}
+
+	var sample int64
+	for pos < len(data) {
+		cmd := data[pos]
+		switch {
+		case cmd == vgmCmdDMG && pos+2 < len(data):
+			writes = append(writes, vgmWrite{sample,
+				portNR10 + uint16(data[pos+1]), data[pos+2]})
+			pos += 3
+		case cmd == vgmCmdWait && pos+2 < len(data):
+			sample += int64(data[pos+1]) | int64(data[pos+2])<<8
+			pos += 3
+		case cmd == vgmCmdWait60:
+			sample += 735
+			pos++
+		case cmd == vgmCmdWait50:
+			sample += 882
+			pos++
+		case cmd >= vgmCmdWaitN && cmd <= vgmCmdWaitN+0x0F:
+			sample += int64(cmd-vgmCmdWaitN) + 1
+			pos++
+		case cmd == vgmCmdEnd:
+			return
+		default:
+			return nil, fmt.Errorf("unsupported VGM command %02Xh "+
+				"at %Xh", cmd, pos)
+		}
+	}
+	return nil, os.NewError("VGM data is truncated")
+}
@@ -0,0 +1,159 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Collects everything the mixer outputs.
+type captureOutput struct {
+	samples []int16
+}
+
+func (out *captureOutput) play(buf []int16) {
+	out.samples = append(out.samples, buf...)
+}
+
+func (out *captureOutput) close() {}
+
+// A memory with only the sound hardware attached.
+func newSoundTestMemory(out audioOutput, log bool) *memory {
+	cfg := &Config{AudioFreq: 48000, AudioBuffers: 4}
+	m := &memory{config: cfg, dpadBits: 0xF, btnBits: 0xF, held: 0xFF,
+		speed: 100}
+	audio := newMixerOutput(m, out)
+	if log {
+		m.vgm = newVGMLog(m.ticks)
+	}
+	m.connect(&display{memory: m}, audio)
+	return m
+}
+
+func runSoundTo(m *memory, ticks int64) {
+	for m.ticks < ticks {
+		t := 4
+		if d := ticks - m.ticks; d < 4 {
+			t = int(d)
+		}
+		m.updateTimers(t)
+		m.audio.step(t)
+	}
+}
+
+// Writes are placed mid-way between mixer steps, so that rounding
+// their times to VGM samples does not move them to another step.
+func at(step int) int64 {
+	return int64(step*mixerStepTicks + mixerStepTicks/2)
+}
+
+var vgmTestWrites = []struct {
+	ticks int64
+	addr  uint16
+	x     byte
+}{
+	{at(0), portNR52, 0x80},
+	{at(0), portNR50, 0x77},
+	{at(0), portNR51, 0xFF},
+	{at(1), portNR11, 0x80},
+	{at(1), portNR12, 0xF3},
+	{at(1), portNR13, 0x00},
+	{at(1), portNR14, 0x87},
+	{at(2), portWAVE + 0x0, 0x01},
+	{at(2), portWAVE + 0x1, 0x23},
+	{at(2), portWAVE + 0x2, 0x45},
+	{at(2), portWAVE + 0x3, 0x67},
+	{at(2), portWAVE + 0x4, 0x89},
+	{at(2), portWAVE + 0x5, 0xAB},
+	{at(2), portWAVE + 0x6, 0xCD},
+	{at(2), portWAVE + 0x7, 0xEF},
+	{at(2), portNR30, 0x80},
+	{at(2), portNR32, 0x20},
+	{at(2), portNR33, 0x40},
+	{at(2), portNR34, 0x86},
+	{at(5), portNR21, 0x40},
+	{at(5), portNR22, 0xA1},
+	{at(5), portNR23, 0x80},
+	{at(5), portNR24, 0xC6},
+	{at(9), portNR42, 0xF1},
+	{at(9), portNR43, 0x45},
+	{at(9), portNR44, 0x80},
+	{at(300), portNR12, 0x00},
+	{at(301), portNR51, 0x0F},
+}
+
+const vgmTestEnd = 400 * mixerStepTicks
+
+func TestVGMRoundTrip(t *testing.T) {
+	orig := new(captureOutput)
+	m := newSoundTestMemory(orig, true)
+	for _, w := range vgmTestWrites {
+		runSoundTo(m, w.ticks)
+		m.writePort(w.addr, w.x)
+	}
+	runSoundTo(m, vgmTestEnd)
+	m.audio.close()
+
+	var file bytes.Buffer
+	if err := m.vgm.writeTo(&file, m.ticks); err != nil {
+		t.Fatal(err)
+	}
+	writes, err := readVGM(file.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The log should begin with the registers set at power on.
+	init := len(writes) - len(vgmTestWrites)
+	if init < 0 {
+		t.Fatalf("got %d writes, expected at least %d",
+			len(writes), len(vgmTestWrites))
+	}
+	for i, w := range vgmTestWrites {
+		got := writes[init+i]
+		if got.addr != w.addr || got.x != w.x {
+			t.Errorf("write %d: got %04X=%02X, expected %04X=%02X",
+				i, got.addr, got.x, w.addr, w.x)
+		}
+	}
+
+	replay := new(captureOutput)
+	m = newSoundTestMemory(replay, false)
+	for _, w := range writes {
+		runSoundTo(m, w.sample*ticksFreq/vgmRate)
+		m.writePort(w.addr, w.x)
+	}
+	runSoundTo(m, vgmTestEnd)
+	m.audio.close()
+
+	if len(replay.samples) != len(orig.samples) {
+		t.Fatalf("replay produced %d samples, expected %d",
+			len(replay.samples), len(orig.samples))
+	}
+	for i := range orig.samples {
+		if replay.samples[i] != orig.samples[i] {
+			t.Fatalf("replay differs at sample %d", i/2)
+		}
+	}
+}
+
+func TestVGMWaits(t *testing.T) {
+	for _, n := range []int64{1, 16, 17, 735, 882, 0xFFFF, 0x10000, 200000} {
+		v := newVGMLog(0)
+		v.write(n*ticksFreq/vgmRate+1, portNR52, 0x80)
+		var file bytes.Buffer
+		if err := v.writeTo(&file, 0); err != nil {
+			t.Fatal(err)
+		}
+		writes, err := readVGM(file.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) != 1 || writes[0].sample != v.samples {
+			t.Errorf("wait %d: got %v", n, writes)
+		}
+	}
+}
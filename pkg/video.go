@@ -0,0 +1,252 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"os"
+)
+
+const (
+	aviHeaderSize = 326
+	aviFrameSize  = displayW * displayH * 3
+	aviMaxSize    = 1<<31 - 1<<24 // keep within what AVI 1.0 readers allow
+	aviKeyFrame   = 0x10
+)
+
+// An aviWriter saves frames and sound to an uncompressed AVI file,
+// with 24-bit RGB video at the exact DMG frame rate and 16-bit stereo
+// PCM audio.
+type aviWriter struct {
+	file    *os.File
+	name    string
+	rate    int // audio samples per second
+	frames  int
+	samples int    // stereo samples written
+	size    int    // bytes of chunks written to the movi list
+	index   []byte // idx1 entries
+	buf     []byte
+	err     os.Error
+
+	started bool // at a VBlank, so that sound and video are in step
+	stop    bool // at the next VBlank
+}
+
+func createAVI(name string, rate int) (*aviWriter, os.Error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &aviWriter{file: file, name: name, rate: rate,
+		buf: make([]byte, aviFrameSize)}
+	// As with WAV files, the header is written again once the
+	// sizes are known.
+	if _, err = file.Write(w.header()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *aviWriter) header() []byte {
+	var b bytes.Buffer
+	put := func(fields ...interface{}) {
+		for _, f := range fields {
+			if s, ok := f.(string); ok {
+				b.WriteString(s)
+			} else {
+				binary.Write(&b, binary.LittleEndian, f)
+			}
+		}
+	}
+	riff := aviHeaderSize - 8 + w.size + 8 + len(w.index)
+	put("RIFF", uint32(riff), "AVI ")
+	put("LIST", uint32(aviHeaderSize-32), "hdrl")
+	put("avih", uint32(56),
+		uint32(1000000*refreshTicks/ticksFreq), // µs per frame
+		uint32(aviFrameSize*60+w.rate*4),
+		uint32(0), uint32(0x10), // has index
+		uint32(w.frames), uint32(0), uint32(2),
+		uint32(aviFrameSize), uint32(displayW), uint32(displayH),
+		[4]uint32{})
+
+	put("LIST", uint32(4+64+48), "strl")
+	put("strh", uint32(56), "vids", "DIB ",
+		uint32(0), uint16(0), uint16(0), uint32(0),
+		uint32(refreshTicks), uint32(ticksFreq), // 59.73 Hz
+		uint32(0), uint32(w.frames), uint32(aviFrameSize),
+		int32(-1), uint32(0), [4]int16{0, 0, displayW, displayH})
+	put("strf", uint32(40), uint32(40),
+		int32(displayW), int32(displayH), uint16(1), uint16(24),
+		uint32(0), uint32(aviFrameSize), [4]uint32{})
+
+	put("LIST", uint32(4+64+26), "strl")
+	put("strh", uint32(56), "auds", uint32(0),
+		uint32(0), uint16(0), uint16(0), uint32(0),
+		uint32(1), uint32(w.rate),
+		uint32(0), uint32(w.samples), uint32(w.rate*4),
+		int32(-1), uint32(4), [4]int16{})
+	put("strf", uint32(18), uint16(1), uint16(2),
+		uint32(w.rate), uint32(w.rate*4), uint16(4), uint16(16),
+		uint16(0))
+
+	put("LIST", uint32(4+w.size), "movi")
+	return b.Bytes()
+}
+
+func (w *aviWriter) chunk(id string, data interface{}, n int) {
+	if w.err != nil {
+		return
+	}
+	var h [8]byte
+	copy(h[:], id)
+	binary.LittleEndian.PutUint32(h[4:], uint32(n))
+	if _, w.err = w.file.Write(h[:]); w.err == nil {
+		w.err = binary.Write(w.file, binary.LittleEndian, data)
+	}
+	if n&1 != 0 && w.err == nil {
+		_, w.err = w.file.Write([]byte{0})
+	}
+
+	var e [16]byte
+	copy(e[:], id)
+	binary.LittleEndian.PutUint32(e[4:], aviKeyFrame)
+	binary.LittleEndian.PutUint32(e[8:], uint32(4+w.size))
+	binary.LittleEndian.PutUint32(e[12:], uint32(n))
+	w.index = append(w.index, e[:]...)
+	w.size += 8 + (n+1)&^1
+}
+
+// frame adds a frame, as kept by the display, in the given colours.
+func (w *aviWriter) frame(pix []byte, colors *[16]image.RGBAColor) {
+	// rows are stored bottom-up, in BGR order
+	i := 0
+	for y := displayH - 1; y >= 0; y-- {
+		for _, p := range pix[y*displayW : (y+1)*displayW] {
+			c := colors[p&15]
+			w.buf[i], w.buf[i+1], w.buf[i+2] = c.B, c.G, c.R
+			i += 3
+		}
+	}
+	w.chunk("00db", w.buf, aviFrameSize)
+	w.frames++
+}
+
+func (w *aviWriter) audio(samples []int16) {
+	if len(samples) > 0 {
+		w.chunk("01wb", samples, len(samples)*2)
+		w.samples += len(samples) / 2
+	}
+}
+
+func (w *aviWriter) full() bool {
+	return aviHeaderSize+w.size+len(w.index) > aviMaxSize
+}
+
+func (w *aviWriter) close() os.Error {
+	if w.err == nil {
+		var h [8]byte
+		copy(h[:], "idx1")
+		binary.LittleEndian.PutUint32(h[4:], uint32(len(w.index)))
+		if _, w.err = w.file.Write(h[:]); w.err == nil {
+			_, w.err = w.file.Write(w.index)
+		}
+	}
+	if w.err == nil {
+		_, w.err = w.file.WriteAt(w.header(), 0)
+	}
+	if err := w.file.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// startVideo begins recording the screen and sound to name. Nothing
+// is recorded until the next VBlank.
+func (m *memory) startVideo(name string) os.Error {
+	if m.video != nil {
+		return os.NewError("already recording")
+	}
+	w, err := createAVI(name, m.audio.outputRate())
+	if err != nil {
+		return err
+	}
+	m.video = w
+	return nil
+}
+
+// videoFrame is called at each VBlank to add the frame (and the sound
+// since the last one) to the video being recorded, and to start or
+// finish recording.
+func (lcd *display) videoFrame() {
+	w := lcd.video
+	if !w.started {
+		w.started = true
+		lcd.audio.captured = lcd.audio.frame
+	}
+	if w.stop || w.full() {
+		lcd.stopVideo()
+		return
+	}
+	lcd.audio.capture()
+	w.frame(lcd.frame[:], &lcd.colors)
+}
+
+// stopVideo finishes the video being recorded, if any, and reports
+// the outcome.
+func (m *memory) stopVideo() {
+	if w := m.video; w != nil {
+		if err := m.closeVideo(); err != nil {
+			m.error("video failed: %v", err)
+		} else {
+			m.message("saved %s (%d frames)", w.name, w.frames)
+		}
+	}
+}
+
+func (m *memory) closeVideo() os.Error {
+	m.audio.capture()
+	w := m.video
+	m.video = nil
+	return w.close()
+}
+
+// nullOutput discards sound, for running without an audio device.
+type nullOutput struct{}
+
+func (nullOutput) play(buf []int16) {}
+
+func (nullOutput) close() {}
+
+// RenderMovie plays back a movie for the ROM image at path, without
+// any audio or video devices, and records the result to an AVI
+// file. If frames is 0 the whole movie is rendered.
+func RenderMovie(path, movie string, frames int, cfg Config, avi string) os.Error {
+	cfg.MovieFile = movie
+	cfg.MovieMode = MovieReadOnly
+	sys, err := startHeadless(path, &cfg)
+	if err != nil {
+		return err
+	}
+	defer sys.audio.close()
+
+	mem := sys.memory
+	if frames == 0 {
+		frames = len(mem.movie.frames)
+	}
+	if err := mem.startVideo(avi); err != nil {
+		return err
+	}
+	w := mem.video
+	for mem.video != nil && w.frames < frames {
+		sys.runFrame()
+	}
+	if mem.video == nil {
+		return w.err // stopped early, at the size limit
+	}
+	return mem.closeVideo()
+}
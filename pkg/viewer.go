@@ -0,0 +1,306 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path"
+)
+
+// The debug views that can be shown beside the screen, or saved with
+// DumpVRAM.
+const (
+	ViewScreen   = iota
+	ViewTiles    // the 384 tiles in VRAM
+	ViewMaps     // both background maps, with the viewport outlined
+	ViewOAM      // the 40 sprites and their attributes
+	ViewPalettes // BGP, OBP0 and OBP1
+	numViews
+)
+
+var viewNames = [numViews]string{"screen", "tiles", "maps", "oam", "palettes"}
+
+const (
+	viewBackColor   = 0x404040
+	viewTextColor   = 0xFFFFFF
+	viewportColor   = 0xFF0000
+	viewWindowColor = 0x0080FF
+
+	oamCellW = 32
+	oamCellH = 26
+)
+
+// A canvas is a picture made in 0xRRGGBB pixels, for the views.
+type canvas struct {
+	w, h int
+	pix  []uint32
+}
+
+func newCanvas(w, h int) *canvas {
+	return &canvas{w, h, make([]uint32, w*h)}
+}
+
+func (c *canvas) set(x, y int, color uint32) {
+	if x >= 0 && x < c.w && y >= 0 && y < c.h {
+		c.pix[y*c.w+x] = color
+	}
+}
+
+func (c *canvas) fill(color uint32) {
+	for i := range c.pix {
+		c.pix[i] = color
+	}
+}
+
+func (c *canvas) text(x, y int, color uint32, format string, args ...interface{}) {
+	textPixels(x, y, fmt.Sprintf(format, args...), func(x, y int) {
+		c.set(x, y, color)
+	})
+}
+
+func (c *canvas) image() image.Image {
+	img := image.NewRGBA(c.w, c.h)
+	for y := 0; y < c.h; y++ {
+		for x := 0; x < c.w; x++ {
+			p := c.pix[y*c.w+x]
+			img.Set(x, y, image.RGBAColor{byte(p >> 16),
+				byte(p >> 8), byte(p), 0xFF})
+		}
+	}
+	return img
+}
+
+// viewCanvas returns a canvas of the right size for view v.
+func viewCanvas(v int) *canvas {
+	switch v {
+	case ViewTiles:
+		return newCanvas(16*tileW, 24*tileH)
+	case ViewMaps:
+		return newCanvas(2*mapW*tileW+tileW, mapH*tileH)
+	case ViewOAM:
+		return newCanvas(8*oamCellW, 5*oamCellH)
+	case ViewPalettes:
+		return newCanvas(84, 44)
+	}
+	return nil
+}
+
+// drawView draws view v on c, which must have come from viewCanvas.
+func (lcd *display) drawView(v int, c *canvas) {
+	c.fill(viewBackColor)
+	switch v {
+	case ViewTiles:
+		lcd.drawTiles(c)
+	case ViewMaps:
+		lcd.drawMaps(c)
+	case ViewOAM:
+		lcd.drawOAM(c)
+	case ViewPalettes:
+		lcd.drawPalettes(c)
+	}
+}
+
+// tilePixel returns the colour number of a pixel in the tile at addr
+// in VRAM.
+func (lcd *display) tilePixel(addr, x, y int) byte {
+	bit := uint(tileW - 1 - x)
+	px := (lcd.vram[addr+y*2] >> bit) & 1
+	px |= ((lcd.vram[addr+y*2+1] >> bit) & 1) << 1
+	return px
+}
+
+// shadeColor returns the colour of a shade as drawn by a layer.
+func (lcd *display) shadeColor(shade, layer byte) uint32 {
+	return rgbOf(lcd.colors[shade|layer<<2])
+}
+
+func (lcd *display) drawTiles(c *canvas) {
+	for t := 0; t < 384; t++ {
+		x0 := t % 16 * tileW
+		y0 := t / 16 * tileH
+		for y := 0; y < tileH; y++ {
+			for x := 0; x < tileW; x++ {
+				px := lcd.tilePixel(t*16, x, y)
+				c.set(x0+x, y0+y,
+					lcd.shadeColor(lcd.bgp[px], layerBG))
+			}
+		}
+	}
+}
+
+func (lcd *display) drawMaps(c *canvas) {
+	const size = mapW * tileW
+	for m := 0; m < 2; m++ {
+		x0 := m * (size + tileW)
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				px := lcd.mapAt(m == 1, x, y)
+				c.set(x0+x, y,
+					lcd.shadeColor(lcd.bgp[px], layerBG))
+			}
+		}
+	}
+
+	// The part of the background on screen, which wraps around.
+	x0 := 0
+	if lcd.bgMap {
+		x0 = size + tileW
+	}
+	outline := func(x0, left, top, w, h int, color uint32) {
+		for i := 0; i < w; i++ {
+			c.set(x0+(left+i)%size, top%size, color)
+			c.set(x0+(left+i)%size, (top+h-1)%size, color)
+		}
+		for i := 0; i < h; i++ {
+			c.set(x0+left%size, (top+i)%size, color)
+			c.set(x0+(left+w-1)%size, (top+i)%size, color)
+		}
+	}
+	outline(x0, int(lcd.scx), int(lcd.scy), displayW, displayH,
+		viewportColor)
+
+	// The part of the window map shown, if any.
+	if lcd.windowEnable && lcd.wx < 167 && lcd.wy < displayH {
+		x0 = 0
+		if lcd.windowMap {
+			x0 = size + tileW
+		}
+		w := displayW - (int(lcd.wx) - 7)
+		if w > displayW {
+			w = displayW
+		}
+		outline(x0, 0, 0, w, displayH-int(lcd.wy), viewWindowColor)
+	}
+}
+
+func (lcd *display) drawOAM(c *canvas) {
+	h := 8
+	if lcd.spriteSize {
+		h = 16
+	}
+	for n := 0; n < 40; n++ {
+		y, x := lcd.oam[n*4], lcd.oam[n*4+1]
+		tile, info := int(lcd.oam[n*4+2]), lcd.oam[n*4+3]
+		if h == 16 {
+			tile &= 0xFE
+		}
+		x0 := n % 8 * oamCellW
+		y0 := n / 8 * oamCellH
+		palidx := (info >> 4) & 1
+		for ty := 0; ty < h; ty++ {
+			for tx := 0; tx < tileW; tx++ {
+				sx, sy := tx, ty
+				if info&0x20 != 0 {
+					sx = tileW - 1 - tx
+				}
+				if info&0x40 != 0 {
+					sy = h - 1 - ty
+				}
+				px := lcd.tilePixel(tile*16, sx, sy)
+				if px != 0 {
+					c.set(x0+2+tx, y0+2+ty, lcd.shadeColor(
+						lcd.obp[palidx][px], layerOBJ0+palidx))
+				}
+			}
+		}
+		c.text(x0+12, y0+2, viewTextColor, "X:%02X", x)
+		c.text(x0+12, y0+8, viewTextColor, "Y:%02X", y)
+		c.text(x0+12, y0+14, viewTextColor, "T:%02X", tile)
+		c.text(x0+12, y0+20, viewTextColor, "A:%02X", info)
+	}
+}
+
+func (lcd *display) drawPalettes(c *canvas) {
+	regs := []struct {
+		name  string
+		pal   *[4]byte
+		layer byte
+	}{
+		{"BGP", &lcd.bgp, layerBG},
+		{"OBP0", &lcd.obp[0], layerOBJ0},
+		{"OBP1", &lcd.obp[1], layerOBJ1},
+	}
+	for n, r := range regs {
+		y0 := 2 + n*14
+		c.text(2, y0+3, viewTextColor, "%s", r.name)
+		var value byte
+		for i, shade := range r.pal {
+			value |= shade << uint(i*2)
+			color := lcd.shadeColor(shade, r.layer)
+			for y := 0; y < 10; y++ {
+				for x := 0; x < 10; x++ {
+					c.set(22+i*12+x, y0+y, color)
+				}
+			}
+		}
+		c.text(72, y0+3, viewTextColor, "%02X", value)
+	}
+}
+
+// setView shows view v to the right of the screen, widening the
+// window to fit both, since SDL 1.2 allows only one window.
+func (lcd *display) setView(v int) {
+	if lcd.screen == nil || v == lcd.view || v < 0 || v >= numViews {
+		return
+	}
+	lcd.view = v
+
+	w, h := lcd.screenW, lcd.screenH
+	title := lcd.rom.title()
+	if v != ViewScreen {
+		lcd.canvas = viewCanvas(v)
+		lcd.viewScale = 1
+		if lcd.config.Scale > 1 {
+			lcd.viewScale = 2
+		}
+		vw := lcd.canvas.w * lcd.viewScale
+		vh := lcd.canvas.h * lcd.viewScale
+		lcd.viewBuf = make([]uint32, vw*vh)
+		w += vw
+		if vh > h {
+			h = vh
+		}
+		title += " - " + viewNames[v]
+	}
+	lcd.screen.setCaption(title)
+	lcd.screen.setMode(w, h)
+	lcd.setPalette(lcd.palName) // the screen format may differ
+	lcd.clear()
+}
+
+// showView draws the current view beside the screen, at VBlank.
+func (lcd *display) showView() {
+	c := lcd.canvas
+	lcd.drawView(lcd.view, c)
+	nearest(lcd.viewBuf, c.pix, c.w, c.h, lcd.viewScale)
+	lcd.screen.blit(lcd.viewBuf, lcd.screenW, 0, c.w*lcd.viewScale,
+		c.h*lcd.viewScale)
+}
+
+// DumpVRAM runs the ROM image at rom for the given number of frames
+// (playing any movie given in cfg), without any audio or video
+// devices, then saves each debug view as a PNG file in dir.
+func DumpVRAM(rom string, frames int, cfg Config, dir string) os.Error {
+	sys, err := startHeadless(rom, &cfg)
+	if err != nil {
+		return err
+	}
+	defer sys.audio.close()
+	for n := 0; n < frames; n++ {
+		sys.runFrame()
+	}
+	for v := ViewTiles; v < numViews; v++ {
+		c := viewCanvas(v)
+		sys.lcd.drawView(v, c)
+		name := fmt.Sprintf("%s-%d-%s.png", sys.rom.title(), frames,
+			viewNames[v])
+		if err := writePNG(path.Join(dir, name), c.image()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 Kevin Bulusek. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gameboy
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const wavHeaderSize = 44
+
+// A wavOutput writes mixed audio to a 16-bit stereo PCM WAV file.
+type wavOutput struct {
+	file *os.File
+	rate int
+	size int // bytes of sample data written
+	err  os.Error
+}
+
+func createWAV(name string, rate int) (*wavOutput, os.Error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	out := &wavOutput{file: file, rate: rate}
+	// The header is written again with the correct sizes when the
+	// file is closed.
+	if err = out.writeHeader(); err == nil {
+		_, err = file.Seek(wavHeaderSize, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+func (out *wavOutput) writeHeader() os.Error {
+	var h [wavHeaderSize]byte
+	le := binary.LittleEndian
+	copy(h[0:], "RIFF")
+	le.PutUint32(h[4:], uint32(36+out.size))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	le.PutUint32(h[16:], 16)
+	le.PutUint16(h[20:], 1) // PCM
+	le.PutUint16(h[22:], 2)
+	le.PutUint32(h[24:], uint32(out.rate))
+	le.PutUint32(h[28:], uint32(out.rate*4))
+	le.PutUint16(h[32:], 4)
+	le.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	le.PutUint32(h[40:], uint32(out.size))
+	_, err := out.file.WriteAt(h[:], 0)
+	return err
+}
+
+func (out *wavOutput) play(buf []int16) {
+	if out.err != nil {
+		return
+	}
+	out.err = binary.Write(out.file, binary.LittleEndian, buf)
+	out.size += len(buf) * 2
+}
+
+func (out *wavOutput) close() {
+	if err := out.writeHeader(); out.err == nil {
+		out.err = err
+	}
+	if err := out.file.Close(); out.err == nil {
+		out.err = err
+	}
+}